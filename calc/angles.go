@@ -0,0 +1,249 @@
+package calc
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// inDegrees returns the function taking or returning angles in degrees
+// instead of radians. The arguments are converted in place, since they are
+// always a copy made for the call.
+func (f function) inDegrees() function {
+	if !f.angleArgs && !f.angleResult {
+		return f
+	}
+
+	deg := f
+	deg.fn = func(args []float64) (float64, error) {
+		if f.angleArgs {
+			if steps, ok := floatDegreeSteps(args[0]); ok {
+				if res, ok, err := exactTrig(f.symbol, steps); ok || err != nil {
+					return res.float(), err
+				}
+			}
+			for i := range args {
+				args[i] = math.Mod(args[i], 360) * math.Pi / 180
+			}
+		}
+		res, err := f.fn(args)
+		if err != nil || !f.angleResult {
+			return res, err
+		}
+		return snapDegrees(res * 180 / math.Pi), nil
+	}
+
+	if f.bigFn != nil {
+		deg.bigFn = func(args []*big.Float) (*big.Float, error) {
+			if f.angleArgs {
+				prec := args[0].Prec()
+				x, _ := args[0].Rat(nil)
+				if steps, ok := ratDegreeSteps(x); ok {
+					if res, ok, err := exactTrig(f.symbol, steps); err != nil {
+						return nil, err
+					} else if ok {
+						return res.bigFloat(prec), nil
+					}
+				}
+				args[0] = new(big.Float).SetPrec(prec).SetRat(ratMod(x, 360))
+				args[0].Mul(args[0], bigPi(prec))
+				args[0].Quo(args[0], big.NewFloat(180))
+			}
+			res, err := f.bigFn(args)
+			if err != nil || !f.angleResult {
+				return res, err
+			}
+			res.Mul(res, big.NewFloat(180))
+			return res.Quo(res, bigPi(res.Prec())), nil
+		}
+	}
+
+	if f.ratFn != nil {
+		deg.ratFn = func(args []*big.Rat) (*big.Rat, error) {
+			if f.angleArgs {
+				steps, ok := ratDegreeSteps(args[0])
+				if !ok {
+					return nil, nil
+				}
+				res, ok, err := exactTrig(f.symbol, steps)
+				if !ok || err != nil {
+					return nil, err
+				}
+				return res.rat(), nil
+			}
+			res, err := f.ratFn(args)
+			// only 0 is rational in both units
+			if err != nil || (res != nil && res.Sign() == 0) {
+				return res, err
+			}
+			return inverseTrigRat(f, args[0]), nil
+		}
+	}
+
+	if f.complexFn != nil {
+		deg.complexFn = func(args []complex128) (complex128, error) {
+			if f.angleArgs {
+				for i := range args {
+					args[i] *= math.Pi / 180
+				}
+			}
+			res, err := f.complexFn(args)
+			if err != nil || !f.angleResult {
+				return res, err
+			}
+			return res * 180 / math.Pi, nil
+		}
+	}
+
+	return deg
+}
+
+// trigValue is sign*√(num/den), the sine, cosine or tangent of an angle
+// multiple of 30 or 45 degrees, eg: sin(60) = √(3/4).
+type trigValue struct {
+	sign     int64
+	num, den int64
+}
+
+func (v trigValue) float() float64 {
+	if v.num == 0 {
+		return 0
+	}
+	return float64(v.sign) * math.Sqrt(float64(v.num)/float64(v.den))
+}
+
+func (v trigValue) bigFloat(prec uint) *big.Float {
+	res := new(big.Float).SetPrec(prec).SetRat(big.NewRat(v.num, v.den))
+	res.Sqrt(res)
+	if v.sign < 0 {
+		res.Neg(res)
+	}
+	return res
+}
+
+// rat returns the value as a fraction, or nil if it is irrational.
+func (v trigValue) rat() *big.Rat {
+	square := big.NewRat(v.num, v.den)
+	num, den := new(big.Int).Sqrt(square.Num()), new(big.Int).Sqrt(square.Denom())
+	if new(big.Int).Mul(num, num).Cmp(square.Num()) != 0 || new(big.Int).Mul(den, den).Cmp(square.Denom()) != 0 {
+		return nil
+	}
+	res := new(big.Rat).SetFrac(num, den)
+	if v.sign < 0 {
+		res.Neg(res)
+	}
+	return res
+}
+
+// exactTrig returns the sine, cosine or tangent of an angle of steps*15
+// degrees, with 0 <= steps < 24, if it is a multiple of 30 or 45 degrees.
+// Converting them to radians isn't exact, so sin(30) would be
+// 0.49999999999999994 and tan(90) a huge number instead of an error.
+func exactTrig(symbol string, steps int) (trigValue, bool, error) {
+	if steps%2 != 0 && steps%3 != 0 {
+		return trigValue{}, false, nil
+	}
+
+	// in the first quadrant sin = √(k/4) for 0, 30, 45 and 60 degrees, and
+	// cos(x) = sin(90-x)
+	sinK := [...]int64{0: 0, 2: 1, 3: 2, 4: 3}[steps%6]
+	cosK := 4 - sinK
+	sinSign, cosSign := int64(1), int64(1)
+	switch steps / 6 {
+	case 1:
+		sinK, cosK = cosK, sinK
+		cosSign = -1
+	case 2:
+		sinSign, cosSign = -1, -1
+	case 3:
+		sinK, cosK = cosK, sinK
+		sinSign = -1
+	}
+
+	switch symbol {
+	case fnSin.symbol:
+		return trigValue{sign: sinSign, num: sinK, den: 4}, true, nil
+	case fnCos.symbol:
+		return trigValue{sign: cosSign, num: cosK, den: 4}, true, nil
+	case fnTan.symbol:
+		if cosK == 0 {
+			return trigValue{}, false, fmt.Errorf("tan(%d): %w", steps*15, errDivisionByZero)
+		}
+		return trigValue{sign: sinSign * cosSign, num: sinK, den: cosK}, true, nil
+	}
+	return trigValue{}, false, nil
+}
+
+// floatDegreeSteps returns x reduced to [0, 360) in steps of 15 degrees, if
+// it is a multiple of them.
+func floatDegreeSteps(x float64) (int, bool) {
+	if math.IsInf(x, 0) || math.IsNaN(x) || math.Mod(x, 15) != 0 {
+		return 0, false
+	}
+	steps := int(math.Mod(x, 360) / 15)
+	return (steps + 24) % 24, true
+}
+
+// ratDegreeSteps is like floatDegreeSteps for fractions.
+func ratDegreeSteps(x *big.Rat) (int, bool) {
+	if x == nil {
+		return 0, false
+	}
+	steps := new(big.Rat).Quo(x, big.NewRat(15, 1))
+	if !steps.IsInt() {
+		return 0, false
+	}
+	return int(new(big.Int).Mod(steps.Num(), big.NewInt(24)).Int64()), true
+}
+
+// ratMod returns x reduced to [0, m).
+func ratMod(x *big.Rat, m int64) *big.Rat {
+	quo := new(big.Int).Div(x.Num(), new(big.Int).Mul(x.Denom(), big.NewInt(m)))
+	return new(big.Rat).Sub(x, new(big.Rat).SetInt(quo.Mul(quo, big.NewInt(m))))
+}
+
+// snapDegrees rounds angles a few ulps away from an integer, the error of
+// converting them from radians, eg: asin(0.5) would be 30.000000000000004.
+func snapDegrees(x float64) float64 {
+	const maxUlps = 4
+	rounded := math.Round(x)
+	if math.Abs(x-rounded) <= maxUlps*(math.Nextafter(math.Abs(x), math.Inf(1))-math.Abs(x)) {
+		return rounded
+	}
+	return x
+}
+
+// inverseTrigRat returns the result in degrees of asin, acos or atan if it is
+// an integer, checked with exactTrig since x is exact, eg: asin(1/2) = 30.
+func inverseTrigRat(f function, x *big.Rat) *big.Rat {
+	var forward string
+	switch f.symbol {
+	case fnAsin.symbol:
+		forward = fnSin.symbol
+	case fnAcos.symbol:
+		forward = fnCos.symbol
+	case fnAtan.symbol:
+		forward = fnTan.symbol
+	default:
+		return nil
+	}
+
+	xFloat, _ := x.Float64()
+	res, err := f.fn([]float64{xFloat})
+	if err != nil {
+		return nil
+	}
+	angle := snapDegrees(res * 180 / math.Pi)
+	steps, ok := floatDegreeSteps(angle)
+	if !ok {
+		return nil
+	}
+	value, ok, err := exactTrig(forward, steps)
+	if !ok || err != nil {
+		return nil
+	}
+	if rat := value.rat(); rat == nil || rat.Cmp(x) != 0 {
+		return nil
+	}
+	return new(big.Rat).SetFloat64(angle)
+}
@@ -0,0 +1,374 @@
+package calc
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"sync"
+)
+
+// Extra bits used internally by the series below, so the result is correct
+// to the precision of the argument.
+const bigGuardBits = 64
+
+// Arguments with a bigger binary exponent than this are rejected by the
+// functions that need argument reduction, to avoid working with absurd
+// precisions.
+const bigMaxExp = 1 << 16
+
+var errOverflow = errors.New("overflow")
+
+var piCache struct {
+	sync.Mutex
+	pi *big.Float
+}
+
+// bigPi returns pi rounded to prec bits, using Machin's formula:
+// pi = 16*atan(1/5) - 4*atan(1/239)
+func bigPi(prec uint) *big.Float {
+	piCache.Lock()
+	defer piCache.Unlock()
+
+	if piCache.pi == nil || piCache.pi.Prec() < prec {
+		wprec := prec + bigGuardBits
+		a := bigAtanInv(5, wprec)
+		b := bigAtanInv(239, wprec)
+		a.Mul(a, big.NewFloat(16))
+		b.Mul(b, big.NewFloat(4))
+		piCache.pi = a.Sub(a, b)
+	}
+
+	return new(big.Float).SetPrec(prec).Set(piCache.pi)
+}
+
+// bigAtanInv returns atan(1/n) with the taylor series.
+func bigAtanInv(n int64, prec uint) *big.Float {
+	nn := new(big.Float).SetPrec(prec).SetInt64(n * n)
+	term := new(big.Float).SetPrec(prec).SetInt64(1)
+	term.Quo(term, new(big.Float).SetInt64(n))
+	sum := new(big.Float).SetPrec(prec).Set(term)
+	t := new(big.Float).SetPrec(prec)
+
+	for k := int64(1); ; k++ {
+		term.Quo(term, nn)
+		t.Quo(term, new(big.Float).SetInt64(2*k+1))
+		if t.Sign() == 0 || t.MantExp(nil) < sum.MantExp(nil)-int(prec) {
+			break
+		}
+		if k%2 == 1 {
+			sum.Sub(sum, t)
+		} else {
+			sum.Add(sum, t)
+		}
+	}
+	return sum
+}
+
+func bigHalfPi(prec uint) *big.Float {
+	pi := bigPi(prec)
+	return pi.SetMantExp(pi, -1)
+}
+
+// bigExp returns e**x.
+func bigExp(x *big.Float) (*big.Float, error) {
+	prec := x.Prec()
+	if x.Sign() == 0 {
+		return new(big.Float).SetPrec(prec).SetInt64(1), nil
+	}
+	if x.MantExp(nil) > 32 {
+		if x.Sign() < 0 {
+			return new(big.Float).SetPrec(prec), nil
+		}
+		return nil, errOverflow
+	}
+
+	// e**x = (e**(x/2**k))**(2**k)
+	k := max(0, x.MantExp(nil)+8)
+	wprec := prec + uint(k) + bigGuardBits
+	r := new(big.Float).SetPrec(wprec).Set(x)
+	r.SetMantExp(r, -k)
+
+	sum := new(big.Float).SetPrec(wprec).SetInt64(1)
+	term := new(big.Float).SetPrec(wprec).SetInt64(1)
+	for n := int64(1); ; n++ {
+		term.Mul(term, r)
+		term.Quo(term, new(big.Float).SetInt64(n))
+		if term.Sign() == 0 || term.MantExp(nil) < sum.MantExp(nil)-int(wprec) {
+			break
+		}
+		sum.Add(sum, term)
+	}
+	for range k {
+		sum.Mul(sum, sum)
+	}
+	if sum.IsInf() {
+		return nil, errOverflow
+	}
+	return sum.SetPrec(prec), nil
+}
+
+// bigLog returns the natural logarithm of x, which must be positive.
+func bigLog(x *big.Float) *big.Float {
+	prec := x.Prec()
+	if x.Sign() <= 0 {
+		panic("logarithm of a non positive number")
+	}
+	if x.Cmp(big.NewFloat(1)) == 0 {
+		return new(big.Float).SetPrec(prec)
+	}
+
+	// log(x) = log(m) + e*log(2), with 0.5 <= m < 1
+	m := new(big.Float)
+	e := x.MantExp(m)
+	wprec := prec + bigGuardBits + uint(bitLength(e))
+
+	res := bigLogNewton(m.SetPrec(wprec))
+	if e != 0 {
+		ln2 := bigLogNewton(new(big.Float).SetPrec(wprec).SetInt64(2))
+		res.Add(res, ln2.Mul(ln2, new(big.Float).SetInt64(int64(e))))
+	}
+	return res.SetPrec(prec)
+}
+
+// bigLogNewton solves exp(y) = x for y, x being close to 1.
+func bigLogNewton(x *big.Float) *big.Float {
+	prec := x.Prec()
+	f, _ := x.Float64()
+	y := new(big.Float).SetPrec(prec).SetFloat64(math.Log(f))
+
+	num := new(big.Float).SetPrec(prec)
+	den := new(big.Float).SetPrec(prec)
+	for range 64 {
+		// Halley's method: y += 2*(x - exp(y)) / (x + exp(y))
+		ey, err := bigExp(y)
+		if err != nil {
+			panic(err)
+		}
+		num.Sub(x, ey)
+		den.Add(x, ey)
+		num.Quo(num, den)
+		num.SetMantExp(num, 1)
+		y.Add(y, num)
+		if num.Sign() == 0 || num.MantExp(nil) < min(y.MantExp(nil), 0)-int(prec) {
+			break
+		}
+	}
+	return y
+}
+
+func bitLength(n int) int {
+	bits := 0
+	for n != 0 {
+		n /= 2
+		bits++
+	}
+	return bits
+}
+
+// bigPow returns x**y.
+func bigPow(x, y *big.Float) (*big.Float, error) {
+	prec := max(x.Prec(), y.Prec())
+
+	if y.IsInt() && y.MantExp(nil) < 63 {
+		n, _ := y.Int64()
+		return bigPowInt(x, n)
+	}
+	if x.Sign() < 0 {
+		return nil, errNaN
+	}
+	if x.Sign() == 0 {
+		if y.Sign() < 0 {
+			return nil, errDivisionByZero
+		}
+		return new(big.Float).SetPrec(prec), nil
+	}
+
+	wprec := prec + bigGuardBits
+	l := bigLog(new(big.Float).SetPrec(wprec).Set(x))
+	l.Mul(l, y)
+	res, err := bigExp(l)
+	if err != nil {
+		return nil, err
+	}
+	return res.SetPrec(prec), nil
+}
+
+func bigPowInt(x *big.Float, n int64) (*big.Float, error) {
+	prec := x.Prec()
+	if n < 0 && x.Sign() == 0 {
+		return nil, errDivisionByZero
+	}
+
+	neg := n < 0
+	if neg {
+		n = -n
+	}
+
+	wprec := prec + bigGuardBits + uint(bitLength(int(n)))
+	base := new(big.Float).SetPrec(wprec).Set(x)
+	res := new(big.Float).SetPrec(wprec).SetInt64(1)
+	for n > 0 {
+		if n%2 == 1 {
+			res.Mul(res, base)
+		}
+		base.Mul(base, base)
+		n /= 2
+	}
+	if neg {
+		res.Quo(new(big.Float).SetPrec(wprec).SetInt64(1), res)
+	}
+	if res.IsInf() {
+		return nil, errOverflow
+	}
+	return res.SetPrec(prec), nil
+}
+
+// bigFloor returns the greatest integer value less than or equal to x.
+func bigFloor(x *big.Float) *big.Float {
+	i, acc := x.Int(nil)
+	if x.Sign() < 0 && acc != big.Exact {
+		i.Sub(i, big.NewInt(1))
+	}
+	return new(big.Float).SetPrec(x.Prec()).SetInt(i)
+}
+
+// bigSinCos returns sin(x) and cos(x).
+func bigSinCos(x *big.Float) (sin *big.Float, cos *big.Float, err error) {
+	prec := x.Prec()
+	if x.MantExp(nil) > bigMaxExp {
+		return nil, nil, errOverflow
+	}
+
+	// reduce to [-pi, pi]
+	wprec := prec + bigGuardBits + uint(max(0, x.MantExp(nil)))
+	twoPi := bigPi(wprec)
+	twoPi.SetMantExp(twoPi, 1)
+	r := new(big.Float).SetPrec(wprec).Set(x)
+	n := new(big.Float).SetPrec(wprec).Quo(r, twoPi)
+	n.Add(n, big.NewFloat(0.5))
+	n = bigFloor(n)
+	r.Sub(r, n.Mul(n, twoPi))
+
+	rr := new(big.Float).SetPrec(wprec).Mul(r, r)
+	rr.Neg(rr)
+
+	sin = new(big.Float).SetPrec(wprec).Set(r)
+	cos = new(big.Float).SetPrec(wprec).SetInt64(1)
+	sinTerm := new(big.Float).SetPrec(wprec).Set(r)
+	cosTerm := new(big.Float).SetPrec(wprec).SetInt64(1)
+	for k := int64(1); ; k++ {
+		// sin: r**(2k+1)/(2k+1)!, cos: r**(2k)/(2k)!
+		cosTerm.Mul(cosTerm, rr)
+		cosTerm.Quo(cosTerm, new(big.Float).SetInt64((2*k-1)*(2*k)))
+		sinTerm.Mul(sinTerm, rr)
+		sinTerm.Quo(sinTerm, new(big.Float).SetInt64((2*k)*(2*k+1)))
+		if cosTerm.Sign() == 0 || cosTerm.MantExp(nil) < -int(wprec) {
+			break
+		}
+		sin.Add(sin, sinTerm)
+		cos.Add(cos, cosTerm)
+	}
+
+	return sin.SetPrec(prec), cos.SetPrec(prec), nil
+}
+
+// bigAtan returns the arc tangent of x.
+func bigAtan(x *big.Float) *big.Float {
+	prec := x.Prec()
+	if x.Sign() == 0 {
+		return new(big.Float).SetPrec(prec)
+	}
+
+	wprec := prec + bigGuardBits
+	r := new(big.Float).SetPrec(wprec).Abs(x)
+	one := new(big.Float).SetPrec(wprec).SetInt64(1)
+
+	// atan(x) = pi/2 - atan(1/x)
+	inverted := r.Cmp(one) > 0
+	if inverted {
+		r.Quo(one, r)
+	}
+
+	// atan(x) = 2*atan(x / (1 + sqrt(1 + x**2)))
+	const halvings = 8
+	t := new(big.Float).SetPrec(wprec)
+	for range halvings {
+		t.Mul(r, r)
+		t.Add(t, one)
+		t.Sqrt(t)
+		t.Add(t, one)
+		r.Quo(r, t)
+	}
+
+	rr := new(big.Float).SetPrec(wprec).Mul(r, r)
+	rr.Neg(rr)
+	sum := new(big.Float).SetPrec(wprec).Set(r)
+	term := new(big.Float).SetPrec(wprec).Set(r)
+	for k := int64(1); ; k++ {
+		term.Mul(term, rr)
+		t.Quo(term, new(big.Float).SetInt64(2*k+1))
+		if t.Sign() == 0 || t.MantExp(nil) < sum.MantExp(nil)-int(wprec) {
+			break
+		}
+		sum.Add(sum, t)
+	}
+	sum.SetMantExp(sum, halvings)
+
+	if inverted {
+		sum.Sub(bigHalfPi(wprec), sum)
+	}
+	if x.Sign() < 0 {
+		sum.Neg(sum)
+	}
+	return sum.SetPrec(prec)
+}
+
+// bigAtan2 returns the arc tangent of y/x, using the signs of both to
+// determine the quadrant, like math.Atan2.
+func bigAtan2(y, x *big.Float) *big.Float {
+	prec := max(x.Prec(), y.Prec())
+
+	if x.Sign() == 0 {
+		switch y.Sign() {
+		case 0:
+			return new(big.Float).SetPrec(prec)
+		case -1:
+			return bigHalfPi(prec).Neg(bigHalfPi(prec))
+		default:
+			return bigHalfPi(prec)
+		}
+	}
+
+	res := bigAtan(new(big.Float).SetPrec(prec).Quo(y, x))
+	if x.Sign() < 0 {
+		if y.Sign() < 0 {
+			res.Sub(res, bigPi(prec))
+		} else {
+			res.Add(res, bigPi(prec))
+		}
+	}
+	return res
+}
+
+// bigAsin returns the arc sine of x, which must be in [-1, 1].
+func bigAsin(x *big.Float) (*big.Float, error) {
+	prec := x.Prec()
+	wprec := prec + bigGuardBits
+
+	// asin(x) = atan(x / sqrt(1 - x**2))
+	t := new(big.Float).SetPrec(wprec).Mul(x, x)
+	t.Sub(new(big.Float).SetInt64(1), t)
+	switch t.Sign() {
+	case -1:
+		return nil, errNaN
+	case 0:
+		res := bigHalfPi(prec)
+		if x.Sign() < 0 {
+			res.Neg(res)
+		}
+		return res, nil
+	}
+	t.Sqrt(t)
+	t.Quo(x, t)
+	return bigAtan(t).SetPrec(prec), nil
+}
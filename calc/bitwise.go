@@ -0,0 +1,215 @@
+package calc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+var (
+	errNotInteger = errors.New("not an integer")
+	errShift      = fmt.Errorf("shift count must be between 0 and %d", maxIntPowerBits)
+)
+
+// Precedences of the bitwise operators, lower than the arithmetic ones like in
+// C, so "1 << 2+1" is 8 and "x & 0xF0 | 1" is "(x & 0xF0) | 1".
+const (
+	precedenceShift      = 0
+	precedenceBitwiseAnd = -1
+	precedenceBitwiseXor = -2
+	precedenceBitwiseOr  = -3
+
+	lowestPrecedence = precedenceBitwiseOr
+)
+
+var (
+	opBitwiseAnd = newIntegerOperator("&", precedenceBitwiseAnd,
+		func(x, y int64) (int64, bool) { return x & y, true },
+		func(x, y *big.Int) (*big.Int, error) { return new(big.Int).And(x, y), nil },
+	)
+	opBitwiseOr = newIntegerOperator("|", precedenceBitwiseOr,
+		func(x, y int64) (int64, bool) { return x | y, true },
+		func(x, y *big.Int) (*big.Int, error) { return new(big.Int).Or(x, y), nil },
+	)
+	opBitwiseXor = newIntegerOperator("^", precedenceBitwiseXor,
+		func(x, y int64) (int64, bool) { return x ^ y, true },
+		func(x, y *big.Int) (*big.Int, error) { return new(big.Int).Xor(x, y), nil },
+	)
+	opShiftLeft = newIntegerOperator("<<", precedenceShift,
+		func(x, y int64) (int64, bool) {
+			if y < 0 || y >= 63 || (x<<y)>>y != x {
+				return 0, false
+			}
+			return x << y, true
+		},
+		func(x, y *big.Int) (*big.Int, error) {
+			if !y.IsInt64() || y.Int64() < 0 || y.Int64() > maxIntPowerBits {
+				return nil, errShift
+			}
+			return new(big.Int).Lsh(x, uint(y.Int64())), nil
+		},
+	)
+	opShiftRight = newIntegerOperator(">>", precedenceShift,
+		func(x, y int64) (int64, bool) {
+			if y < 0 {
+				return 0, false
+			}
+			return x >> min(y, 63), true
+		},
+		func(x, y *big.Int) (*big.Int, error) {
+			if y.Sign() < 0 {
+				return nil, errShift
+			}
+			if !y.IsInt64() || y.Int64() > int64(x.BitLen()) {
+				// all the bits are shifted out, leaving the sign
+				return big.NewInt(int64(min(x.Sign(), 0))), nil
+			}
+			return new(big.Int).Rsh(x, uint(y.Int64())), nil
+		},
+	)
+
+	// fnBitwiseNot is the unary "~" operator, parsed like a function.
+	fnBitwiseNot = function{
+		fn: func(args []float64) (float64, error) {
+			x, err := floatToInt64(args[0])
+			if err == nil {
+				return float64(^x), nil
+			}
+			i, err := floatToBigInt(args[0])
+			if err != nil {
+				return 0, err
+			}
+			f, _ := new(big.Float).SetInt(i.Not(i)).Float64()
+			return f, nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			if !args[0].IsInt() {
+				return nil, errNotInteger
+			}
+			i, _ := args[0].Int(nil)
+			return new(big.Float).SetPrec(args[0].Prec()).SetInt(i.Not(i)), nil
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			if !args[0].IsInt() {
+				return nil, errNotInteger
+			}
+			return new(big.Rat).SetInt(new(big.Int).Not(args[0].Num())), nil
+		},
+		minArgs:     1,
+		maxArgs:     1,
+		symbol:      "~",
+		usage:       "~x",
+		doc:         "Bitwise not",
+		integerArgs: true,
+	}
+)
+
+// newIntegerOperator returns an operator defined only for integers, which uses
+// int64Operation for floats when it fits in an int64, so compiled programs
+// don't allocate.
+func newIntegerOperator(
+	symbol string,
+	precedence int,
+	int64Operation func(x, y int64) (int64, bool),
+	intOperation func(x, y *big.Int) (*big.Int, error),
+) operator {
+	return operator{
+		operation: func(lhs float64, rhs float64) (float64, error) {
+			x, xErr := floatToInt64(lhs)
+			y, yErr := floatToInt64(rhs)
+			if xErr == nil && yErr == nil {
+				if res, ok := int64Operation(x, y); ok {
+					return float64(res), nil
+				}
+			}
+			bigX, err := floatToBigInt(lhs)
+			if err != nil {
+				return 0, err
+			}
+			bigY, err := floatToBigInt(rhs)
+			if err != nil {
+				return 0, err
+			}
+			res, err := intOperation(bigX, bigY)
+			if err != nil {
+				return 0, err
+			}
+			f, _ := new(big.Float).SetInt(res).Float64()
+			return f, nil
+		},
+		intOperation: intOperation,
+		bigOperation: func(lhs *big.Float, rhs *big.Float) (*big.Float, error) {
+			if !lhs.IsInt() || !rhs.IsInt() {
+				return nil, errNotInteger
+			}
+			x, _ := lhs.Int(nil)
+			y, _ := rhs.Int(nil)
+			res, err := intOperation(x, y)
+			if err != nil {
+				return nil, err
+			}
+			return new(big.Float).SetPrec(lhs.Prec()).SetInt(res), nil
+		},
+		ratOperation: func(lhs *big.Rat, rhs *big.Rat) (*big.Rat, error) {
+			if !lhs.IsInt() || !rhs.IsInt() {
+				return nil, errNotInteger
+			}
+			res, err := intOperation(lhs.Num(), rhs.Num())
+			if err != nil {
+				return nil, err
+			}
+			return new(big.Rat).SetInt(res), nil
+		},
+		precedence: precedence,
+		integers:   true,
+		symbol:     symbol,
+	}
+}
+
+func floatToInt64(f float64) (int64, error) {
+	if f != math.Trunc(f) || math.Abs(f) >= 1<<63 {
+		return 0, errNotInteger
+	}
+	return int64(f), nil
+}
+
+func floatToBigInt(f float64) (*big.Int, error) {
+	i, ok := newFloatValue(f).toInt()
+	if !ok {
+		return nil, errNotInteger
+	}
+	return i, nil
+}
+
+// checkInteger returns an error positioned at node if its value v is not an
+// integer, for the operands of the bitwise operators.
+func checkInteger(node *parserNode, v value) error {
+	if _, ok := v.toInt(); ok {
+		return nil
+	}
+	pos, end := nodeSpan(node)
+	return newParseError(fmt.Sprintf("eval tree: %v: %s", v, errNotInteger), pos, end-pos)
+}
+
+// nodeSpan returns the positions of the first and after the last tokens of
+// node and its children.
+func nodeSpan(node *parserNode) (start int, end int) {
+	start, end = node.token.pos, node.token.pos+node.token.size()
+	children := []*parserNode{}
+	switch n := node.data.(type) {
+	case nodeKindOperation:
+		children = append(children, n.lhs, n.rhs)
+	case nodeKindUserOperation:
+		children = append(children, n.lhs, n.rhs)
+	case nodeKindFunction:
+		children = n.args
+	case nodeKindUserCall:
+		children = n.args
+	}
+	for _, child := range children {
+		childStart, childEnd := nodeSpan(child)
+		start, end = min(start, childStart), max(end, childEnd)
+	}
+	return start, end
+}
@@ -0,0 +1,1743 @@
+package calc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCalculations(t *testing.T) {
+	// single number
+	testStatement(t, nil, "1", 1)
+	testStatement(t, nil, "69", 69)
+	testStatement(t, nil, ".420", .420)
+	testStatement(t, nil, "33.33", 33.33)
+	testStatement(t, nil, "1337.", 1337)
+	testStatement(t, nil, "69_420", 69420)
+	testStatement(t, nil, "69___420__", 69420)
+	assertStatementError(t, "__69___420__")
+	assertStatementError(t, "4.2_0")
+	testStatement(t, nil, "0x1F", 31)
+	testStatement(t, nil, "0XfF", 255)
+	testStatement(t, nil, "0b1011_0010", 178)
+	testStatement(t, nil, "0o755", 493)
+	testStatement(t, nil, "-0x10+1", -15)
+	assertStatementError(t, "0b12")
+	assertStatementError(t, "0o8")
+	assertStatementError(t, "0xG")
+	for _, test := range []struct{ input, literal string }{
+		{"0b2", "0b2"},
+		{"1+0x10k", "0x10k"},
+		{"0o9+1", "0o9"},
+	} {
+		_, _, processed, err := evalStatement([]byte(test.input), newEnvironment())
+		var perr ParseError
+		if !errors.As(err, &perr) || processed[perr.Pos:perr.Pos+perr.Size] != test.literal {
+			t.Errorf("%q: error expected at %q: %v", test.input, test.literal, err)
+		}
+	}
+	testStatement(t, nil, "1e-9", 1e-9)
+	testStatement(t, nil, "6.022e23", 6.022e23)
+	testStatement(t, nil, ".5E+2", 50)
+	testStatement(t, nil, "-1e3+1", -999)
+	assertStatementError(t, "1e")
+	assertStatementError(t, "1e-")
+	for _, mode := range []evalMode{evalModeFloat, evalModePrecision, evalModeRational} {
+		env := newEnvironment()
+		env.mode = mode
+		_, _, processed, err := evalStatement([]byte("2*1e-1000000"), env)
+		var perr ParseError
+		if !errors.As(err, &perr) || processed[perr.Pos:perr.Pos+perr.Size] != "1e-1000000" {
+			t.Errorf("%s: exponent out of range error expected: %v", mode, err)
+		}
+	}
+
+	// operations
+	testStatement(t, nil, "3+4", 7)
+	testStatement(t, nil, "2-5", -3)
+	testStatement(t, nil, "3*2", 6)
+	testStatement(t, nil, "3(-2)", -6)
+	testStatement(t, nil, "(3)2", 6)
+	testStatement(t, nil, "(3)(-2)", -6)
+	testStatement(t, nil, "3/2", 1.5)
+	testStatement(t, nil, "4//6", 0)
+	testStatement(t, nil, "7%10", 7)
+	testStatement(t, nil, "3v27", 3)
+	testStatement(t, nil, "(1+2)v27", 3)
+	testStatement(t, nil, "2**8", 256)
+
+	// functions
+	testStatement(t, nil, "sin 2", math.Sin(2))
+	testStatement(t, nil, "cos 2", math.Cos(2))
+	testStatement(t, nil, "tan 2", math.Tan(2))
+	testStatement(t, nil, "asin .1", math.Asin(0.1))
+	testStatement(t, nil, "acos .1", math.Acos(0.1))
+	testStatement(t, nil, "atan 2", math.Atan(2))
+	testStatement(t, nil, "sin -.2", math.Sin(-0.2))
+	testStatement(t, nil, "sin cos 2", math.Sin(math.Cos(2)))
+	testStatement(t, nil, "sin cos -2 * 2", math.Sin(math.Cos(-2))*2)
+	testStatement(t, nil, "sin 4*2", math.Sin(4*2))
+	testStatement(t, nil, "sin 4 *2", math.Sin(4)*2)
+	testStatement(t, nil, "sin (4 *2", math.Sin(4*2))
+	testStatement(t, nil, "atan2(1, 2)", math.Atan2(1, 2))
+	testStatement(t, nil, "atan2(-1,-1)", math.Atan2(-1, -1))
+	testStatement(t, nil, "max(1, 2, 3)", 3)
+	testStatement(t, nil, "max(3)", 3)
+	testStatement(t, nil, "min(4, -2, 3)", -2)
+	testStatement(t, nil, "log 8", math.Log(8))
+	testStatement(t, nil, "log(8, 2)", 3)
+	testStatement(t, nil, "round(3.14159, 2)", 3.14)
+	testStatement(t, nil, "round(-2.5)", -3)
+	testStatement(t, nil, "round(1234, -2)", 1200)
+	testStatement(t, nil, "max(1, sin 2, 3)", 3)
+	testStatement(t, nil, "atan2(1 + 2, 3)", math.Atan2(3, 3))
+	testStatement(t, nil, "max(1, 2 + 3 *4)", 14)
+	testStatement(t, nil, "max(1,2)-1", 1)
+	testStatement(t, nil, "max(1,2)3", 6)
+	testStatement(t, nil, "max(1, 2", 2)
+	testStatement(t, nil, "max (1, 2)", 2)
+	testStatement(t, nil, "max (1, 2) + 1", 3)
+	testStatement(t, nil, "2 * atan2 (1, 2)", 2*math.Atan2(1, 2))
+	assertStatementError(t, "max()")
+	assertStatementError(t, "atan2(1)")
+	assertStatementError(t, "sin(1, 2)")
+	assertStatementError(t, "round(1, 2, 3)")
+	assertStatementError(t, "max(1,)")
+	assertStatementError(t, "max(,1)")
+	assertStatementError(t, "log 0")
+
+	// associative property
+	testStatement(t, nil, "3+4+5+6", 18)
+	testStatement(t, nil, "3+4-5+6", 8)
+	testStatement(t, nil, "3-4+5+6", 10)
+	testStatement(t, nil, "3-4-5+6", 0)
+
+	testStatement(t, nil, "3*4*5*2", 120)
+	testStatement(t, nil, "3*4/5*2", 4.8)
+	testStatement(t, nil, "3/4*5*2", 7.5)
+	testStatement(t, nil, "3/4/5*2", 0.3)
+
+	// operators precedence
+	testStatement(t, nil, "3+4*5", 23)
+	testStatement(t, nil, "3*4+5", 17)
+	testStatement(t, nil, "3*4v5", 4.486046343663661)
+	testStatement(t, nil, "3-4**5", -1021)
+
+	// brackets
+	testStatement(t, nil, "2+(3)", 5)
+	testStatement(t, nil, "(2)+(3)", 5)
+	testStatement(t, nil, "(2+3)", 5)
+	testStatement(t, nil, "((2)+(3))", 5)
+	testStatement(t, nil, "(2)+(3)4(2+3-1)", 50)
+	testStatement(t, nil, "(((2(2", 4)
+	testStatement(t, nil, "3*(1+2)+1", 10)
+	testStatement(t, nil, "2*(1+2)**2", 18)
+	testStatement(t, nil, "(1+2)*(3+4)-1", 20)
+	testStatement(t, nil, "(1+2)-1", 2)
+	testStatement(t, nil, "(1+2) -1", 2)
+
+	// space expansion
+	testStatement(t, nil, "1+ 1", 2)
+	testStatement(t, nil, "1 + 1 + 1 * 2", 4)
+	testStatement(t, nil, "1+1 *2", 4)
+	testStatement(t, nil, "( 1+1*2)", 3)
+	testStatement(t, nil, "(1+1 *2", 4)
+	testStatement(t, nil, "1+1 *2 **2", 16)
+	testStatement(t, nil, "1+1 *2** 2", 8)
+}
+
+func TestAssociativity(t *testing.T) {
+	testStatement(t, nil, "2**3**2", 512)
+	testStatement(t, nil, "(2**3)**2", 64)
+	testStatement(t, nil, "2**3**2*2", 1024)
+	testStatement(t, nil, "2*2**3**2", 1024)
+	testStatement(t, nil, "2v2v16", 2)
+	testStatement(t, nil, "(2v2)v16", math.Pow(16, 1/math.Sqrt2))
+	testStatement(t, nil, "2v16**2", 16)
+	testStatement(t, nil, "2**2v16", 16)
+	testStatement(t, nil, "10-4-3", 3)
+	testStatement(t, nil, "64/4/2", 8)
+	testStatement(t, nil, "100//7//2", 7)
+	testStatement(t, nil, "100%7%3", 2)
+
+	env := newEnvironment()
+	testCommand(t, env, ":precision 20", "")
+	testStatementOutput(t, env, "2**3**2", "512")
+	testCommand(t, env, ":rational on", "")
+	testStatementOutput(t, env, "2**-1**3", "1/2")
+}
+
+func TestVariables(t *testing.T) {
+	env := newEnvironment()
+
+	testStatement(t, env, "A = 1+1 *2", 4)
+	testStatement(t, env, "A", 4)
+	testStatement(t, env, "A+1", 5)
+	testStatement(t, env, "A-1", 3)
+	testStatement(t, env, "A -1", 3)
+	testStatement(t, env, "A+A", 8)
+	testStatement(t, env, "B = A*A", 16)
+	testStatement(t, env, "B", 16)
+	testStatement(t, env, "snake_case_69 = B", 16)
+	testStatement(t, env, "snake_case_69 + 1", 17)
+	testStatement(t, env, "value = 2", 2)
+	testStatement(t, env, "3 v value**3", 2)
+}
+
+func TestPrecision(t *testing.T) {
+	env := newEnvironment()
+	env.mode = evalModePrecision
+	env.precision = 50
+
+	// exact integers
+	testStatementOutput(t, env, "2**100", "1_267_650_600_228_229_401_496_703_205_376")
+	testStatementOutput(t, env, "123456789*987654321*123456789", "15_053_411_111_487_447_638_891_241")
+	testStatementOutput(t, env, "7//2", "3")
+	testStatementOutput(t, env, "-7//2", "-4")
+	testStatementOutput(t, env, "-7%3", "-1")
+	testStatementOutput(t, env, "6/3", "2")
+	testStatementOutput(t, env, "3v27", "3")
+	testStatementOutput(t, env, "2v(10**100)", "100_000_000_000_000_000_000_000_000_000_000_000_000_000_000_000_000")
+
+	// decimals
+	testStatementOutput(t, env, "0.1+0.2", "0.3")
+	testStatementOutput(t, env, "10/4", "2.5")
+	testStatementOutput(t, env, "2**-2", "0.25")
+	testStatementOutput(t, env, "1/3", "0.33333333333333333333333333333333333333333333333333")
+	testStatementOutput(t, env, "2v2", "1.4142135623730950488016887242096980785696718753769")
+	testStatementOutput(t, env, "2**.5", "1.4142135623730950488016887242096980785696718753769")
+	testStatementOutput(t, env, "1.5**2.5", "2.7556759606310753604719445840441278159616909157388")
+	testStatementOutput(t, env, "PI", "3.1415926535897932384626433832795028841971693993751")
+
+	// functions
+	testStatementOutput(t, env, "sin 1", "0.84147098480789650665250232163029899962256306079837")
+	testStatementOutput(t, env, "cos 1", "0.54030230586813971740093660744297660373231042061792")
+	testStatementOutput(t, env, "tan 1", "1.5574077246549022305069748074583601730872507723815")
+	testStatementOutput(t, env, "asin .5", "0.52359877559829887307710723054658381403286156656252")
+	testStatementOutput(t, env, "acos .5", "1.047197551196597746154214461093167628065723133125")
+	testStatementOutput(t, env, "atan 2", "1.1071487177940905030170654601785370400700476454014")
+
+	assertStatementErrorEnv(t, env, "1/0")
+	assertStatementErrorEnv(t, env, "1//0")
+
+	// variables keep their precision
+	testStatementOutput(t, env, "A = 1/3", "0.33333333333333333333333333333333333333333333333333")
+	testStatementOutput(t, env, "A*3", "1")
+
+	env.precision = 10
+	testStatementOutput(t, env, "1/3", "0.3333333333")
+	testStatementOutput(t, env, "PI*1000", "3141.592654")
+
+	// integer parts longer than the precision
+	env.precision = 20
+	testStatementOutput(t, env, "2**0.5*10**40", "1.4142135623730950488e40")
+	testStatementOutput(t, env, "0-2**0.5*10**40", "-1.4142135623730950488e40")
+	testStatementOutput(t, env, "10.5*10**30", "1.05e31")
+
+	// huge exponents are formatted without computing every digit
+	env.precision = 5
+	testStatementOutput(t, env, "1e-100000", "1e-100000")
+	testStatementOutput(t, env, "0.1**1000000", "1e-1000000")
+	env.precision = 20
+
+	// the notation applies as in float mode
+	testStatementOutput(t, env, "1e10000", "1e10000")
+	testStatementOutput(t, env, "2**0.5/10**7", "1.4142135623730950488e-7")
+	testStatementOutput(t, env, "10**20/3", "3.3333333333333333333e19")
+	env.notation = notation{engineering: true, min: defaultNotation.min, max: defaultNotation.max}
+	testStatementOutput(t, env, "1e10000", "10e9999")
+	testStatementOutput(t, env, "2**0.5/10**7", "141.42135623730950488e-9")
+	env.notation = notation{min: 1e-3, max: 1e30}
+	testStatementOutput(t, env, "2**0.5*10**19", "14_142_135_623_730_950_488")
+	testStatementOutput(t, env, "2**0.5*1000", "1414.2135623730950488")
+	testStatementOutput(t, env, "1/3/1000", "3.3333333333333333333e-4")
+	env.notation = defaultNotation
+}
+
+func TestRational(t *testing.T) {
+	env := newEnvironment()
+	env.mode = evalModeRational
+
+	testStatementOutput(t, env, "1/3 + 1/6", "1/2")
+	testStatementOutput(t, env, "0.1+0.2", "3/10")
+	testStatementOutput(t, env, "6/3", "2")
+	testStatementOutput(t, env, "-2/4", "-1/2")
+	testStatementOutput(t, env, "1_000_000/3", "1_000_000/3")
+	testStatementOutput(t, env, "7//2", "3")
+	testStatementOutput(t, env, "-7//2", "-4")
+	testStatementOutput(t, env, "(7/2)//(1/3)", "10")
+	testStatementOutput(t, env, "-7%3", "-1")
+	testStatementOutput(t, env, "(7/2)%1", "1/2")
+	testStatementOutput(t, env, "(2/3)**3", "8/27")
+	testStatementOutput(t, env, "(2/3)**-2", "9/4")
+	testStatementOutput(t, env, "2v(9/4)", "3/2")
+	assertStatementErrorEnv(t, env, "1/0")
+	assertStatementErrorEnv(t, env, "0**-1")
+
+	// irrational operations fall back to floats
+	testStatementOutput(t, env, "2v2", "≈1.414213")
+	testStatementOutput(t, env, "4**.5", "≈2")
+	testStatementOutput(t, env, "sin 1", "≈0.84147")
+	testStatementOutput(t, env, "PI/2", "≈1.570796")
+	testStatementOutput(t, env, "A = 1/3", "1/3")
+	testStatementOutput(t, env, "A*3", "1")
+
+	env.showMixed = true
+	testStatementOutput(t, env, "7/2", "7/2 = 3 1/2")
+	testStatementOutput(t, env, "-7/2", "-7/2 = -3 1/2")
+	testStatementOutput(t, env, "1/2", "1/2")
+
+	env.showDecimal = true
+	testStatementOutput(t, env, "4/3", "4/3 = 1 1/3 ≈ 1.333333")
+}
+
+func TestComplex(t *testing.T) {
+	env := newEnvironment()
+
+	testStatementOutput(t, env, "i", "i")
+	testStatementOutput(t, env, "3+4i", "3+4i")
+	testStatementOutput(t, env, "3-4i", "3-4i")
+	testStatementOutput(t, env, "-2.5i", "-2.5i")
+	testStatementOutput(t, env, "i*i", "-1")
+	testStatementOutput(t, env, "(3+4i)(3-4i)", "25")
+	testStatementOutput(t, env, "(1+2i)/(3-4i)", "-0.2+0.4i")
+	testStatementOutput(t, env, "2v-4", "2i")
+	testStatementOutput(t, env, "2v-2", "1.414213i")
+	testStatementOutput(t, env, "(-8)**(1/3)", "1+1.73205i")
+	testStatementOutput(t, env, "i**i", "0.207879")
+	testStatementOutput(t, env, "2**i", "0.769238+0.638961i")
+	testStatementOutput(t, env, "asin 2", "1.570796+1.316957i")
+	testStatementOutput(t, env, "acos 2", "-1.316957i")
+	testStatementOutput(t, env, "sin(1+i)", "1.298457+0.634963i")
+
+	testStatementOutput(t, env, "re(3+4i)", "3")
+	testStatementOutput(t, env, "im(3+4i)", "4")
+	testStatementOutput(t, env, "abs(3+4i)", "5")
+	testStatementOutput(t, env, "abs -3", "3")
+	testStatementOutput(t, env, "arg i", "1.570796")
+	testStatementOutput(t, env, "arg -1", "3.141592")
+	testStatementOutput(t, env, "conj(3+4i)", "3-4i")
+
+	testStatementOutput(t, env, "z = 1+i", "1+i")
+	testStatementOutput(t, env, "z*z", "2i")
+	testStatementOutput(t, env, "i = 2", "2")
+	testStatementOutput(t, env, "i", "2")
+
+	assertStatementErrorEnv(t, env, "(1+2i)//2")
+	assertStatementErrorEnv(t, env, "(1+2i)%2")
+	assertStatementErrorEnv(t, env, "1/(0i)")
+
+	env.polar = true
+	testStatementOutput(t, env, "1+1i", "1.414213∠0.785398")
+
+	env = newEnvironment()
+	env.mode = evalModePrecision
+	testStatementOutput(t, env, "2v-4", "2i")
+	testStatementOutput(t, env, "(1+i)**2", "2i")
+	testStatementOutput(t, env, "asin 2", "1.570796+1.316957i")
+
+	env.mode = evalModeRational
+	testStatementOutput(t, env, "2v-4", "≈2i")
+	testStatementOutput(t, env, "abs(-1/3)", "1/3")
+	testStatementOutput(t, env, "im(1/3)", "0")
+}
+
+func TestSettings(t *testing.T) {
+	env := newEnvironment()
+
+	args, err := parseArgs([]string{"--precision=30", "1/3"}, env)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(args) != 1 || args[0] != "1/3" {
+		t.Errorf("unexpected args: %q", args)
+	}
+	if env.mode != evalModePrecision || env.precision != 30 {
+		t.Errorf("precision not set: mode=%s, precision=%d", env.mode, env.precision)
+	}
+
+	if _, err := parseArgs([]string{"--precision=0"}, env); err == nil {
+		t.Errorf("error expected for invalid precision")
+	}
+	if _, err := parseArgs([]string{"--foo"}, env); err == nil {
+		t.Errorf("error expected for unknown option")
+	}
+
+	testCommand(t, env, ":precision", "precision = 30")
+	testCommand(t, env, ":precision off", "")
+	testCommand(t, env, ":precision", "precision = off")
+	testCommand(t, env, ":precision 20", "")
+	testStatementOutput(t, env, "1/3", "0.33333333333333333333")
+
+	testCommand(t, env, ":rational mixed,decimal", "")
+	testCommand(t, env, ":rational", "rational = on,mixed,decimal")
+	testCommand(t, env, ":precision", "precision = off")
+	testCommand(t, env, ":precision off", "")
+	testCommand(t, env, ":rational", "rational = on,mixed,decimal")
+	testCommand(t, env, ":rational off", "")
+	testCommand(t, env, ":rational", "rational = off")
+
+	testCommand(t, env, ":complex polar", "")
+	testCommand(t, env, ":complex", "complex = polar")
+
+	testCommand(t, env, ":base hex", "")
+	testCommand(t, env, ":base", "base = hex")
+	testStatementOutput(t, env, "0xDEADBEEF", "0xDEAD_BEEF")
+	testStatementOutput(t, env, "-255", "-0xFF")
+	testStatementOutput(t, env, "1.5", "1.5")
+	testCommand(t, env, ":base bin", "")
+	testStatementOutput(t, env, "178", "0b1011_0010")
+	testCommand(t, env, ":base oct", "")
+	testStatementOutput(t, env, "493", "0o755")
+	testCommand(t, env, ":rational on", "")
+	testStatementOutput(t, env, "0o10/2", "0o4")
+	testStatementOutput(t, env, "1/2", "1/2")
+	testCommand(t, env, ":rational off", "")
+	testCommand(t, env, ":base dec", "")
+
+	testStatementOutput(t, env, "2**70", "1.180591e21")
+	testStatementOutput(t, env, "-1e-9/3", "-3.333333e-10")
+	testStatementOutput(t, env, "1e15-1", "999_999_999_999_999")
+	testCommand(t, env, ":notation eng", "")
+	testStatementOutput(t, env, "2**70", "1.180591e21")
+	testStatementOutput(t, env, "1e22", "10e21")
+	testStatementOutput(t, env, "12e-6/100", "120e-9")
+	testCommand(t, env, ":notation sci,0.01,1000", "")
+	testCommand(t, env, ":notation", "notation = sci,0.01,1000")
+	testStatementOutput(t, env, "1234.5", "1.2345e3")
+	testStatementOutput(t, env, "999.5", "999.5")
+	testStatementOutput(t, env, "0", "0")
+	testCommand(t, env, ":notation sci,1e-6,1e15", "")
+
+	if _, err := runCommand(":notation sci,1,0", env); err == nil {
+		t.Errorf("error expected for invalid notation limits")
+	}
+	if _, err := runCommand(":base 3", env); err == nil {
+		t.Errorf("error expected for invalid base")
+	}
+	if _, err := runCommand(":complex foo", env); err == nil {
+		t.Errorf("error expected for invalid complex format")
+	}
+	if _, err := runCommand(":rational foo", env); err == nil {
+		t.Errorf("error expected for invalid rational option")
+	}
+	if _, err := runCommand(":foo", env); err == nil {
+		t.Errorf("error expected for unknown command")
+	}
+}
+
+func TestCommands(t *testing.T) {
+	env := newEnvironment()
+	testCommand(t, env, ":vars", "")
+
+	testStatement(t, env, "B = 1/4", 0.25)
+	testStatement(t, env, "A = 2", 2)
+	testDefinition(t, env, "f(x) = x*A")
+	testDefinition(t, env, "op <> prec 2 = lhs+rhs")
+	testCommand(t, env, ":vars", "A = 2\nB = 0.25")
+
+	funcs, err := runCommand(":funcs", env)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(funcs, "\n")
+	if !slices.ContainsFunc(lines, func(line string) bool { return strings.Join(strings.Fields(line), " ") == "sin(x) Sine" }) {
+		t.Errorf("sin not listed:\n%s", funcs)
+	}
+	for _, line := range []string{"f(x) = x*A", "op <> prec 2 left = lhs+rhs"} {
+		if !slices.Contains(lines, line) {
+			t.Errorf("%q not listed:\n%s", line, funcs)
+		}
+	}
+
+	testCommand(t, env, ":del B", "")
+	testCommand(t, env, ":vars", "A = 2")
+	testCommand(t, env, ":del f", "")
+	assertStatementErrorEnv(t, env, "f(1)")
+	if _, err := runCommand(":del f", env); err == nil {
+		t.Errorf("error expected for undefined name")
+	}
+
+	// operators used by other definitions can't be deleted
+	testDefinition(t, env, "g(x) = x <> 1")
+	testDefinition(t, env, "op <+> prec 1 = lhs <> rhs")
+	if _, err := runCommand(":del <>", env); err == nil || !strings.HasSuffix(err.Error(), `"<>" is used by g(x), op <+>`) {
+		t.Errorf("dependents error expected: %v", err)
+	}
+	testCommand(t, env, ":del g", "")
+	testCommand(t, env, ":del <+>", "")
+	testCommand(t, env, ":del <>", "")
+	assertStatementErrorEnv(t, env, "1 <> 2")
+
+	testCommand(t, env, ":clear", "")
+	testCommand(t, env, ":vars", "")
+	assertStatementErrorEnv(t, env, "1 <> 2")
+
+	help, err := runCommand(":help", env)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{":vars", ":del name", ":clear", ":funcs", ":help", ":precision [digits|off]", ":mode [deg|rad]"} {
+		if !strings.Contains(help, name+" ") {
+			t.Errorf("%q not in help:\n%s", name, help)
+		}
+	}
+
+	if _, err := runCommand(":vars A", env); err == nil {
+		t.Errorf("error expected for unexpected argument")
+	}
+}
+
+func TestAngleMode(t *testing.T) {
+	env := newEnvironment()
+	testCommand(t, env, ":mode", "mode = rad")
+	testCommand(t, env, ":mode deg", "")
+	testCommand(t, env, ":mode", "mode = deg")
+
+	testStatement(t, env, "sin(90)", 1)
+	testStatement(t, env, "cos(60)", 0.5)
+	testStatement(t, env, "tan(45)", 1)
+	testStatement(t, env, "asin(1)", 90)
+	testStatement(t, env, "atan2(1, 1)", 45)
+	testStatement(t, env, "arg(-1)", 180)
+	testStatement(t, env, "arg(1i)", 90)
+
+	// exact at the multiples of 30 and 45
+	testStatementOutput(t, env, "sin 30", "0.5")
+	testStatementOutput(t, env, "sin 390", "0.5")
+	testStatementOutput(t, env, "cos -240", "-0.5")
+	testStatementOutput(t, env, "sin 180", "0")
+	testStatementOutput(t, env, "tan 135", "-1")
+	testStatementOutput(t, env, "asin .5", "30")
+	testStatementOutput(t, env, "acos .5", "60")
+	assertStatementErrorEnv(t, env, "tan 90")
+	assertStatementErrorEnv(t, env, "tan -270")
+
+	testCommand(t, env, ":precision 30", "")
+	testStatementOutput(t, env, "acos(0)", "90")
+	testStatementOutput(t, env, "sin 150", "0.5")
+	testStatementOutput(t, env, "sin 405", "0.707106781186547524400844362105")
+	assertStatementErrorEnv(t, env, "tan 90")
+	testCommand(t, env, ":precision off", "")
+	testCommand(t, env, ":rational on", "")
+	testStatementOutput(t, env, "arg(2)", "0")
+	testStatementOutput(t, env, "sin 30", "1/2")
+	testStatementOutput(t, env, "cos 120", "-1/2")
+	testStatementOutput(t, env, "tan 45", "1")
+	testStatementOutput(t, env, "sin 45", "≈0.707106")
+	testStatementOutput(t, env, "asin(1/2)", "30")
+	testStatementOutput(t, env, "acos(-1/2)", "120")
+	testStatementOutput(t, env, "atan(-1)", "-45")
+	testStatementOutput(t, env, "atan(1/2)", "≈26.565051")
+	testCommand(t, env, ":rational off", "")
+
+	testCommand(t, env, ":complex polar", "")
+	testStatementOutput(t, env, "2i", "2∠90°")
+
+	testCommand(t, env, ":mode rad", "")
+	testStatement(t, env, "asin(1)", math.Pi/2)
+	testCommand(t, env, ":rational on", "")
+	testStatementOutput(t, env, "sin 0", "0")
+	testStatementOutput(t, env, "cos 0", "1")
+	testStatementOutput(t, env, "acos 1", "0")
+	testStatementOutput(t, env, "sin 1", "≈0.84147")
+	testCommand(t, env, ":rational off", "")
+	if _, err := runCommand(":mode grad", env); err == nil {
+		t.Errorf("error expected for invalid angle mode")
+	}
+
+	engine := New()
+	if err := engine.Set("mode", "deg"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	program, err := engine.Compile("sin(x)")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res, err := program.Eval([]float64{30}); err != nil || res != 0.5 {
+		t.Errorf("unexpected result: %v: %v", res, err)
+	}
+}
+
+func TestInvalidSyntax(t *testing.T) {
+	assertStatementError(t, "1(")
+	assertStatementError(t, ")1")
+	assertStatementError(t, "1+")
+	assertStatementError(t, "+1")
+	assertStatementError(t, "1+1++1")
+	assertStatementError(t, "1+1()")
+	assertStatementError(t, "1+1 1")
+	assertStatementError(t, "1+1+")
+	assertStatementError(t, "1+1(")
+	assertStatementError(t, "1+1)")
+	assertStatementError(t, "1,2")
+	assertStatementError(t, "(1,2)")
+	assertStatementError(t, "max((1,2),3)")
+
+	// the whole unexpected char is marked
+	_, _, _, err := evalStatement([]byte("1+µ"), newEnvironment())
+	var perr ParseError
+	if !errors.As(err, &perr) || perr.Pos != len("1+") || perr.Size != len("µ") {
+		t.Errorf("wrong error position: %v", err)
+	}
+}
+
+func TestArityErrorPosition(t *testing.T) {
+	_, _, processed, err := evalStatement([]byte("1+atan2(1)"), newEnvironment())
+	var perr ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("parsing error expected: processed=%q: %v", processed, err)
+	}
+	if perr.Pos != 2 || perr.Size != len("atan2(1)") {
+		t.Errorf("wrong error position: processed=%q: pos=%d, size=%d", processed, perr.Pos, perr.Size)
+	}
+}
+
+func TestFunctionRegistry(t *testing.T) {
+	env := newEnvironment()
+	err := env.functions.register(function{
+		fn: func(args []float64) (float64, error) {
+			return math.Sinh(args[0]), nil
+		},
+		minArgs: 1,
+		maxArgs: 1,
+		symbol:  "sinh",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.functions.register(function{
+		fn: func(args []float64) (float64, error) {
+			return math.Sqrt(args[0]), nil
+		},
+		domain: func(args []value) error {
+			if args[0].sign() < 0 {
+				return errors.New("negative root")
+			}
+			return nil
+		},
+		minArgs: 1,
+		maxArgs: 1,
+		symbol:  "sqrt",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// matched by the whole name, not by prefix
+	testStatement(t, env, "sinh 1", math.Sinh(1))
+	testStatement(t, env, "sin 1 + sinh(1)", math.Sin(1)+math.Sinh(1))
+	testStatement(t, env, "sinhx = 2", 2)
+	testStatement(t, env, "sinhx * 2", 4)
+
+	// without big.Float implementation
+	testCommand(t, env, ":precision 30", "")
+	testStatement(t, env, "sqrt(16)", 4)
+	assertStatementErrorEnv(t, env, "sqrt(-16)")
+	assertStatementErrorEnv(t, env, "sqrt(1, 2)")
+
+	if err := env.functions.register(fnSin); !errors.Is(err, errAlreadyRegistered) {
+		t.Errorf("already registered error expected: %v", err)
+	}
+	for _, name := range []string{"", "v", "2x", "a-b", "PI"} {
+		if err := env.functions.register(function{fn: fnSin.fn, symbol: name}); err == nil {
+			t.Errorf("invalid name error expected: %q", name)
+		}
+	}
+	if err := env.functions.register(function{symbol: "nofn"}); err == nil {
+		t.Errorf("missing implementation error expected")
+	}
+
+	// not shared between environments
+	assertStatementError(t, "sinh 1")
+}
+
+func TestUserFunctions(t *testing.T) {
+	env := newEnvironment()
+	testStatementOutput(t, env, "f(x, y) = x**2 + y", "(x**2)+(y)")
+	testStatement(t, env, "f(3, 1)", 10)
+	testStatement(t, env, "2 * f(1, 2) + 1", 7)
+	testDefinition(t, env, "g(x) = f(x, x) * 2")
+	testStatement(t, env, "g 2", 12)
+	testStatement(t, env, "max(f(1, 1), g(1))", 4)
+
+	// parameters shadow variables and functions
+	testStatement(t, env, "x = 10", 10)
+	testDefinition(t, env, "h(x, f) = x + f")
+	testStatement(t, env, "h(1, 2)", 3)
+	testStatement(t, env, "x", 10)
+
+	// redefinitions are seen by the functions using them
+	testDefinition(t, env, "f(x, y) = x - y")
+	testStatement(t, env, "g(3)", 0)
+
+	// variables and functions replace each other
+	testStatement(t, env, "f = 2", 2)
+	assertStatementErrorEnv(t, env, "g(1)")
+	testDefinition(t, env, "x(a) = a")
+	assertStatementErrorEnv(t, env, "x + 1")
+
+	// the body is parsed again when the mode changes
+	testDefinition(t, env, "third(x) = x / 3")
+	testCommand(t, env, ":rational on", "")
+	testStatementOutput(t, env, "third(1)", "1/3")
+
+	assertStatementErrorEnv(t, env, "sin(x) = x")
+	assertStatementErrorEnv(t, env, "k(sin) = 1")
+	assertStatementErrorEnv(t, env, "k(x, x) = x")
+	assertStatementErrorEnv(t, env, "k(x y) = x")
+	assertStatementErrorEnv(t, env, "k(1) = 1")
+	assertStatementErrorEnv(t, env, "k(x) =")
+	assertStatementErrorEnv(t, env, "k(x) = x +")
+	assertStatementErrorEnv(t, env, "h(1)")
+	assertStatementErrorEnv(t, env, "h(1, 2, 3)")
+}
+
+func TestArityError(t *testing.T) {
+	for input, expected := range map[string]string{
+		"sin(1, 2)": "sin: expected 1 argument, got 2",
+		"atan2(1)":  "atan2: expected 2 arguments, got 1",
+		"max()":     "max: expected at least 1 argument, got 0",
+	} {
+		_, _, processed, err := evalStatement([]byte(input), newEnvironment())
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("arity error expected: input=%q, processed=%q: expected %q, got %v", input, processed, expected, err)
+		}
+	}
+}
+
+func TestUserFunctionRecursion(t *testing.T) {
+	env := newEnvironment()
+	testDefinition(t, env, "f(n) = f(n - 1) + 1")
+
+	_, _, processed, err := evalStatement([]byte("f(1)"), env)
+	if err == nil || !strings.Contains(err.Error(), "maximum recursion depth exceeded") {
+		t.Fatalf("recursion error expected: processed=%q: %v", processed, err)
+	}
+}
+
+func TestUserFunctionErrorPosition(t *testing.T) {
+	env := newEnvironment()
+	testDefinition(t, env, "f(x) = 1 + x // 0")
+
+	_, _, processed, err := evalStatement([]byte("2 * f(1)"), env)
+	var perr ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("parsing error expected: processed=%q: %v", processed, err)
+	}
+	if perr.Source != "f(x) = (1)+((x))//(0)" {
+		t.Errorf("wrong error source: %q", perr.Source)
+	}
+	if perr.Pos != len("f(x) = (1)+((x))") || perr.Size != len("//") {
+		t.Errorf("wrong error position: pos=%d, size=%d", perr.Pos, perr.Size)
+	}
+
+	_, _, processed, err = evalStatement([]byte("A = 1 + y"), env)
+	if !errors.As(err, &perr) {
+		t.Fatalf("parsing error expected: processed=%q: %v", processed, err)
+	}
+	if perr.Pos != len("A = (1)+(") {
+		t.Errorf("wrong error position: processed=%q: pos=%d", processed, perr.Pos)
+	}
+}
+
+func TestUserOperators(t *testing.T) {
+	env := newEnvironment()
+	testDefinition(t, env, "op <> prec 2 = (lhs+rhs)/2")
+	testStatement(t, env, "1 <> 3", 2)
+	testStatement(t, env, "1+1<>3*2", 5)
+	testStatement(t, env, "2<>4<>10", 6.5)
+	testStatement(t, env, "1<>-3", -1)
+
+	testDefinition(t, env, "op -> prec 1 right = lhs - rhs")
+	testStatement(t, env, "5->3->1", 3)
+	testStatement(t, env, "5-3-1", 1)
+
+	// lexed greedily
+	testDefinition(t, env, "op <>> prec 2 = lhs * 10 + rhs")
+	testStatement(t, env, "1<>>2", 12)
+	testStatement(t, env, "1<>3", 2)
+
+	// using functions and other operators
+	testDefinition(t, env, "f(x) = x <> 0")
+	testStatement(t, env, "f(4)", 2)
+	testDefinition(t, env, "op ## prec 3 = f(lhs) <>> rhs")
+	testStatement(t, env, "4 ## 2", 22)
+
+	// "op" can still be a variable
+	testStatement(t, env, "op = 3", 3)
+	testStatement(t, env, "op * 2", 6)
+
+	assertStatementErrorEnv(t, env, "op + prec 1 = lhs")
+	assertStatementErrorEnv(t, env, "op ab prec 1 = lhs")
+	assertStatementErrorEnv(t, env, "op !! prec = lhs")
+	assertStatementErrorEnv(t, env, "op !! prec x = lhs")
+	assertStatementErrorEnv(t, env, "op !! prec 100 = lhs")
+	assertStatementErrorEnv(t, env, "op !! prec 1 up = lhs")
+	assertStatementErrorEnv(t, env, "op !! level 1 = lhs")
+	assertStatementErrorEnv(t, env, "op !! prec 1 =")
+	assertStatementErrorEnv(t, env, "op !! prec 1 = lhs +")
+	assertStatementErrorEnv(t, env, "1 !! 2")
+	testDefinition(t, env, "op !! prec 1 = lhs + x")
+	assertStatementErrorEnv(t, env, "1 !! 2")
+}
+
+func TestUserOperatorErrorPosition(t *testing.T) {
+	env := newEnvironment()
+	testDefinition(t, env, "op %% prec 2 = lhs // rhs")
+
+	_, _, processed, err := evalStatement([]byte("1 %% 0"), env)
+	var perr ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("parsing error expected: processed=%q: %v", processed, err)
+	}
+	if perr.Source != "op %% prec 2 left = (lhs)//(rhs)" {
+		t.Errorf("wrong error source: %q", perr.Source)
+	}
+	if perr.Pos != len("op %% prec 2 left = (lhs)") || perr.Size != len("//") {
+		t.Errorf("wrong error position: pos=%d, size=%d", perr.Pos, perr.Size)
+	}
+
+	_, _, processed, err = evalStatement([]byte("op !! prec 1 up = lhs"), env)
+	if !errors.As(err, &perr) {
+		t.Fatalf("parsing error expected: processed=%q: %v", processed, err)
+	}
+	if perr.Pos != len("op !! prec 1 ") || perr.Size != len("up") {
+		t.Errorf("wrong error position: processed=%q: pos=%d, size=%d", processed, perr.Pos, perr.Size)
+	}
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	testStatement(t, nil, "0xF0 & 0x3C", 0x30)
+	testStatement(t, nil, "0xF0 | 0x0F", 0xFF)
+	testStatement(t, nil, "0xFF ^ 0b1010", 0xF5)
+	testStatement(t, nil, "~0", -1)
+	testStatement(t, nil, "~~0x10", 0x10)
+	testStatement(t, nil, "0xFF & ~0x0F", 0xF0)
+	testStatement(t, nil, "1 << 4", 16)
+	testStatement(t, nil, "0x100 >> 4", 0x10)
+	testStatement(t, nil, "-16 >> 2", -4)
+	testStatement(t, nil, "1 >> 100", 0)
+	testStatement(t, nil, "1 << 64", 1<<64)
+
+	// C precedence: * > + > shifts > & > ^ > |
+	testStatement(t, nil, "1 << 2+1", 8)
+	testStatement(t, nil, "0x0F & 0x3C << 1", 0x08)
+	testStatement(t, nil, "1 | 6 ^ 3 & 2", 5)
+	testStatement(t, nil, "(1 | 6) ^ 3", 4)
+	testStatement(t, nil, "0xF0 & 0xFF | 1", 0xF1)
+
+	env := newEnvironment()
+	testCommand(t, env, ":base hex", "")
+	testStatementOutput(t, env, "0xDEAD_BEEF & 0xFFFF_0000 | 0x1234", "0xDEAD_1234")
+	testCommand(t, env, ":precision 50", "")
+	testStatementOutput(t, env, "(1 << 100) | 1", "0x10_0000_0000_0000_0000_0000_0001")
+	testCommand(t, env, ":rational on", "")
+	testStatementOutput(t, env, "(4/2) << 3", "0x10")
+
+	tests := []struct {
+		input     string
+		errorPos  int
+		errorSize int
+	}{
+		{"1.5 & 1", len("("), len("1.5")},
+		{"0xFF ^ (1/2+1)", len("(0xFF)^(("), len("1/2+1")},
+		{"~0.5", len("~"), len("0.5")},
+		{"1i | 1", len("("), len("1i")},
+		{"1 << -1", len("(1)"), len("<<")},
+		{"-0.5&1", 0, len("-0.5")},
+	}
+	for _, test := range tests {
+		_, _, processed, err := evalStatement([]byte(test.input), newEnvironment())
+		var perr ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("parsing error expected: input=%q, processed=%q: %v", test.input, processed, err)
+			continue
+		}
+		if perr.Pos != test.errorPos || perr.Size != test.errorSize {
+			t.Errorf("wrong error position: input=%q, processed=%q: pos=%d, size=%d", test.input, processed, perr.Pos, perr.Size)
+		}
+	}
+	assertStatementError(t, "1 ~ 2")
+	assertStatementError(t, "2~")
+	assertStatementError(t, "op & prec 1 = lhs")
+	assertStatementError(t, "op ~ prec 1 = lhs")
+
+	p, err := Compile("x & 0xF0 | ~y << 1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res, err := p.Eval([]float64{0xAB, 2}); err != nil || res != 0xA0|(^2<<1) {
+		t.Errorf("unexpected result: %v: %v", res, err)
+	}
+	if _, err := p.Eval([]float64{0.5, 2}); err == nil {
+		t.Errorf("error expected for a non integer")
+	}
+}
+
+func TestFixedWidthIntegers(t *testing.T) {
+	// casts work in any mode
+	testStatement(t, nil, "u16(70000)", 4464)
+	testStatement(t, nil, "i8(200)", -56)
+	testStatement(t, nil, "u8(-1)", 255)
+	testStatement(t, nil, "i32(2**31)", -(1 << 31))
+	testStatement(t, nil, "u8(2.9)", 2)
+
+	// exactly, even if floats can't hold the argument
+	env := newEnvironment()
+	testStatementOutput(t, env, "u64(0xFFFF_FFFF_FFFF_FFFF)", "18_446_744_073_709_551_615")
+	testStatementOutput(t, env, "u64(2**64)", "0")
+	testStatementOutput(t, env, "i64(2**63-1)", "9_223_372_036_854_775_807")
+	testStatementOutput(t, env, "i64(2**63)", "-9_223_372_036_854_775_808")
+
+	// literals are exact too
+	testCommand(t, env, ":int u64", "")
+	testStatementOutput(t, env, "18446744073709551615", "18_446_744_073_709_551_615")
+	testStatementOutput(t, env, "0xFFFF_FFFF_FFFF_FFFF", "18_446_744_073_709_551_615")
+	testStatementOutput(t, env, "18446744073709551615+1", "0")
+	testCommand(t, env, ":int i64", "")
+	testStatementOutput(t, env, "9223372036854775807", "9_223_372_036_854_775_807")
+	testStatementOutput(t, env, "-9223372036854775808", "-9_223_372_036_854_775_808")
+	testStatementOutput(t, env, "9223372036854775807+1", "-9_223_372_036_854_775_808")
+
+	// the error of a negative number is shown at it
+	for _, input := range []string{"-1.5", "2*-0.5"} {
+		_, _, processed, err := evalStatement([]byte(input), env)
+		var perr ParseError
+		if !errors.As(err, &perr) || perr.Pos+perr.Size > len(processed) || processed[perr.Pos:perr.Pos+perr.Size] != strings.TrimPrefix(input, "2*") {
+			t.Errorf("%q: error expected at the number: %v", input, err)
+		}
+	}
+
+	env = newEnvironment()
+	testCommand(t, env, ":int u8", "")
+	testCommand(t, env, ":int", "int = u8,wrap")
+	testStatementOutput(t, env, "200+100", "44")
+	testStatementOutput(t, env, "0-1", "255")
+	testStatementOutput(t, env, "7/2", "3")
+	testStatementOutput(t, env, "2**8", "0")
+	testStatementOutput(t, env, "300", "44")
+	testStatementOutput(t, env, "0xF0 | 0x0F << 4", "240")
+	assertStatementErrorEnv(t, env, "1.5")
+	assertStatementErrorEnv(t, env, "sin(1)")
+	assertStatementErrorEnv(t, env, "1+1i")
+
+	testCommand(t, env, ":int i8", "")
+	testStatementOutput(t, env, "127+1", "-128")
+	testStatementOutput(t, env, "-7/2", "-3")
+	testCommand(t, env, ":base hex", "")
+	testStatementOutput(t, env, "0-1", "0xFF")
+	testStatementOutput(t, env, "~0x0F", "0xF0")
+	testCommand(t, env, ":base dec", "")
+
+	testCommand(t, env, ":int u64", "")
+	testStatementOutput(t, env, "0-1", "18_446_744_073_709_551_615")
+	testStatementOutput(t, env, "u64(-1) / 3", "6_148_914_691_236_517_205")
+
+	testCommand(t, env, ":int u16,trap", "")
+	testCommand(t, env, ":int", "int = u16,trap")
+	testStatementOutput(t, env, "65535", "65535")
+	_, _, processed, err := evalStatement([]byte("1+65535"), env)
+	var perr ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("parsing error expected: processed=%q: %v", processed, err)
+	}
+	if perr.Pos != len("1") || perr.Size != len("+") {
+		t.Errorf("wrong error position: processed=%q: pos=%d, size=%d", processed, perr.Pos, perr.Size)
+	}
+	testStatementOutput(t, env, "u8(65535)", "255")
+
+	testCommand(t, env, ":int off", "")
+	testStatementOutput(t, env, "7/2", "3.5")
+
+	for _, arg := range []string{"u7", "u8,saturate"} {
+		if _, err := runCommand(":int "+arg, env); err == nil {
+			t.Errorf("%q: error expected", arg)
+		}
+	}
+
+	engine := New()
+	if err := engine.Set("int", "i16"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, test := range []struct {
+		statement string
+		wrapped   bool
+	}{
+		{"32767 + 1", true},
+		{"32767 - 1", false},
+		{"i8(200)", false}, // casts always wrap
+		{"2**16 + 1", true},
+	} {
+		res, err := engine.Eval(test.statement)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", test.statement, err)
+		}
+		if res.Wrapped() != test.wrapped {
+			t.Errorf("%q: expected wrapped=%t", test.statement, test.wrapped)
+		}
+	}
+
+	for _, test := range []struct {
+		fn  function
+		doc string
+	}{
+		{fnU8, "Cast to an 8-bit unsigned integer"},
+		{fnI16, "Cast to a 16-bit signed integer"},
+		{fnU64, "Cast to a 64-bit unsigned integer"},
+	} {
+		if test.fn.doc != test.doc {
+			t.Errorf("%s: expected doc %q, got %q", test.fn.symbol, test.doc, test.fn.doc)
+		}
+	}
+}
+
+func TestNumberSuffixes(t *testing.T) {
+	testStatement(t, nil, "4k", 4000)
+	testStatement(t, nil, "2.5M", 2.5e6)
+	testStatement(t, nil, "3Gi", 3<<30)
+	testStatement(t, nil, "10m", 0.01)
+	testStatement(t, nil, "5µ", 5e-6)
+	testStatement(t, nil, "5u", 5e-6)
+	testStatement(t, nil, "64Gi / 4Ki", 1<<24)
+	testStatement(t, nil, "-1_024k+1", -1023999)
+	testStatement(t, nil, "1.5Ki", 1536)
+	testStatement(t, nil, "2v4M", 2000)
+	testStatement(t, nil, "2kv2", math.Pow(2, 1.0/2000))
+	assertStatementError(t, "2km")
+	assertStatementError(t, "2k_")
+
+	env := newEnvironment()
+	testCommand(t, env, ":rational on", "")
+	testStatementOutput(t, env, "10m + 5µ", "2001/200_000")
+	testCommand(t, env, ":precision 30", "")
+	testStatementOutput(t, env, "3Ti", "3_298_534_883_328")
+
+	// "k" is still a variable, or the only meaning with the suffixes off
+	testStatement(t, env, "k = 2", 2)
+	testStatement(t, env, "4*k", 8)
+	testCommand(t, env, ":suffixes off", "")
+	testCommand(t, env, ":suffixes", "suffixes = off")
+	assertStatementErrorEnv(t, env, "4k")
+	if _, err := runCommand(":suffixes maybe", env); err == nil {
+		t.Errorf("error expected for invalid suffixes option")
+	}
+}
+
+func TestEngine(t *testing.T) {
+	engine := New()
+
+	res, err := engine.Eval("A = 2**3")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Assigned() != "A" || res.String() != "8" || res.Float64() != 8 {
+		t.Errorf("unexpected result: assigned=%q, text=%q, float=%v", res.Assigned(), res.String(), res.Float64())
+	}
+
+	if err := engine.SetVar("B", 0.5); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := engine.SetVar("sin", 1); err == nil {
+		t.Errorf("error expected for builtin function name")
+	}
+	if err := engine.SetVar("2x", 1); err == nil {
+		t.Errorf("error expected for invalid name")
+	}
+	if v, exists := engine.Var("B"); !exists || v.Float64() != 0.5 {
+		t.Errorf("variable not set: %v", v)
+	}
+
+	err = engine.RegisterFunction(Function{
+		Name:    "sqrt",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Float: func(args []float64) (float64, error) {
+			return math.Sqrt(args[0]), nil
+		},
+		Complex: func(args []complex128) (complex128, error) {
+			return cmplx.Sqrt(args[0]), nil
+		},
+		Domain: func(args []float64) error {
+			if args[0] < 0 {
+				return fmt.Errorf("sqrt(%v) = %w", args[0], ErrNaN)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	res, err = engine.Eval("sqrt(A*2) + B")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Float64() != 4.5 {
+		t.Errorf("unexpected result: %v", res.Float64())
+	}
+	res, err = engine.Eval("sqrt(-4)")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !res.IsComplex() || res.Complex128() != 2i || !math.IsNaN(res.Float64()) {
+		t.Errorf("unexpected result: %v", res.Complex128())
+	}
+
+	res, err = engine.Eval("f(x) = x + 1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !res.IsDefinition() || res.Assigned() != "f(x)" || res.String() != "(x)+(1)" {
+		t.Errorf("unexpected definition: assigned=%q, text=%q", res.Assigned(), res.String())
+	}
+
+	// statements are trimmed
+	for _, statement := range []string{" 1", "1 ", " C = 1 "} {
+		if res, err := engine.Eval(statement); err != nil || res.Float64() != 1 {
+			t.Errorf("unexpected result: %q: %v: %v", statement, res, err)
+		}
+	}
+	if names := engine.Complete("sq"); !slices.Equal(names, []string{"sqrt("}) {
+		t.Errorf("unexpected completion: %q", names)
+	}
+	names := engine.Complete("")
+	for _, name := range []string{"A", "B", "PI", "i", "f(", "sin("} {
+		if !slices.Contains(names, name) {
+			t.Errorf("%q not completed: %q", name, names)
+		}
+	}
+
+	if err := engine.Set("rational", "on"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _ := engine.Get("rational"); value != "on" {
+		t.Errorf("setting not changed: %q", value)
+	}
+	res, err = engine.Eval("f(1/3)")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r, exact := res.Rat(); !exact || r.String() != "4/3" {
+		t.Errorf("unexpected fraction: %v, %v", r, exact)
+	}
+
+	_, err = engine.Eval("1+(2//0)")
+	var perr ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("parse error expected: %v", err)
+	}
+	if perr.Source != "1+(2//0)" || perr.Pos != 4 || perr.Size != 2 {
+		t.Errorf("unexpected error: source=%q, pos=%d, size=%d", perr.Source, perr.Pos, perr.Size)
+	}
+	if _, err := engine.Eval("C = "); !errors.As(err, &perr) || perr.Source != "C =" {
+		t.Errorf("parse error expected: %#v", err)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	engine := New()
+	for _, def := range []string{"f(x, y) = x**2 + y", "g(x) = f(x, x) * 2", "op <> prec 2 = (lhs+rhs)/2"} {
+		if _, err := engine.Eval(def); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	p, err := engine.Compile("g(A) + sin(B) <> max(A, B, 2) - PI")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if slots := p.Slots(); !slices.Equal(slots, []string{"A", "B"}) {
+		t.Fatalf("unexpected slots: %q", slots)
+	}
+
+	env := make([]float64, 2)
+	for _, vars := range [][2]float64{{1, 2}, {3, -1}, {0.5, 10}} {
+		env[p.Slot("A")] = vars[0]
+		env[p.Slot("B")] = vars[1]
+		if err := engine.SetVar("A", vars[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := engine.SetVar("B", vars[1]); err != nil {
+			t.Fatal(err)
+		}
+
+		expected, err := engine.Eval(p.Processed())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res, err := p.Eval(env)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res != expected.Float64() {
+			t.Errorf("wrong result: vars=%v: expected %v, got %v", vars, expected.Float64(), res)
+		}
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		p.Eval(env)
+	})
+	if allocs != 0 {
+		t.Errorf("program eval allocates: %v", allocs)
+	}
+
+	// positioned errors, also inside functions
+	p, err = engine.Compile("1 + A // B")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = p.Eval([]float64{1, 0})
+	var perr ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("parse error expected: %v", err)
+	}
+	if perr.Source != "(1)+((A))//(B)" || perr.Pos != len("(1)+((A))") {
+		t.Errorf("unexpected error: source=%q, pos=%d", perr.Source, perr.Pos)
+	}
+	if _, err := p.Eval([]float64{1}); err == nil {
+		t.Errorf("error expected for missing variables")
+	}
+
+	if _, err := engine.Eval("h(x) = log(x)"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p, err = engine.Compile("h(A)")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = p.Eval([]float64{0})
+	if !errors.As(err, &perr) {
+		t.Fatalf("parse error expected: %v", err)
+	}
+	if perr.Source != "h(x) = log(x)" || perr.Pos != len("h(x) = ") {
+		t.Errorf("unexpected error: source=%q, pos=%d", perr.Source, perr.Pos)
+	}
+
+	if _, err := engine.Eval("r(x) = r(x - 1)"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, expr := range []string{"r(1)", "A = 1", "2i + 1", "1 +", "sin(1, 2)", "$9"} {
+		if _, err := engine.Compile(expr); err == nil {
+			t.Errorf("error expected: %q", expr)
+		}
+	}
+
+	// result references are the results when compiling
+	engine = New()
+	if _, err := engine.Eval("20 + 1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := engine.Eval("2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p, err = engine.Compile("$1 + ans*A")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(p.Slots(), []string{"A"}) {
+		t.Errorf("unexpected slots: %v", p.Slots())
+	}
+	if res, err := p.Eval([]float64{10}); err != nil || res != 41 {
+		t.Errorf("unexpected result: %v, %v", res, err)
+	}
+
+	// only floats can be compiled
+	for _, setting := range [][2]string{{"int", "u8"}, {"rational", "on"}, {"precision", "30"}} {
+		engine := New()
+		if err := engine.Set(setting[0], setting[1]); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := engine.Compile("255 + 1"); err == nil {
+			t.Errorf("%s %s: error expected", setting[0], setting[1])
+		}
+	}
+}
+
+const benchmarkExpr = "2*A**2 + sin(B) - max(A, B)/3"
+
+func BenchmarkEvalExpression(b *testing.B) {
+	env := newEnvironment()
+	tokens, err := lexStatement([]byte(benchmarkExpr), env)
+	if err != nil {
+		b.Fatal(err)
+	}
+	recalcPositions(tokens, 0)
+
+	b.ReportAllocs()
+	for i := range b.N {
+		env.vars["A"] = newFloatValue(float64(i))
+		env.vars["B"] = newFloatValue(0.5)
+		if _, _, err := evalExpression(slices.Clone(tokens), env); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProgramEval(b *testing.B) {
+	p, err := Compile(benchmarkExpr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	env := make([]float64, len(p.Slots()))
+	a, c := p.Slot("A"), p.Slot("B")
+
+	b.ReportAllocs()
+	for i := range b.N {
+		env[a] = float64(i)
+		env[c] = 0.5
+		if _, err := p.Eval(env); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestFuzzyInput(t *testing.T) {
+	seed := rand.Int63()
+	fmt.Println("seed:", seed)
+	random := rand.New(rand.NewSource(seed))
+
+	m := newEnvironment()
+
+	t.Run("good tokens", func(t *testing.T) {
+		for range 1_000_000 {
+			input := createRandomInput(random)
+			evalStatement(input, m)
+		}
+	})
+
+	t.Run("bad tokens", func(t *testing.T) {
+		for range 100_000 {
+			input := createRandomBadInput(random)
+			evalStatement(input, m)
+		}
+	})
+
+	t.Run("good input", func(t *testing.T) {
+		for range 1_000_000 {
+			input := createRandomGoodInput(random)
+			_, _, _, err := evalStatement(input, m)
+			if err != nil {
+				if strings.HasSuffix(err.Error(), "division by 0") {
+					continue
+				}
+				if strings.HasSuffix(err.Error(), "= NaN") {
+					continue
+				}
+				if strings.HasSuffix(err.Error(), "not defined for complex numbers") {
+					continue
+				}
+				t.Errorf("error: input = %q: %v", input, err)
+				return
+			}
+		}
+	})
+}
+
+func createRandomGoodInput(random *rand.Rand) []byte {
+	n := random.Int()%100 + 1
+	digits := []byte("0123456789")
+	operators := []string{"+", "-", "*", "/", "//", "%", "v", "**"}
+	functions := []string{"asin", "acos", "atan", "sin", "cos", "tan"} // supersets at the end
+	input := make([]byte, 0, n+8)
+
+	for len(input) < n {
+		if random.Intn(15) == 0 {
+			input = append(input, ' ')
+		}
+		if random.Intn(15) == 0 {
+			input = append(input, '(')
+		}
+
+		var digit byte
+		for {
+			random.Shuffle(len(digits), func(i, j int) {
+				digits[i], digits[j] = digits[j], digits[i]
+			})
+			digit = digits[0]
+			if len(input) > 0 && (input[len(input)-1] == '/' || input[len(input)-1] == '%') && digit == '0' {
+				continue
+			}
+			break
+		}
+		input = append(input, digit)
+
+		random.Shuffle(len(operators), func(i, j int) {
+			operators[i], operators[j] = operators[j], operators[i]
+		})
+		input = append(input, operators[0]...)
+
+		if random.Intn(10) == 0 && input[len(input)-1] != 'v' {
+			fnIdx := random.Intn(len(functions))
+			input = append(input, functions[fnIdx]...)
+			if random.Intn(2) == 0 {
+				input = append(input, ' ')
+			} else {
+				input = append(input, '(')
+			}
+		}
+	}
+
+	if input[len(input)-1] == '(' || input[len(input)-1] == ' ' {
+		input = input[:len(input)-1]
+	}
+	for _, fn := range functions {
+		for bytes.HasSuffix(input, []byte(fn)) {
+			input = input[:len(input)-len(fn)]
+		}
+	}
+
+	for _, op := range operators {
+		for bytes.HasSuffix(input, []byte(op)) {
+			input = input[:len(input)-len(op)]
+		}
+	}
+
+	input = bytes.Trim(input, " \t\r\n")
+	return input
+}
+
+func createRandomInput(random *rand.Rand) []byte {
+	n := random.Int()%100 + 1
+	tokens := []string{
+		"0", "1", "2", "3", "4", "5", "6", "7", "8", "9",
+		".", "+", "-", "*", "/", "//", "%", "v", "**", "(", ")", " ",
+		"sin", "cos", "tan", "asin", "acos", "atan",
+		"re", "im", "abs", "arg", "conj", "i",
+		"atan2", "log", "round", "max", "min", ",",
+		"a", "b", "c", "d",
+	}
+	input := make([]byte, 0, n+8)
+
+	for len(input) < n {
+		random.Shuffle(len(tokens), func(i, j int) {
+			tokens[i], tokens[j] = tokens[j], tokens[i]
+		})
+		input = append(input, tokens[0]...)
+	}
+
+	input = bytes.Trim(input, " \t\r\n")
+	return input
+}
+
+func createRandomBadInput(random *rand.Rand) []byte {
+	n := random.Int()%100 + 1
+	input := make([]byte, 0, n+8)
+
+	for len(input) < n {
+		input = append(input, byte(random.Int()%256))
+	}
+
+	input = bytes.Trim(input, " \t\r\n")
+	return input
+}
+
+func testStatement(t *testing.T, env *environment, input string, expected float64) {
+	t.Helper()
+	if env == nil {
+		env = newEnvironment()
+	}
+	errMargin := 0.0000000001
+	value, _, processed, err := evalStatement([]byte(input), env)
+	if err != nil {
+		t.Errorf("error: input=%q, processed=%q: %v", input, processed, err)
+	}
+	res := value.toFloat()
+	if res < expected-errMargin || res > expected+errMargin {
+		t.Errorf("calculation error: input=%q, processed=%q: expected %.20f, got %.20f", input, processed, expected, res)
+	}
+}
+
+func testStatementOutput(t *testing.T, env *environment, input string, expected string) {
+	t.Helper()
+	res, _, processed, err := evalStatement([]byte(input), env)
+	if err != nil {
+		t.Errorf("error: input=%q, processed=%q: %v", input, processed, err)
+		return
+	}
+	if output := formatValue(res, env); output != expected {
+		t.Errorf("output error: input=%q, processed=%q: expected %q, got %q", input, processed, expected, output)
+	}
+}
+
+func testDefinition(t *testing.T, env *environment, input string) {
+	t.Helper()
+	res, _, processed, err := evalStatement([]byte(input), env)
+	if err != nil {
+		t.Errorf("error: input=%q, processed=%q: %v", input, processed, err)
+	} else if res.kind != valueKindFunction {
+		t.Errorf("definition expected: input=%q, processed=%q: got %s", input, processed, res.kind)
+	}
+}
+
+func assertStatementError(t *testing.T, input string) {
+	t.Helper()
+	assertStatementErrorEnv(t, newEnvironment(), input)
+}
+
+func assertStatementErrorEnv(t *testing.T, env *environment, input string) {
+	t.Helper()
+	_, _, _, err := evalStatement([]byte(input), env)
+	if err == nil {
+		t.Errorf("error expected: input=%q", input)
+	}
+}
+
+func testCommand(t *testing.T, env *environment, line string, expected string) {
+	t.Helper()
+	output, err := runCommand(line, env)
+	if err != nil {
+		t.Errorf("error: command=%q: %v", line, err)
+		return
+	}
+	if output != expected {
+		t.Errorf("command error: command=%q: expected %q, got %q", line, expected, output)
+	}
+}
+
+func TestFork(t *testing.T) {
+	engine := New()
+	for _, statement := range []string{"A = 2", "f(x) = x*A", "op <> prec 2 = lhs+rhs"} {
+		if _, err := engine.Eval(statement); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	fork := engine.Fork()
+	for _, statement := range []string{"A = 3", "B = 1", "f(x) = x", "op <> prec 2 = lhs-rhs", "g(x) = x"} {
+		if _, err := fork.Eval(statement); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if res, err := fork.Eval("f(A) + (5 <> B)"); err != nil || res.Float64() != 7 {
+		t.Errorf("unexpected result in fork: %v: %v", res, err)
+	}
+
+	if res, err := engine.Eval("f(A) + (5 <> A)"); err != nil || res.Float64() != 11 {
+		t.Errorf("engine changed by the fork: %v: %v", res, err)
+	}
+	for _, statement := range []string{"B", "g(1)"} {
+		if _, err := engine.Eval(statement); err == nil {
+			t.Errorf("%q defined by the fork", statement)
+		}
+	}
+}
+
+func TestResults(t *testing.T) {
+	engine := New()
+	if _, err := engine.Eval("ans"); err == nil {
+		t.Errorf("ans without results: error expected")
+	}
+
+	tests := []struct {
+		statement string
+		expected  float64
+		number    int
+	}{
+		{"2+3", 5, 1},
+		{"A = $1*2", 10, 2},
+		{"f(x) = x+1", math.NaN(), 0},
+		{"f(ans)", 11, 3},
+		{"_ - $1", 6, 4},
+		{"$2 + ans", 16, 5},
+	}
+	for _, test := range tests {
+		res, err := engine.Eval(test.statement)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", test.statement, err)
+		}
+		if res.Number() != test.number {
+			t.Errorf("%q: expected number %d, got %d", test.statement, test.number, res.Number())
+		}
+		if !res.IsDefinition() && res.Float64() != test.expected {
+			t.Errorf("%q: expected %v, got %v", test.statement, test.expected, res.Float64())
+		}
+	}
+
+	for _, statement := range []string{"$6", "$0", "$1 = 2", "_ = 2", "_(x) = x"} {
+		if _, err := engine.Eval(statement); err == nil {
+			t.Errorf("%q: error expected", statement)
+		}
+	}
+
+	// a variable takes precedence
+	if _, err := engine.Eval("ans = 100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// "$" isn't an operator, so "2$1" can't mean two things
+	if _, err := engine.Eval("op $ prec 1 = lhs-rhs"); err == nil {
+		t.Errorf("error expected for the operator \"$\"")
+	}
+	if res, err := engine.Eval("ans + $1"); err != nil || res.Float64() != 105 {
+		t.Errorf("unexpected result: %v: %v", res, err)
+	}
+
+	tokens := engine.Tokens("$1+$99")
+	if len(tokens) != 3 || tokens[0].Kind != TokenSymbol || tokens[2].Kind != TokenUnknownSymbol {
+		t.Errorf("unexpected tokens: %v", tokens)
+	}
+
+	fork := engine.Fork()
+	if _, err := fork.Eval("1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res, err := engine.Eval("2"); err != nil || res.Number() != 8 {
+		t.Errorf("unexpected result: %v: %v", res, err)
+	}
+	if res, err := fork.Eval("$8"); err != nil || res.Float64() != 1 {
+		t.Errorf("engine results changed by the fork: %v: %v", res, err)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	engine := New()
+	for _, statement := range []string{"A = 2", "f(x) = x", "op <> prec 2 = lhs+rhs"} {
+		if _, err := engine.Eval(statement); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		statement string
+		expected  []Token
+	}{
+		{"sin(A)  <> f(B)*PI", []Token{
+			{"sin", 0, TokenFunction},
+			{"(", 3, TokenBracket},
+			{"A", 4, TokenSymbol},
+			{")", 5, TokenBracket},
+			{"  ", 6, TokenSpace},
+			{"<>", 8, TokenOperator},
+			{" ", 10, TokenSpace},
+			{"f", 11, TokenFunction},
+			{"(", 12, TokenBracket},
+			{"B", 13, TokenUnknownSymbol},
+			{")", 14, TokenBracket},
+			{"*", 15, TokenOperator},
+			{"PI", 16, TokenSymbol},
+		}},
+		{"C = 1_0;2.5i", []Token{
+			{"C", 0, TokenUnknownSymbol},
+			{" ", 1, TokenSpace},
+			{"=", 2, TokenPunctuation},
+			{" ", 3, TokenSpace},
+			{"1_0", 4, TokenNumber},
+			{";", 7, TokenPunctuation},
+			{"2.5i", 8, TokenNumber},
+		}},
+		{"1+[2] 3", []Token{
+			{"1", 0, TokenNumber},
+			{"+", 1, TokenOperator},
+			{"[2] 3", 2, TokenInvalid},
+		}},
+		{"", []Token{}},
+	}
+	for _, test := range tests {
+		if tokens := engine.Tokens(test.statement); !slices.Equal(tokens, test.expected) {
+			t.Errorf("wrong tokens: %q:\n\texpected %v\n\tgot      %v", test.statement, test.expected, tokens)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	engine := New()
+	src := "# comment\nf(x) = x*2; A = f(3)\n\n:precision 30\n  # indented comment\n"
+	if err := engine.Load(src); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res, err := engine.Eval("A + 1/3"); err != nil || res.String() != "6.33333333333333333333333333333" {
+		t.Errorf("not loaded: %v: %v", res, err)
+	} else if res.Number() != 1 {
+		t.Errorf("loaded results numbered: $%d", res.Number())
+	}
+
+	var perr ParseError
+	err := engine.Load("B = 1\nB +* 2\nC = 3")
+	if !errors.As(err, &perr) || !strings.HasPrefix(perr.Msg, "line 2: ") || perr.Source != "B +* 2" {
+		t.Errorf("error in line 2 expected: %#v", err)
+	}
+	if _, exists := engine.Var("C"); exists {
+		t.Errorf("loaded after an error")
+	}
+	if err := engine.Load(":precision -1"); err == nil || !strings.HasPrefix(err.Error(), "line 1: ") {
+		t.Errorf("error in line 1 expected: %v", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	engine := New()
+	for _, statement := range []string{
+		"g(x) = x + 1",
+		"op <> prec 2 right = g(lhs)*rhs",
+		"f(x) = x <> A",
+		"g(x) = x + 2",
+		"A = 0.1",
+		"B = -2 + 0.5i",
+	} {
+		if _, err := engine.Eval(statement); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := engine.SetVar("C", math.Inf(1)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := engine.Set("mode", "deg"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := strings.Join([]string{
+		":precision off",
+		":rational off",
+		":complex rect",
+		":mode deg",
+		":base dec",
+		":notation sci,1e-6,1e15",
+		":int off",
+		":suffixes on",
+		"A = 0.1",
+		"B = -2+0.5i",
+		"g(x) = (x)+(2)",
+		"op <> prec 2 right = g(lhs)*rhs",
+		"f(x) = (x)<>(A)",
+	}, "\n") + "\n"
+	session := engine.Session()
+	if session != expected {
+		t.Errorf("unexpected session:\n%s\nexpected:\n%s", session, expected)
+	}
+
+	restored := New()
+	for _, line := range strings.Split(strings.TrimSpace(session), "\n") {
+		var err error
+		if strings.HasPrefix(line, ":") {
+			_, err = restored.Command(line)
+		} else {
+			_, err = restored.Eval(line)
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %q: %v", line, err)
+		}
+	}
+	if restored.Session() != session {
+		t.Errorf("session not restored:\n%s", restored.Session())
+	}
+	if res, err := restored.Eval("f(1)"); err != nil || res.Float64() != 0.30000000000000004 {
+		t.Errorf("unexpected result: %v: %v", res, err)
+	}
+
+	engine = New()
+	if err := engine.Set("precision", "30"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := engine.Eval("A = 1/3"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if session := engine.Session(); !strings.Contains(session, "\nA = 0.333333333333333333333333333333") {
+		t.Errorf("precision lost: %s", session)
+	}
+}
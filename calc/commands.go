@@ -0,0 +1,144 @@
+package calc
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// command is a REPL command of the form ":name [arg]" that is not a setting.
+type command struct {
+	name  string
+	usage string
+	doc   string
+	run   func(env *environment, arg string) (string, error)
+}
+
+var errUnexpectedArg = errors.New("unexpected argument")
+
+// commands is initialized in init, since :help refers to it.
+var commands []command
+
+func init() {
+	commands = []command{
+		{
+			name: "vars",
+			doc:  "List the variables",
+			run: func(env *environment, arg string) (string, error) {
+				if arg != "" {
+					return "", errUnexpectedArg
+				}
+				lines := []string{}
+				for _, name := range slices.Sorted(maps.Keys(env.vars)) {
+					lines = append(lines, name+" = "+formatValue(env.vars[name], env))
+				}
+				return strings.Join(lines, "\n"), nil
+			},
+		},
+		{
+			name:  "del",
+			usage: "name",
+			doc:   "Delete a variable, function or operator",
+			run: func(env *environment, arg string) (string, error) {
+				_, isVar := env.vars[arg]
+				_, isFunc := env.funcs[arg]
+				_, isOperator := env.operators[arg]
+				if !isVar && !isFunc && !isOperator {
+					return "", fmt.Errorf("undefined: %q", arg)
+				}
+				// they would fail when called
+				if dependents := operatorDependents(arg, env); len(dependents) > 0 {
+					return "", fmt.Errorf("%q is used by %s", arg, strings.Join(dependents, ", "))
+				}
+				env.own()
+				delete(env.vars, arg)
+				delete(env.funcs, arg)
+				delete(env.operators, arg)
+				return "", nil
+			},
+		},
+		{
+			name: "clear",
+			doc:  "Delete all the variables, functions and operators",
+			run: func(env *environment, arg string) (string, error) {
+				if arg != "" {
+					return "", errUnexpectedArg
+				}
+				env.vars = make(map[string]value)
+				env.funcs = make(map[string]*userFunction)
+				env.operators = make(map[string]*userOperator)
+				return "", nil
+			},
+		},
+		{
+			name: "funcs",
+			doc:  "List the functions and operators",
+			run: func(env *environment, arg string) (string, error) {
+				if arg != "" {
+					return "", errUnexpectedArg
+				}
+				fns := []function{}
+				for _, name := range env.functions.names() {
+					fn, _ := env.functions.lookup(name)
+					fns = append(fns, fn)
+				}
+				width := 0
+				for _, fn := range fns {
+					width = max(width, len(fn.usage))
+				}
+
+				lines := []string{}
+				for _, fn := range fns {
+					lines = append(lines, fmt.Sprintf("%-*s  %s", width, fn.usage, fn.doc))
+				}
+				for _, name := range slices.Sorted(maps.Keys(env.funcs)) {
+					lines = append(lines, env.funcs[name].source())
+				}
+				for _, symbol := range slices.Sorted(maps.Keys(env.operators)) {
+					lines = append(lines, env.operators[symbol].fn.source())
+				}
+				return strings.Join(lines, "\n"), nil
+			},
+		},
+		{
+			name: "help",
+			doc:  "Show this help",
+			run: func(env *environment, arg string) (string, error) {
+				if arg != "" {
+					return "", errUnexpectedArg
+				}
+				usages := []string{}
+				docs := []string{}
+				for _, c := range commands {
+					usages = append(usages, strings.TrimSpace(":"+c.name+" "+c.usage))
+					docs = append(docs, c.doc)
+				}
+				for _, s := range settings {
+					usages = append(usages, ":"+s.name+" ["+s.usage+"]")
+					docs = append(docs, s.doc)
+				}
+				width := 0
+				for _, usage := range usages {
+					width = max(width, len(usage))
+				}
+
+				lines := []string{}
+				for i := range usages {
+					lines = append(lines, fmt.Sprintf("%-*s  %s", width, usages[i], docs[i]))
+				}
+				return strings.Join(lines, "\n"), nil
+			},
+		},
+	}
+}
+
+func lookupCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
@@ -0,0 +1,366 @@
+package calc
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+type instructionKind byte
+
+const (
+	instructionPush       instructionKind = iota // push consts[arg]
+	instructionLoad                              // push env[arg]
+	instructionLoadLocal                         // push locals[arg]
+	instructionStoreLocal                        // pop into locals[arg]
+	instructionOperate                           // pop rhs and lhs, push operators[arg](lhs, rhs)
+	instructionCall                              // pop argc args, push functions[arg](args)
+)
+
+type instruction struct {
+	kind instructionKind
+	arg  int
+	argc int
+
+	// where errors are shown
+	token lexerToken
+	fn    *userFunction // the inlined function the instruction comes from
+}
+
+// Program is an expression compiled to be evaluated many times with floats,
+// without allocating. User functions and operators are inlined, so
+// redefining them later doesn't affect it. It is not safe for concurrent use.
+type Program struct {
+	instructions []instruction
+	consts       []float64
+	operators    []operator
+	functions    []function
+	slots        []string // variable names, indexed like the env of Eval
+
+	stack  []float64
+	locals []float64
+	args   []value // for the domain checks of functions
+
+	processed string
+}
+
+// Compile compiles an expression with the builtin functions only.
+func Compile(expr string) (*Program, error) {
+	return New().Compile(expr)
+}
+
+// Compile compiles an expression using the functions and operators defined
+// in the engine. Variables are not resolved, every symbol that isn't a
+// constant gets a slot in the env of Program.Eval. Result references like
+// "ans" and "$1" are the results when compiling. Programs evaluate floats,
+// so the engine must be in the float mode without fixed-width integers.
+func (e *Engine) Compile(expr string) (*Program, error) {
+	if e.env.intType.bits != 0 {
+		return nil, fmt.Errorf("compile: %s integers can't be compiled, only floats", e.env.intType)
+	}
+	if e.env.mode != evalModeFloat {
+		return nil, fmt.Errorf("compile: the %s mode can't be compiled, only floats", e.env.mode)
+	}
+	tokens, err := lexStatement([]byte(expr), e.env)
+	if err != nil {
+		return nil, withSource(err, expr)
+	}
+	recalcPositions(tokens, 0)
+	for _, token := range tokens {
+		if token.kind == tokenKindEqual {
+			return nil, withSource(newParseError("compile: assignments can't be compiled", token.pos, token.size()), expr)
+		}
+	}
+
+	tree, processed, err := parseExpression(tokens, e.env)
+	if err != nil {
+		return nil, withSource(err, processed)
+	}
+
+	c := compiler{
+		env:     e.env,
+		program: &Program{processed: processed},
+	}
+	if err := c.compile(tree, nil, nil); err != nil {
+		return nil, withSource(err, processed)
+	}
+
+	p := c.program
+	p.stack = make([]float64, c.maxDepth)
+	p.locals = make([]float64, c.localsCount)
+	p.args = make([]value, c.maxArgs)
+	return p, nil
+}
+
+// withSource sets the source of parse errors that don't have one.
+func withSource(err error, source string) error {
+	var perr ParseError
+	if errors.As(err, &perr) && perr.Source == "" {
+		perr.Source = source
+		return perr
+	}
+	return err
+}
+
+type compiler struct {
+	env     *environment
+	program *Program
+
+	depth       int // of the stack
+	maxDepth    int
+	localsCount int
+	maxArgs     int
+	inlining    []*userFunction
+}
+
+func (c *compiler) emit(inst instruction, depthChange int) {
+	c.program.instructions = append(c.program.instructions, inst)
+	c.depth += depthChange
+	c.maxDepth = max(c.maxDepth, c.depth)
+}
+
+// compile emits the instructions that leave the value of node on the stack.
+// Inside inlined functions, locals maps the parameters to their index in the
+// program locals.
+func (c *compiler) compile(node *parserNode, fn *userFunction, locals map[string]int) error {
+	inst := instruction{token: node.token, fn: fn}
+
+	newError := func(msg string) error {
+		perr := newParseError(fmt.Sprintf("compile: %s", msg), node.token.pos, node.token.size())
+		if fn != nil {
+			return fn.wrapError(perr)
+		}
+		return perr
+	}
+
+	switch n := node.data.(type) {
+	case nodeKindNumber:
+		if n.number.kind == valueKindComplex {
+			return newError("complex numbers can't be compiled")
+		}
+		inst.kind = instructionPush
+		inst.arg = len(c.program.consts)
+		c.program.consts = append(c.program.consts, n.number.toFloat())
+		c.emit(inst, 1)
+
+	case nodeKindSymbol:
+		name := node.token.text
+		if idx, exists := locals[name]; exists {
+			inst.kind = instructionLoadLocal
+			inst.arg = idx
+			c.emit(inst, 1)
+			return nil
+		}
+		if constant, exists := lookupConstant(name); exists {
+			if _, isVar := c.env.vars[name]; !isVar {
+				v := constant.value(c.env)
+				if v.kind == valueKindComplex {
+					return newError("complex numbers can't be compiled")
+				}
+				inst.kind = instructionPush
+				inst.arg = len(c.program.consts)
+				c.program.consts = append(c.program.consts, v.toFloat())
+				c.emit(inst, 1)
+				return nil
+			}
+		}
+		if _, isVar := c.env.vars[name]; !isVar && isResultReference(name) {
+			res, err := c.env.lookupResult(name)
+			if err != nil {
+				return newError(err.Error())
+			}
+			if res.kind == valueKindComplex {
+				return newError("complex numbers can't be compiled")
+			}
+			inst.kind = instructionPush
+			inst.arg = len(c.program.consts)
+			c.program.consts = append(c.program.consts, res.toFloat())
+			c.emit(inst, 1)
+			return nil
+		}
+		slot := slices.Index(c.program.slots, name)
+		if slot == -1 {
+			slot = len(c.program.slots)
+			c.program.slots = append(c.program.slots, name)
+		}
+		inst.kind = instructionLoad
+		inst.arg = slot
+		c.emit(inst, 1)
+
+	case nodeKindOperation:
+		if err := c.compile(n.lhs, fn, locals); err != nil {
+			return err
+		}
+		if err := c.compile(n.rhs, fn, locals); err != nil {
+			return err
+		}
+		inst.kind = instructionOperate
+		inst.arg = len(c.program.operators)
+		c.program.operators = append(c.program.operators, n.op)
+		c.emit(inst, -1)
+
+	case nodeKindFunction:
+		for _, arg := range n.args {
+			if err := c.compile(arg, fn, locals); err != nil {
+				return err
+			}
+		}
+		f := n.fn
+		if c.env.degrees {
+			f = f.inDegrees()
+		}
+		inst.kind = instructionCall
+		inst.arg = len(c.program.functions)
+		inst.argc = len(n.args)
+		c.program.functions = append(c.program.functions, f)
+		c.maxArgs = max(c.maxArgs, len(n.args))
+		c.emit(inst, 1-len(n.args))
+
+	case nodeKindUserCall:
+		userFn, exists := c.env.funcs[n.name]
+		if !exists {
+			return newError(fmt.Sprintf("undefined function: %q", n.name))
+		}
+		return c.inline(userFn, n.args, fn, locals, newError)
+
+	case nodeKindUserOperation:
+		op, exists := c.env.operators[n.symbol]
+		if !exists {
+			return newError(fmt.Sprintf("undefined operator: %q", n.symbol))
+		}
+		return c.inline(op.fn, []*parserNode{n.lhs, n.rhs}, fn, locals, newError)
+
+	default:
+		panic("unexpected parser node kind")
+	}
+	return nil
+}
+
+// inline compiles the body of a user function, its arguments being stored in
+// new locals.
+func (c *compiler) inline(
+	userFn *userFunction,
+	args []*parserNode,
+	fn *userFunction,
+	locals map[string]int,
+	newError func(msg string) error,
+) error {
+	if slices.Contains(c.inlining, userFn) {
+		return newError(fmt.Sprintf("recursive function %q can't be compiled", userFn.name))
+	}
+	if err := userFn.checkArity(len(args)); err != nil {
+		return newError(err.Error())
+	}
+	tree, err := userFn.parse(c.env)
+	if err != nil {
+		return userFn.wrapError(err)
+	}
+
+	params := make(map[string]int, len(args))
+	for i, arg := range args {
+		if err := c.compile(arg, fn, locals); err != nil {
+			return err
+		}
+		params[userFn.params[i]] = c.localsCount
+		c.localsCount++
+	}
+	// stored in reverse, the last argument being on top
+	for i := len(args) - 1; i >= 0; i-- {
+		c.emit(instruction{kind: instructionStoreLocal, arg: params[userFn.params[i]]}, -1)
+	}
+
+	c.inlining = append(c.inlining, userFn)
+	defer func() { c.inlining = c.inlining[:len(c.inlining)-1] }()
+	return c.compile(tree, userFn, params)
+}
+
+// Slots returns the names of the variables used by the program, in the order
+// expected by Eval.
+func (p *Program) Slots() []string {
+	return slices.Clone(p.slots)
+}
+
+// Slot returns the index of a variable in the env of Eval, or -1 if the
+// program doesn't use it.
+func (p *Program) Slot(name string) int {
+	return slices.Index(p.slots, name)
+}
+
+// Processed returns the expression after the syntax sugar is applied, which
+// the position of ParseError errors refers to.
+func (p *Program) Processed() string {
+	return p.processed
+}
+
+// Eval evaluates the program with the values of its variables in env,
+// indexed by slot.
+func (p *Program) Eval(env []float64) (float64, error) {
+	if len(env) < len(p.slots) {
+		return 0, fmt.Errorf("program eval: expected %d variables, got %d", len(p.slots), len(env))
+	}
+
+	stack := p.stack[:0]
+	for i := range p.instructions {
+		inst := &p.instructions[i]
+
+		switch inst.kind {
+		case instructionPush:
+			stack = append(stack, p.consts[inst.arg])
+
+		case instructionLoad:
+			stack = append(stack, env[inst.arg])
+
+		case instructionLoadLocal:
+			stack = append(stack, p.locals[inst.arg])
+
+		case instructionStoreLocal:
+			p.locals[inst.arg] = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+		case instructionOperate:
+			lhs, rhs := stack[len(stack)-2], stack[len(stack)-1]
+			res, err := p.operators[inst.arg].operation(lhs, rhs)
+			if err != nil {
+				return 0, p.newError(inst, err)
+			}
+			stack = stack[:len(stack)-1]
+			stack[len(stack)-1] = res
+
+		case instructionCall:
+			fn := &p.functions[inst.arg]
+			args := stack[len(stack)-inst.argc:]
+			if fn.domain != nil {
+				values := p.args[:inst.argc]
+				for i, arg := range args {
+					values[i] = newFloatValue(arg)
+				}
+				if err := fn.domain(values); err != nil {
+					return 0, p.newError(inst, err)
+				}
+			}
+			res, err := fn.fn(args)
+			if err != nil {
+				return 0, p.newError(inst, err)
+			}
+			stack = stack[:len(stack)-inst.argc]
+			stack = append(stack, res)
+
+		default:
+			panic("unexpected instruction kind")
+		}
+	}
+
+	if len(stack) != 1 {
+		panic(fmt.Errorf("program eval: %d values left in the stack", len(stack)))
+	}
+	return stack[0], nil
+}
+
+func (p *Program) newError(inst *instruction, err error) error {
+	perr := newParseError(fmt.Sprintf("program eval: %s", err), inst.token.pos, inst.token.size())
+	if inst.fn != nil {
+		return inst.fn.wrapError(perr)
+	}
+	perr.Source = p.processed
+	return perr
+}
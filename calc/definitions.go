@@ -0,0 +1,409 @@
+package calc
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Calls to user functions nested deeper than this fail, since there is no
+// way to stop a recursion.
+const maxCallDepth = 1000
+
+type userFunction struct {
+	name   string
+	params []string
+	header string       // left side of the definition, eg: "f(x, y)"
+	tokens []lexerToken // preprocessed body
+	body   string       // processed body
+	order  int          // of the first definition with the same name, see environment.definitions
+
+	// The body is parsed again if the evaluation mode changes, since numbers
+	// are parsed differently.
+	tree          *parserNode
+	treeMode      evalMode
+	treePrecision int
+}
+
+// source returns the whole definition, used to show errors in the body.
+func (f *userFunction) source() string {
+	return f.header + " = " + f.body
+}
+
+func (f *userFunction) bodyPos() int {
+	return len(f.header + " = ")
+}
+
+func (f *userFunction) checkArity(count int) error {
+	if count != len(f.params) {
+		return fmt.Errorf("%s: expected %s, got %d", f.name, countArguments(len(f.params)), count)
+	}
+	return nil
+}
+
+func (f *userFunction) parse(env *environment) (*parserNode, error) {
+	if f.tree != nil && f.treeMode == env.mode && f.treePrecision == env.precision {
+		return f.tree, nil
+	}
+	tree, err := parseTokens(f.tokens, env)
+	if err != nil {
+		return nil, err
+	}
+	f.tree = tree
+	f.treeMode = env.mode
+	f.treePrecision = env.precision
+	return tree, nil
+}
+
+// setBody preprocesses and parses the body of the function, which must be
+// already registered if it calls itself.
+func (f *userFunction) setBody(tokens []lexerToken, env *environment) error {
+	markUserFunctions(tokens, env, f.params)
+
+	tokens, err := preprocessTokens(tokens)
+	f.tokens = tokens
+	f.body = tokensToString(tokens)
+	if err != nil {
+		return shiftError(err, f.bodyPos())
+	}
+
+	if _, err := f.parse(env); err != nil {
+		return shiftError(err, f.bodyPos())
+	}
+	return nil
+}
+
+// call evaluates the body of the function with the parameters bound to args.
+func (f *userFunction) call(args []value, env *environment) (value, error) {
+	if env.depth >= maxCallDepth {
+		return value{}, fmt.Errorf("%s: maximum recursion depth exceeded", f.name)
+	}
+
+	tree, err := f.parse(env)
+	if err != nil {
+		return value{}, f.wrapError(err)
+	}
+
+	locals := make(map[string]value, len(args))
+	for i, param := range f.params {
+		locals[param] = args[i]
+	}
+	callEnv := *env
+	callEnv.locals = locals
+	callEnv.depth++
+
+	res, err := evalTree(tree, &callEnv)
+	if err != nil {
+		return value{}, f.wrapError(err)
+	}
+	return res, nil
+}
+
+// wrapError makes the position of errors in the body relative to the whole
+// definition, unless it comes from a function called by this one.
+func (f *userFunction) wrapError(err error) error {
+	var perr ParseError
+	if !errors.As(err, &perr) || perr.Source != "" {
+		return err
+	}
+	perr.Msg = fmt.Sprintf("in %s: %s", f.name, perr.Msg)
+	perr.Pos += f.bodyPos()
+	perr.Source = f.source()
+	return perr
+}
+
+// markUserFunctions changes the kind of the symbols that name user
+// functions, so they are parsed like builtin ones. Symbols in locals are
+// left untouched.
+func markUserFunctions(tokens []lexerToken, env *environment, locals []string) {
+	for i, token := range tokens {
+		if token.kind != tokenKindSymbol || slices.Contains(locals, token.text) {
+			continue
+		}
+		if _, exists := env.funcs[token.text]; exists {
+			tokens[i].kind = tokenKindFunction
+		}
+	}
+}
+
+// defineFunction handles statements like "f(x, y) = x**2 + y", the tokens
+// positions being already calculated.
+func defineFunction(tokens []lexerToken, env *environment) (res value, assignedSymbol string, processed string, err error) {
+	name := tokens[0]
+	if name.kind != tokenKindSymbol {
+		return value{}, "", tokensToString(tokens), newParseError(
+			fmt.Sprintf("definition: %q is a builtin function", name.text),
+			name.pos,
+			name.size(),
+		)
+	}
+
+	if _, exists := lookupConstant(name.text); exists {
+		return value{}, "", tokensToString(tokens), newParseError(
+			fmt.Sprintf("definition: %q is a constant", name.text),
+			name.pos,
+			name.size(),
+		)
+	}
+
+	if isResultReference(name.text) && name.text != "ans" {
+		return value{}, "", tokensToString(tokens), newParseError(
+			fmt.Sprintf("definition: %q is a result reference", name.text),
+			name.pos,
+			name.size(),
+		)
+	}
+
+	params := []string{}
+	commaExpected := false
+	idx := 2 // after the "("
+	for idx < len(tokens) && tokens[idx].kind != tokenKindBracketClose {
+		token := tokens[idx]
+		idx++
+
+		switch {
+		case token.kind == tokenKindSpace:
+			continue
+		case commaExpected && token.kind == tokenKindComma:
+			commaExpected = false
+			continue
+		case commaExpected:
+			return value{}, "", tokensToString(tokens), newParseError("definition: comma expected", token.pos, token.size())
+		case token.kind == tokenKindFunction:
+			return value{}, "", tokensToString(tokens), newParseError(
+				fmt.Sprintf("definition: %q is a builtin function", token.text),
+				token.pos,
+				token.size(),
+			)
+		case token.kind != tokenKindSymbol:
+			return value{}, "", tokensToString(tokens), newParseError("definition: parameter name expected", token.pos, token.size())
+		case slices.Contains(params, token.text):
+			return value{}, "", tokensToString(tokens), newParseError(
+				fmt.Sprintf("definition: duplicated parameter: %q", token.text),
+				token.pos,
+				token.size(),
+			)
+		}
+		params = append(params, token.text)
+		commaExpected = true
+	}
+	if len(params) > 0 && !commaExpected {
+		return value{}, "", tokensToString(tokens), newParseError("definition: parameter name expected", tokens[idx-1].pos, tokens[idx-1].size())
+	}
+	idx++ // the ")"
+
+	for idx < len(tokens) && tokens[idx].kind == tokenKindSpace {
+		idx++
+	}
+	if idx >= len(tokens) || tokens[idx].kind != tokenKindEqual {
+		pos := len(tokensToString(tokens))
+		if idx < len(tokens) {
+			pos = tokens[idx].pos
+		}
+		return value{}, "", tokensToString(tokens), newParseError("definition: \"=\" expected", pos, 1)
+	}
+	idx++
+	for idx < len(tokens) && tokens[idx].kind == tokenKindSpace {
+		idx++
+	}
+
+	fn := &userFunction{
+		name:   name.text,
+		params: params,
+		header: name.text + "(" + strings.Join(params, ", ") + ")",
+	}
+	processed = fn.header + " = "
+	if idx >= len(tokens) {
+		return value{}, fn.header, processed, newParseError("definition: expression expected", len(processed), 1)
+	}
+
+	body := slices.Clone(tokens[idx:])
+	recalcPositions(body, 0)
+
+	// registered before parsing the body, so it can be called recursively
+	env.own()
+	prev, redefined := env.funcs[fn.name]
+	fn.order = env.definitionOrder(prev)
+	env.funcs[fn.name] = fn
+	if err := fn.setBody(body, env); err != nil {
+		if redefined {
+			env.funcs[fn.name] = prev
+		} else {
+			delete(env.funcs, fn.name)
+		}
+		return value{}, fn.header, fn.source(), err
+	}
+	delete(env.vars, fn.name)
+
+	return newFunctionValue(fn), fn.header, fn.source(), nil
+}
+
+// Characters that can be used in the symbol of user operators.
+const operatorChars = "!#%&*+-/<>?@^|~"
+
+type userOperator struct {
+	fn            *userFunction // with the parameters "lhs" and "rhs"
+	precedence    int
+	associativity associativity
+}
+
+// isOperatorDefinition tells if the statement is like "op <symbol> ... = ...",
+// so "op" can still be used as a variable.
+func isOperatorDefinition(statement string) bool {
+	fields := strings.Fields(statement)
+	return len(fields) >= 2 && fields[0] == "op" && fields[1] != "=" && strings.Contains(statement, "=")
+}
+
+// defineOperator handles statements like "op <> prec 2 left = (lhs+rhs)/2",
+// the associativity being left if omitted.
+func defineOperator(statement string, env *environment) (res value, assignedSymbol string, processed string, err error) {
+	header, bodyText, _ := strings.Cut(statement, "=")
+	header = strings.TrimSpace(header)
+	bodyText = strings.TrimSpace(bodyText)
+
+	type field struct {
+		text string
+		pos  int
+	}
+	fields := []field{}
+	offset := 0
+	for _, text := range strings.Fields(header) {
+		pos := offset + strings.Index(header[offset:], text)
+		fields = append(fields, field{text: text, pos: pos})
+		offset = pos + len(text)
+	}
+
+	if len(fields) < 4 || len(fields) > 5 {
+		return value{}, "", statement, newParseError(
+			"definition: expected \"op <symbol> prec <precedence> [left|right] = <expression>\"",
+			0,
+			len(header),
+		)
+	}
+
+	symbol := fields[1]
+	if strings.Trim(symbol.text, operatorChars) != "" {
+		return value{}, "", statement, newParseError(
+			fmt.Sprintf("definition: invalid operator symbol: %q: must be made of %q", symbol.text, operatorChars),
+			symbol.pos,
+			len(symbol.text),
+		)
+	}
+	isBuiltin := symbol.text == fnBitwiseNot.symbol
+	for _, op := range builtinOperators {
+		isBuiltin = isBuiltin || op.symbol == symbol.text
+	}
+	if isBuiltin {
+		return value{}, "", statement, newParseError(
+			fmt.Sprintf("definition: %q is a builtin operator", symbol.text),
+			symbol.pos,
+			len(symbol.text),
+		)
+	}
+
+	if fields[2].text != "prec" {
+		return value{}, "", statement, newParseError("definition: \"prec\" expected", fields[2].pos, len(fields[2].text))
+	}
+	precedence, err := strconv.Atoi(fields[3].text)
+	if err != nil || precedence < 0 || precedence >= functionPrecedence {
+		return value{}, "", statement, newParseError(
+			fmt.Sprintf("definition: invalid precedence: %q: must be a number between 0 and %d", fields[3].text, functionPrecedence-1),
+			fields[3].pos,
+			len(fields[3].text),
+		)
+	}
+
+	assoc := associativityLeft
+	if len(fields) == 5 {
+		switch fields[4].text {
+		case "left":
+		case "right":
+			assoc = associativityRight
+		default:
+			return value{}, "", statement, newParseError(
+				fmt.Sprintf("definition: invalid associativity: %q: must be left or right", fields[4].text),
+				fields[4].pos,
+				len(fields[4].text),
+			)
+		}
+	}
+
+	op := &userOperator{
+		fn: &userFunction{
+			name:   symbol.text,
+			params: []string{"lhs", "rhs"},
+			header: fmt.Sprintf("op %s prec %d %s", symbol.text, precedence, assoc),
+		},
+		precedence:    precedence,
+		associativity: assoc,
+	}
+	processed = op.fn.header + " = "
+	if bodyText == "" {
+		return value{}, op.fn.header, processed, newParseError("definition: expression expected", len(processed), 1)
+	}
+
+	// registered before lexing the body, so it can be used recursively
+	env.own()
+	prev, redefined := env.operators[symbol.text]
+	if redefined {
+		op.fn.order = env.definitionOrder(prev.fn)
+	} else {
+		op.fn.order = env.definitionOrder(nil)
+	}
+	env.operators[symbol.text] = op
+	restore := func() {
+		if redefined {
+			env.operators[symbol.text] = prev
+		} else {
+			delete(env.operators, symbol.text)
+		}
+	}
+
+	body, err := lexStatement([]byte(bodyText), env)
+	if err != nil {
+		restore()
+		return value{}, op.fn.header, processed + bodyText, shiftError(err, len(processed))
+	}
+	if err := op.fn.setBody(body, env); err != nil {
+		restore()
+		return value{}, op.fn.header, op.fn.source(), err
+	}
+
+	return newFunctionValue(op.fn), op.fn.header, op.fn.source(), nil
+}
+
+// operatorDependents returns the user functions and other operators whose
+// body uses the operator, eg: "f(x)" or "op <+>".
+func operatorDependents(symbol string, env *environment) []string {
+	uses := func(fn *userFunction) bool {
+		return slices.ContainsFunc(fn.tokens, func(token lexerToken) bool {
+			return token.kind == tokenKindOperator && token.text == symbol
+		})
+	}
+	dependents := []string{}
+	for _, name := range slices.Sorted(maps.Keys(env.funcs)) {
+		if uses(env.funcs[name]) {
+			dependents = append(dependents, env.funcs[name].header)
+		}
+	}
+	for _, other := range slices.Sorted(maps.Keys(env.operators)) {
+		if other != symbol && uses(env.operators[other].fn) {
+			dependents = append(dependents, "op "+other)
+		}
+	}
+	return dependents
+}
+
+// shiftError moves the position of a parsing error, unless it refers to the
+// definition of a user function.
+func shiftError(err error, offset int) error {
+	var perr ParseError
+	if !errors.As(err, &perr) || perr.Source != "" {
+		return err
+	}
+	perr.Pos += offset
+	return perr
+}
@@ -0,0 +1,321 @@
+// Package calc evaluates the expressions of sweet-calc, with its syntax sugar,
+// user functions and operators.
+package calc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+// Engine evaluates statements, keeping the variables, user definitions and
+// settings between them. It is not safe for concurrent use.
+type Engine struct {
+	env *environment
+}
+
+func New() *Engine {
+	return &Engine{env: newEnvironment()}
+}
+
+// Result is the outcome of a statement.
+type Result struct {
+	value     value
+	text      string
+	assigned  string
+	processed string
+	number    int
+	wrapped   bool
+}
+
+// String returns the result formatted with the settings of the engine at the
+// time it was evaluated.
+func (r Result) String() string {
+	return r.text
+}
+
+// Assigned returns the variable, function or operator defined by the
+// statement, eg: "A" or "f(x, y)", or "" if it was just an expression.
+func (r Result) Assigned() string {
+	return r.assigned
+}
+
+// Processed returns the statement after the syntax sugar is applied.
+func (r Result) Processed() string {
+	return r.processed
+}
+
+// Number returns n if the result can be referenced as "$n" in later
+// statements, or 0 if it is a definition.
+func (r Result) Number() int {
+	return r.number
+}
+
+// Wrapped tells if some value wrapped around in the fixed-width integer mode
+// while evaluating the statement.
+func (r Result) Wrapped() bool {
+	return r.wrapped
+}
+
+// IsDefinition tells if the statement defined a function or operator, in
+// which case there is no numeric result.
+func (r Result) IsDefinition() bool {
+	return r.value.kind == valueKindFunction
+}
+
+// IsComplex tells if the result has an imaginary part.
+func (r Result) IsComplex() bool {
+	return r.value.kind == valueKindComplex
+}
+
+// Float64 returns the result as a float, or NaN if it is complex or a
+// definition.
+func (r Result) Float64() float64 {
+	if r.IsComplex() || r.IsDefinition() {
+		return math.NaN()
+	}
+	return r.value.toFloat()
+}
+
+// Complex128 returns the result as a complex number, or NaN if it is a
+// definition.
+func (r Result) Complex128() complex128 {
+	if r.IsDefinition() {
+		return complex(math.NaN(), math.NaN())
+	}
+	return r.value.toComplex()
+}
+
+// Rat returns the result as a fraction, only if it is known to be exact.
+func (r Result) Rat() (*big.Rat, bool) {
+	if r.IsComplex() || r.IsDefinition() {
+		return nil, false
+	}
+	rat, exact := r.value.toRat()
+	if !exact {
+		return nil, false
+	}
+	return new(big.Rat).Set(rat), true
+}
+
+func (e *Engine) newResult(res value, assigned string, processed string) Result {
+	return Result{
+		value:     res,
+		text:      formatValue(res, e.env),
+		assigned:  assigned,
+		processed: processed,
+	}
+}
+
+// Eval evaluates a single statement, an expression or a definition like
+// "A = 2", "f(x) = x*2" or "op <> prec 2 = (lhs+rhs)/2". Results that are not
+// definitions are numbered, so later statements can use them as "$n", or as
+// "ans" or "_" for the last one. The position of ParseError errors refers to
+// its Source field.
+func (e *Engine) Eval(statement string) (Result, error) {
+	result, err := e.eval(statement)
+	if err != nil {
+		return Result{}, err
+	}
+	if !result.IsDefinition() {
+		e.env.results = append(e.env.results, result.value)
+		result.number = len(e.env.results)
+	}
+	return result, nil
+}
+
+// eval evaluates a statement without numbering its result.
+func (e *Engine) eval(statement string) (Result, error) {
+	e.env.wrapped = false
+	res, assigned, processed, err := evalStatement([]byte(statement), e.env)
+	if err != nil {
+		var perr ParseError
+		if errors.As(err, &perr) && perr.Source == "" {
+			perr.Source = processed
+			return Result{}, perr
+		}
+		return Result{}, err
+	}
+	result := e.newResult(res, assigned, processed)
+	result.wrapped = e.env.wrapped
+	return result, nil
+}
+
+// Load evaluates the statements and commands of a file, like a config file
+// with function and operator definitions, or a session. They are separated by
+// ";" or newlines, and lines starting with "#" are comments. The results are
+// not numbered, and it stops at the first error, which tells its line.
+// Statements are evaluated without the fixed-width integer mode, so the
+// variables of a session are restored as they were saved, eg: 0.5 is not an
+// integer.
+func (e *Engine) Load(src string) error {
+	for i, line := range strings.Split(src, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, stmt := range strings.Split(line, ";") {
+			stmt = strings.TrimSpace(stmt)
+			if stmt == "" {
+				continue
+			}
+			var err error
+			if stmt[0] == ':' {
+				_, err = e.Command(stmt)
+			} else {
+				mode := e.env.intType
+				e.env.intType = intType{}
+				_, err = e.eval(stmt)
+				e.env.intType = mode
+			}
+			var perr ParseError
+			if errors.As(err, &perr) {
+				perr.Msg = fmt.Sprintf("line %d: %s", i+1, perr.Msg)
+				return perr
+			}
+			if err != nil {
+				return fmt.Errorf("line %d: %w", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// SetVar assigns a variable, replacing any user function with the same name.
+func (e *Engine) SetVar(name string, x float64) error {
+	if !isIdentifier(name) {
+		return fmt.Errorf("set var: invalid name: %q", name)
+	}
+	if _, exists := e.env.functions.lookup(name); exists {
+		return fmt.Errorf("set var: %q is a builtin function", name)
+	}
+	e.env.own()
+	e.env.vars[name] = newFloatValue(x)
+	delete(e.env.funcs, name)
+	return nil
+}
+
+// Var returns the value of a variable.
+func (e *Engine) Var(name string) (Result, bool) {
+	v, exists := e.env.vars[name]
+	if !exists {
+		return Result{}, false
+	}
+	return e.newResult(v, name, name), true
+}
+
+// Function describes a function to be registered in an engine, which can
+// then be called like the builtin ones.
+type Function struct {
+	Name    string
+	MinArgs int
+	MaxArgs int    // -1 if variadic
+	Usage   string // eg: "log(x[, base])"
+	Doc     string
+
+	Float func(args []float64) (float64, error)
+	// Complex is optional, it is used when some argument is complex, or when
+	// Float or Domain return an error wrapping ErrNaN.
+	Complex func(args []complex128) (complex128, error)
+	// Domain is optional, it rejects real arguments before Float is called.
+	Domain func(args []float64) error
+}
+
+// ErrNaN can be wrapped by the errors of registered functions when the result
+// is not a real number, so the complex version is tried.
+var ErrNaN = errNaN
+
+// RegisterFunction adds a function, failing if the name is already used by
+// another one.
+func (e *Engine) RegisterFunction(fn Function) error {
+	f := function{
+		fn:        fn.Float,
+		complexFn: fn.Complex,
+		minArgs:   fn.MinArgs,
+		maxArgs:   fn.MaxArgs,
+		symbol:    fn.Name,
+		usage:     fn.Usage,
+		doc:       fn.Doc,
+	}
+	if fn.Domain != nil {
+		f.domain = func(args []value) error {
+			floatArgs := make([]float64, len(args))
+			for i, arg := range args {
+				floatArgs[i] = arg.toFloat()
+			}
+			return fn.Domain(floatArgs)
+		}
+	}
+	e.env.own()
+	return e.env.functions.register(f)
+}
+
+// Fork returns an engine that starts with the variables, definitions and
+// settings of e, and that doesn't change e when evaluating. The definitions
+// are only copied when the fork changes them, so it is cheap to get one to
+// try a statement. e must not be changed while the fork is used.
+func (e *Engine) Fork() *Engine {
+	return &Engine{env: e.env.fork()}
+}
+
+// Set changes a setting, like "--name=arg" in the command line.
+func (e *Engine) Set(name string, arg string) error {
+	s, ok := lookupSetting(name)
+	if !ok {
+		return fmt.Errorf("unknown setting: %q", name)
+	}
+	return s.set(e.env, arg)
+}
+
+// Get returns the current value of a setting.
+func (e *Engine) Get(name string) (string, error) {
+	s, ok := lookupSetting(name)
+	if !ok {
+		return "", fmt.Errorf("unknown setting: %q", name)
+	}
+	return s.get(e.env), nil
+}
+
+// ParseArgs applies the "--name=arg" options and returns the remaining
+// arguments.
+func (e *Engine) ParseArgs(args []string) ([]string, error) {
+	return parseArgs(args, e.env)
+}
+
+// Command executes a REPL command of the form ":name [arg]", returning the
+// text to show to the user.
+func (e *Engine) Command(line string) (string, error) {
+	return runCommand(line, e.env)
+}
+
+// Complete returns the names starting with prefix that can be used in an
+// expression: variables, constants, "ans" if there is some result, and
+// builtin and user functions, the functions followed by "(", eg: "sin(". They
+// are sorted.
+func (e *Engine) Complete(prefix string) []string {
+	names := []string{}
+	add := func(name string) {
+		if strings.HasPrefix(name, prefix) && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	for name := range e.env.vars {
+		add(name)
+	}
+	for _, c := range []constant{constPi, constImaginary} {
+		add(c.symbol)
+	}
+	if len(e.env.results) > 0 {
+		add("ans")
+	}
+	for name := range e.env.funcs {
+		add(name + "(")
+	}
+	for _, name := range e.env.functions.names() {
+		add(name + "(")
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,518 @@
+package calc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+// ParseError is an error located in the evaluated text, even if it happens
+// after parsing.
+type ParseError struct {
+	Msg  string
+	Pos  int // byte offset in Source
+	Size int
+
+	// Source is the text Pos refers to, the processed statement or the
+	// definition of a user function.
+	Source string
+}
+
+func newParseError(msg string, pos int, size int) ParseError {
+	return ParseError{Msg: msg, Pos: pos, Size: size}
+}
+
+func (p ParseError) Error() string {
+	return p.Msg
+}
+
+func tokensToString(tokens []lexerToken) string {
+	builder := strings.Builder{}
+	for _, token := range tokens {
+		builder.WriteString(token.text)
+	}
+	return builder.String()
+}
+
+func evalStatement(statement []byte, env *environment) (res value, assignedSymbol string, processed string, err error) {
+	// the spaces around it would be taken for syntax sugar
+	statement = bytes.TrimSpace(statement)
+	if isOperatorDefinition(string(statement)) {
+		return defineOperator(string(statement), env)
+	}
+
+	tokens, err := lexStatement(statement, env)
+	if err != nil {
+		return value{}, "", string(statement), err
+	}
+
+	if len(tokens) == 0 {
+		return value{}, "", tokensToString(tokens), errors.New("statement eval: empty statement")
+	}
+
+	recalcPositions(tokens, 0)
+
+	isAssignment := false
+	for _, token := range tokens {
+		if token.kind == tokenKindEqual {
+			isAssignment = true
+			break
+		}
+	}
+
+	if !isAssignment {
+		res, processed, err = evalExpression(tokens, env)
+		if err != nil {
+			return value{}, "", processed, err
+		}
+		return res, "", processed, nil
+	}
+
+	if len(tokens) > 1 && tokens[1].kind == tokenKindBracketOpen {
+		return defineFunction(tokens, env)
+	}
+
+	symbol := tokens[0]
+	if isResultReference(symbol.text) && symbol.text != "ans" {
+		return value{}, "", tokensToString(tokens), newParseError(
+			fmt.Sprintf("assignment: %q is a result reference", symbol.text),
+			symbol.pos,
+			symbol.size(),
+		)
+	}
+	idx := 1
+
+	if idx < len(tokens) && tokens[idx].kind == tokenKindSpace {
+		idx++
+	}
+
+	idx++ // the "="
+
+	if idx < len(tokens) && tokens[idx].kind == tokenKindSpace {
+		idx++
+	}
+
+	if idx >= len(tokens) {
+		return value{}, symbol.text, tokensToString(tokens), newParseError("statement eval: expression expected", len(tokensToString(tokens)), 1)
+	}
+
+	expr := slices.Clone(tokens[idx:])
+	recalcPositions(expr, 0)
+
+	res, processed, err = evalExpression(expr, env)
+	prefix := symbol.text + " = "
+	processed = prefix + processed
+	if err != nil {
+		return value{}, symbol.text, processed, shiftError(err, len(prefix))
+	}
+	env.own()
+	env.vars[symbol.text] = res
+	delete(env.funcs, symbol.text)
+
+	return res, symbol.text, processed, nil
+}
+
+func recalcPositions(tokens []lexerToken, start int) {
+	nextPos := start
+	if start == -1 {
+		nextPos = tokens[0].pos
+	}
+	for i := range tokens {
+		tokens[i].pos = nextPos
+		nextPos += tokens[i].size()
+	}
+}
+
+func evalExpression(tokens []lexerToken, env *environment) (res value, processed string, err error) {
+	tree, processed, err := parseExpression(tokens, env)
+	if err != nil {
+		return value{}, processed, err
+	}
+
+	result, err := evalTree(tree, env)
+	if err != nil {
+		return value{}, processed, err
+	}
+
+	return result, processed, nil
+}
+
+// parseExpression applies the syntax sugar and parses the tokens.
+func parseExpression(tokens []lexerToken, env *environment) (tree *parserNode, processed string, err error) {
+	markUserFunctions(tokens, env, nil)
+
+	tokens, err = preprocessTokens(tokens)
+	if err != nil {
+		return nil, tokensToString(tokens), err
+	}
+
+	tree, err = parseTokens(tokens, env)
+	if err != nil {
+		return nil, tokensToString(tokens), err
+	}
+
+	return tree, tokensToString(tokens), nil
+}
+
+func evalTree(node *parserNode, env *environment) (value, error) {
+	switch n := node.data.(type) {
+	case nodeKindNumber:
+		if env.intType.bits != 0 {
+			res, err := env.fitInt(n.number, false)
+			if err != nil {
+				return value{}, newParseError(fmt.Sprintf("eval tree: %s", err), node.token.pos, node.token.size())
+			}
+			return res, nil
+		}
+		return n.number, nil
+
+	case nodeKindSymbol:
+		if value, exists := env.locals[node.token.text]; exists {
+			return value, nil
+		}
+		if value, exists := env.vars[node.token.text]; exists {
+			return value, nil
+		}
+		if constant, exists := lookupConstant(node.token.text); exists {
+			return constant.value(env), nil
+		}
+		if isResultReference(node.token.text) {
+			res, err := env.lookupResult(node.token.text)
+			if err != nil {
+				return value{}, newParseError(fmt.Sprintf("eval tree: %s", err), node.token.pos, node.token.size())
+			}
+			return res, nil
+		}
+		return value{}, newParseError(
+			fmt.Sprintf("eval tree: undefined variable: %q", node.token.text),
+			node.token.pos,
+			node.token.size(),
+		)
+
+	case nodeKindFunction:
+		if n.fn.exactArgs {
+			defer env.exactMode()()
+		}
+		args := make([]value, len(n.args))
+		for i, argNode := range n.args {
+			if argNode == nil {
+				panic("function with nil arg")
+			}
+			arg, err := evalTree(argNode, env)
+			if err != nil {
+				return value{}, err
+			}
+			if n.fn.integerArgs {
+				if err := checkInteger(argNode, arg); err != nil {
+					return value{}, err
+				}
+			}
+			args[i] = arg
+		}
+		res, err := applyFunction(n.fn, args, env)
+		if err == nil && env.intType.bits != 0 {
+			res, err = env.fitInt(res, false)
+		}
+		if err != nil {
+			return value{}, newParseError(
+				fmt.Sprintf("eval tree: %s", err),
+				node.token.pos,
+				node.token.size(),
+			)
+		}
+		return res, nil
+
+	case nodeKindUserCall:
+		fn, exists := env.funcs[n.name]
+		if !exists {
+			return value{}, newParseError(
+				fmt.Sprintf("eval tree: undefined function: %q", n.name),
+				node.token.pos,
+				node.token.size(),
+			)
+		}
+		return evalUserCall(fn, n.args, node, env)
+
+	case nodeKindUserOperation:
+		op, exists := env.operators[n.symbol]
+		if !exists {
+			return value{}, newParseError(
+				fmt.Sprintf("eval tree: undefined operator: %q", n.symbol),
+				node.token.pos,
+				node.token.size(),
+			)
+		}
+		return evalUserCall(op.fn, []*parserNode{n.lhs, n.rhs}, node, env)
+
+	case nodeKindOperation:
+		if n.lhs == nil || n.rhs == nil {
+			panic("operator with nil lhs and rhs")
+		}
+
+		lhs, err := evalTree(n.lhs, env)
+		if err != nil {
+			return value{}, err
+		}
+		rhs, err := evalTree(n.rhs, env)
+		if err != nil {
+			return value{}, err
+		}
+		if n.op.integers || env.intType.bits != 0 {
+			if err := checkInteger(n.lhs, lhs); err != nil {
+				return value{}, err
+			}
+			if err := checkInteger(n.rhs, rhs); err != nil {
+				return value{}, err
+			}
+		}
+		res, err := applyOperator(n.op, lhs, rhs, env)
+		if err == nil && env.intType.bits != 0 {
+			// "/" is the integer division of C
+			res, err = env.fitInt(res, n.op.symbol == opDivision.symbol)
+		}
+		if err != nil {
+			return value{}, newParseError(
+				fmt.Sprintf("eval tree: %s", err),
+				node.token.pos,
+				node.token.size(),
+			)
+		}
+		return res, nil
+
+	default:
+		panic("unexpected parser node kind")
+	}
+}
+
+func evalUserCall(fn *userFunction, argNodes []*parserNode, node *parserNode, env *environment) (value, error) {
+	if err := fn.checkArity(len(argNodes)); err != nil {
+		return value{}, newParseError(fmt.Sprintf("eval tree: %s", err), node.token.pos, node.token.size())
+	}
+	args := make([]value, len(argNodes))
+	for i, argNode := range argNodes {
+		arg, err := evalTree(argNode, env)
+		if err != nil {
+			return value{}, err
+		}
+		args[i] = arg
+	}
+	res, err := fn.call(args, env)
+	if err != nil {
+		var perr ParseError
+		if errors.As(err, &perr) {
+			return value{}, err
+		}
+		return value{}, newParseError(
+			fmt.Sprintf("eval tree: %s", err),
+			node.token.pos,
+			node.token.size(),
+		)
+	}
+	return res, nil
+}
+
+func applyOperator(op operator, lhs value, rhs value, env *environment) (value, error) {
+	if lhs.kind == valueKindComplex || rhs.kind == valueKindComplex {
+		return applyComplexOperator(op, lhs, rhs)
+	}
+
+	res, err := applyRealOperator(op, lhs, rhs, env)
+	if errors.Is(err, errNaN) && op.complexOperation != nil {
+		if res, err := applyComplexOperator(op, lhs, rhs); err == nil {
+			return res, nil
+		}
+	}
+	return res, err
+}
+
+func applyRealOperator(op operator, lhs value, rhs value, env *environment) (value, error) {
+	switch env.evalMode() {
+	case evalModePrecision:
+		if lhs.isInf() || rhs.isInf() {
+			break
+		}
+
+		if lhs.kind == valueKindInt && rhs.kind == valueKindInt {
+			res, err := op.intOperation(lhs.int, rhs.int)
+			if err != nil {
+				return value{}, err
+			}
+			if res != nil {
+				return newIntValue(res), nil
+			}
+		}
+
+		prec := env.precisionBits()
+		res, err := op.bigOperation(lhs.toBigFloat(prec), rhs.toBigFloat(prec))
+		if err != nil {
+			return value{}, err
+		}
+		return newBigFloatValue(res), nil
+
+	case evalModeRational:
+		lhsRat, lhsExact := lhs.toRat()
+		rhsRat, rhsExact := rhs.toRat()
+		if !lhsExact || !rhsExact {
+			break
+		}
+
+		res, err := op.ratOperation(lhsRat, rhsRat)
+		if err != nil {
+			return value{}, err
+		}
+		if res != nil {
+			return newRatValue(res), nil
+		}
+	}
+
+	res, err := op.operation(lhs.toFloat(), rhs.toFloat())
+	return newFloatValue(res), err
+}
+
+func applyComplexOperator(op operator, lhs value, rhs value) (value, error) {
+	if op.complexOperation == nil {
+		return value{}, fmt.Errorf("%q not defined for complex numbers", op.symbol)
+	}
+	lhsComplex, rhsComplex := lhs.toComplex(), rhs.toComplex()
+	if hasNaN(lhsComplex) || hasNaN(rhsComplex) {
+		return value{}, fmt.Errorf("%v%s%v = %w", lhs, op.symbol, rhs, errNaN)
+	}
+	res, err := op.complexOperation(lhsComplex, rhsComplex)
+	if err != nil {
+		return value{}, err
+	}
+	if hasNaN(res) {
+		return value{}, fmt.Errorf("%v%s%v = %w", lhs, op.symbol, rhs, errNaN)
+	}
+	return newComplexOrRealValue(res), nil
+}
+
+func applyFunction(fn function, args []value, env *environment) (value, error) {
+	if env.degrees {
+		fn = fn.inDegrees()
+	}
+	for _, arg := range args {
+		if arg.kind == valueKindComplex {
+			return applyComplexFunction(fn, args)
+		}
+	}
+
+	var err error
+	if fn.domain != nil {
+		err = fn.domain(args)
+	}
+	res := value{}
+	if err == nil {
+		res, err = applyRealFunction(fn, args, env)
+	}
+	if errors.Is(err, errNaN) && fn.complexFn != nil {
+		if res, err := applyComplexFunction(fn, args); err == nil {
+			return res, nil
+		}
+	}
+	return res, err
+}
+
+func applyRealFunction(fn function, args []value, env *environment) (value, error) {
+	switch env.evalMode() {
+	case evalModePrecision:
+		if fn.bigFn == nil {
+			break
+		}
+		prec := env.precisionBits()
+		bigArgs := make([]*big.Float, len(args))
+		for i, arg := range args {
+			if arg.isInf() {
+				bigArgs = nil
+				break
+			}
+			bigArgs[i] = arg.toBigFloat(prec)
+		}
+		if bigArgs == nil {
+			break
+		}
+		res, err := fn.bigFn(bigArgs)
+		if err != nil {
+			return value{}, err
+		}
+		return newBigFloatValue(res), nil
+
+	case evalModeRational:
+		if fn.ratFn == nil {
+			break
+		}
+		ratArgs := make([]*big.Rat, len(args))
+		for i, arg := range args {
+			r, exact := arg.toRat()
+			if !exact {
+				ratArgs = nil
+				break
+			}
+			ratArgs[i] = r
+		}
+		if ratArgs == nil {
+			break
+		}
+		res, err := fn.ratFn(ratArgs)
+		if err != nil {
+			return value{}, err
+		}
+		if res != nil {
+			return newRatValue(res), nil
+		}
+	}
+
+	floatArgs := make([]float64, len(args))
+	for i, arg := range args {
+		floatArgs[i] = arg.toFloat()
+	}
+	res, err := fn.fn(floatArgs)
+	return newFloatValue(res), err
+}
+
+func applyComplexFunction(fn function, args []value) (value, error) {
+	if fn.complexFn == nil {
+		return value{}, fmt.Errorf("%q not defined for complex numbers", fn.symbol)
+	}
+
+	complexArgs := make([]complex128, len(args))
+	for i, arg := range args {
+		complexArgs[i] = arg.toComplex()
+		if hasNaN(complexArgs[i]) {
+			return value{}, fmt.Errorf("%s(%s) = %w", fn.symbol, formatArgs(args), errNaN)
+		}
+	}
+	res, err := fn.complexFn(complexArgs)
+	if err != nil {
+		return value{}, err
+	}
+	if hasNaN(res) {
+		return value{}, fmt.Errorf("%s(%s) = %w", fn.symbol, formatArgs(args), errNaN)
+	}
+	return newComplexOrRealValue(res), nil
+}
+
+func formatArgs(args []value) string {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = arg.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+// hasNaN is like cmplx.IsNaN, but also true when the other part is infinite.
+func hasNaN(c complex128) bool {
+	return math.IsNaN(real(c)) || math.IsNaN(imag(c))
+}
+
+// newComplexOrRealValue drops the imaginary part if it is zero.
+func newComplexOrRealValue(c complex128) value {
+	if imag(c) == 0 {
+		return newFloatValue(real(c))
+	}
+	return newComplexValue(c)
+}
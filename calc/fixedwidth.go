@@ -0,0 +1,167 @@
+package calc
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// intType is a fixed-width integer type like the ones of C. When it is set
+// in the environment, every result is converted to it, see fitInt.
+type intType struct {
+	bits   uint // 0 if not set
+	signed bool
+	trap   bool // overflows are errors instead of wrapping around
+}
+
+var (
+	intTypeU8  = intType{bits: 8}
+	intTypeU16 = intType{bits: 16}
+	intTypeU32 = intType{bits: 32}
+	intTypeU64 = intType{bits: 64}
+	intTypeI8  = intType{bits: 8, signed: true}
+	intTypeI16 = intType{bits: 16, signed: true}
+	intTypeI32 = intType{bits: 32, signed: true}
+	intTypeI64 = intType{bits: 64, signed: true}
+)
+
+var intTypes = []intType{intTypeU8, intTypeU16, intTypeU32, intTypeU64, intTypeI8, intTypeI16, intTypeI32, intTypeI64}
+
+func lookupIntType(name string) (intType, bool) {
+	for _, t := range intTypes {
+		if t.String() == name {
+			return t, true
+		}
+	}
+	return intType{}, false
+}
+
+// String returns the name of the type, eg: "u16" or "i32".
+func (t intType) String() string {
+	if t.signed {
+		return fmt.Sprintf("i%d", t.bits)
+	}
+	return fmt.Sprintf("u%d", t.bits)
+}
+
+// wrap returns i wrapped around to the range of the type, in two's
+// complement, and if it was out of range.
+func (t intType) wrap(i *big.Int) (*big.Int, bool) {
+	modulus := new(big.Int).Lsh(big.NewInt(1), t.bits)
+	res := new(big.Int).And(i, new(big.Int).Sub(modulus, big.NewInt(1)))
+	if t.signed && res.Bit(int(t.bits)-1) == 1 {
+		res.Sub(res, modulus)
+	}
+	return res, res.Cmp(i) != 0
+}
+
+// unsigned returns the bits of i as an unsigned number, eg: -1 is 0xFF in i8.
+func (t intType) unsigned(i *big.Int) *big.Int {
+	if i.Sign() >= 0 {
+		return i
+	}
+	return new(big.Int).Add(i, new(big.Int).Lsh(big.NewInt(1), t.bits))
+}
+
+// exactMode switches from the float mode to the rational one, returning the
+// function that switches back, so the casts are exact in any mode, eg:
+// "u64(0xFFFF_FFFF_FFFF_FFFF)" would be rounded to 2**64 and wrap to 0.
+func (env *environment) exactMode() (restore func()) {
+	if env.evalMode() != evalModeFloat {
+		return func() {}
+	}
+	env.mode = evalModeRational
+	return func() { env.mode = evalModeFloat }
+}
+
+// fitInt converts v to the integer type of env, wrapping it or failing on
+// overflow depending on the type, and remembering if it was wrapped. If
+// truncate, decimals are discarded like in the integer division of C,
+// otherwise v must be an integer.
+func (env *environment) fitInt(v value, truncate bool) (value, error) {
+	if truncate {
+		v = truncateValue(v)
+	}
+	i, ok := v.toInt()
+	if !ok {
+		return value{}, fmt.Errorf("%v: %w", v, errNotInteger)
+	}
+	res, wrapped := env.intType.wrap(i)
+	if wrapped {
+		if env.intType.trap {
+			return value{}, fmt.Errorf("%v overflows %s", i, env.intType)
+		}
+		env.wrapped = true
+	}
+	return newIntValue(res), nil
+}
+
+// truncateValue discards the decimals of a real value, rounding towards 0.
+func truncateValue(v value) value {
+	switch v.kind {
+	case valueKindFloat:
+		return newFloatValue(math.Trunc(v.float))
+	case valueKindBigFloat:
+		i, _ := v.bigFloat.Int(nil)
+		return newIntValue(i)
+	case valueKindRat:
+		return newIntValue(new(big.Int).Quo(v.rat.Num(), v.rat.Denom()))
+	}
+	return v
+}
+
+// newCastFunction returns a function like "u16(x)", which converts x to the
+// type like a cast in C: the decimals are discarded and it wraps around. x is
+// evaluated exactly, since floats can't hold every 64-bit integer.
+func newCastFunction(t intType) function {
+	cast := func(i *big.Int) *big.Int {
+		res, _ := t.wrap(i)
+		return res
+	}
+	kind := "unsigned"
+	if t.signed {
+		kind = "signed"
+	}
+	article := "a"
+	if t.bits == 8 {
+		article = "an"
+	}
+	return function{
+		fn: func(args []float64) (float64, error) {
+			if math.IsInf(args[0], 0) || math.IsNaN(args[0]) {
+				return 0, fmt.Errorf("%s(%v): %w", t, args[0], errNotInteger)
+			}
+			i, _ := big.NewFloat(math.Trunc(args[0])).Int(nil)
+			f, _ := new(big.Float).SetInt(cast(i)).Float64()
+			return f, nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			if args[0].IsInf() {
+				return nil, fmt.Errorf("%s(%v): %w", t, args[0], errNotInteger)
+			}
+			i, _ := args[0].Int(nil)
+			return new(big.Float).SetPrec(args[0].Prec()).SetInt(cast(i)), nil
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			i := new(big.Int).Quo(args[0].Num(), args[0].Denom())
+			return new(big.Rat).SetInt(cast(i)), nil
+		},
+		minArgs:   1,
+		maxArgs:   1,
+		symbol:    t.String(),
+		usage:     t.String() + "(x)",
+		doc:       fmt.Sprintf("Cast to %s %d-bit %s integer", article, t.bits, kind),
+		exactArgs: true,
+	}
+}
+
+var (
+	fnU8  = newCastFunction(intTypeU8)
+	fnU16 = newCastFunction(intTypeU16)
+	fnU32 = newCastFunction(intTypeU32)
+	fnU64 = newCastFunction(intTypeU64)
+	fnI8  = newCastFunction(intTypeI8)
+	fnI16 = newCastFunction(intTypeI16)
+	fnI32 = newCastFunction(intTypeI32)
+	fnI64 = newCastFunction(intTypeI64)
+)
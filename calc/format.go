@@ -0,0 +1,333 @@
+package calc
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/cmplx"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// groupDigits separates the digits of long integers in groups of the given
+// size with "_".
+func groupDigits(str string, size int) string {
+	const maxNormalIntegerLength = 5
+
+	if len(str) <= maxNormalIntegerLength {
+		return str
+	}
+
+	s := make([]byte, 0, len(str)+len(str)/size+1)
+	for i := range str {
+		if i%size == 0 && i > 0 {
+			s = append(s, '_')
+		}
+		s = append(s, byte(str[len(str)-1-i]))
+	}
+
+	slices.Reverse(s)
+	return string(s)
+}
+
+func formatValue(res value, env *environment) string {
+	// only integers are shown in other bases
+	if env.base != 10 && res.kind != valueKindComplex && res.kind != valueKindFunction {
+		if i, ok := res.toInt(); ok {
+			// in two's complement in the fixed-width integer mode
+			if env.intType.bits != 0 {
+				i = env.intType.unsigned(i)
+			}
+			return formatIntBase(i, env.base)
+		}
+	}
+
+	switch res.kind {
+	case valueKindFloat:
+		if env.mode == evalModeRational {
+			// fallback of an irrational operation
+			return "≈" + formatFloat(res.float, env.notation)
+		}
+		return formatFloat(res.float, env.notation)
+
+	case valueKindInt:
+		return formatInt(res.int)
+
+	case valueKindBigFloat:
+		return formatBigFloat(res.bigFloat, env.precision, env.notation)
+
+	case valueKindRat:
+		if res.rat.IsInt() {
+			return formatInt(res.rat.Num())
+		}
+		str := formatRat(res.rat)
+		if env.showMixed && res.rat.Num().CmpAbs(res.rat.Denom()) > 0 {
+			str += " = " + formatMixed(res.rat)
+		}
+		if env.showDecimal {
+			f, _ := res.rat.Float64()
+			str += " ≈ " + formatFloat(f, env.notation)
+		}
+		return str
+
+	case valueKindComplex:
+		str := formatComplex(res.complex, env)
+		if env.mode == evalModeRational {
+			return "≈" + str
+		}
+		return str
+
+	case valueKindFunction:
+		return res.fn.body
+	}
+	panic("not implemented")
+}
+
+// formatComplex formats res as "a+bi", or as "r∠θ" if env.polar, with θ in
+// degrees if env.degrees.
+func formatComplex(res complex128, env *environment) string {
+	if env.polar {
+		r, theta := cmplx.Polar(res)
+		if env.degrees {
+			return formatComplexPart(r, env.notation) + "∠" + formatComplexPart(theta*180/math.Pi, env.notation) + "°"
+		}
+		return formatComplexPart(r, env.notation) + "∠" + formatComplexPart(theta, env.notation)
+	}
+
+	// parts negligible compared to the other are omitted, mostly rounding
+	// errors (eg: 2v-4 = 1.2e-16+2i)
+	const negligible = 1e-12
+	abs := cmplx.Abs(res)
+	realStr := ""
+	if math.Abs(real(res)) > abs*negligible {
+		realStr = formatComplexPart(real(res), env.notation)
+	}
+	if math.Abs(imag(res)) <= abs*negligible {
+		if realStr == "" {
+			return "0"
+		}
+		return realStr
+	}
+	imagStr := formatComplexPart(math.Abs(imag(res)), env.notation)
+	if imagStr == "1" {
+		imagStr = ""
+	}
+	imagStr += "i"
+
+	switch {
+	case imag(res) < 0:
+		return realStr + "-" + imagStr
+	case realStr == "":
+		return imagStr
+	default:
+		return realStr + "+" + imagStr
+	}
+}
+
+func formatInt(res *big.Int) string {
+	str := groupDigits(new(big.Int).Abs(res).String(), 3)
+	if res.Sign() < 0 {
+		str = "-" + str
+	}
+	return str
+}
+
+// formatIntBase formats res in base 2, 8 or 16 with its prefix, eg: "0x1F",
+// the binary and hex digits grouped by 4.
+func formatIntBase(res *big.Int, base int) string {
+	prefix, size := "", 4
+	switch base {
+	case 2:
+		prefix = "0b"
+	case 8:
+		prefix, size = "0o", 3
+	case 16:
+		prefix = "0x"
+	default:
+		panic(fmt.Errorf("unexpected base: %d", base))
+	}
+	str := prefix + groupDigits(strings.ToUpper(new(big.Int).Abs(res).Text(base)), size)
+	if res.Sign() < 0 {
+		str = "-" + str
+	}
+	return str
+}
+
+func formatRat(res *big.Rat) string {
+	return formatInt(res.Num()) + "/" + formatInt(res.Denom())
+}
+
+// formatMixed formats res as an integer followed by a proper fraction (eg: 7/2 = 3 1/2).
+func formatMixed(res *big.Rat) string {
+	integerPart, rem := new(big.Int).QuoRem(res.Num(), res.Denom(), new(big.Int))
+	str := formatInt(integerPart)
+	if rem.Sign() != 0 {
+		str += " " + formatRat(new(big.Rat).SetFrac(rem.Abs(rem), res.Denom()))
+	}
+	return str
+}
+
+// notation tells how to format the floats too large or too small to be shown
+// with decimals.
+type notation struct {
+	engineering bool    // exponents multiple of 3, instead of scientific notation
+	min, max    float64 // magnitudes shown with decimals, from min to below max
+}
+
+var defaultNotation = notation{min: 1e-6, max: 1e15}
+
+// formatFloat formats res truncated to 6 decimals, or in the notation of n if
+// its magnitude is out of its limits.
+func formatFloat(res float64, n notation) string {
+	return formatFloatDecimals(res, n, true)
+}
+
+// formatComplexPart formats a part of a complex number like formatFloat, but
+// without the ".0" of decimals truncated away, since a complex number isn't
+// taken for an integer, eg: "2i" instead of "2.0i".
+func formatComplexPart(res float64, n notation) string {
+	return formatFloatDecimals(res, n, false)
+}
+
+func formatFloatDecimals(res float64, n notation, marker bool) string {
+	switch {
+	case math.IsNaN(res):
+		return "NaN"
+	case math.IsInf(res, 1):
+		return "∞"
+	case math.IsInf(res, -1):
+		return "-∞"
+	}
+
+	abs := math.Abs(res)
+	if abs != 0 && (abs < n.min || abs >= n.max) {
+		return formatExponent(res, n.engineering)
+	}
+
+	integerPart, decimalPart, _ := strings.Cut(strconv.FormatFloat(abs, 'f', -1, 64), ".")
+	decimalPart = strings.TrimRight(decimalPart[:min(len(decimalPart), 6)], "0")
+	// so it is not taken for an integer
+	if marker && decimalPart == "" && abs != math.Trunc(abs) {
+		decimalPart = "0"
+	}
+
+	str := groupDigits(integerPart, 3)
+	if decimalPart != "" {
+		str += "." + decimalPart
+	}
+	if res < 0 {
+		str = "-" + str
+	}
+	return str
+}
+
+// formatExponent formats res truncated to 7 significant digits with an
+// exponent, eg: "6.022e23" or "1.5e-9", which is a multiple of 3 if
+// engineering.
+func formatExponent(res float64, engineering bool) string {
+	mantissa, exponent, _ := strings.Cut(strconv.FormatFloat(math.Abs(res), 'e', -1, 64), "e")
+	exp, _ := strconv.Atoi(exponent)
+	digits := strings.Replace(mantissa, ".", "", 1)
+	digits = (digits + "000000")[:7]
+
+	integerDigits := 1
+	if engineering {
+		shift := (exp%3 + 3) % 3
+		exp -= shift
+		integerDigits += shift
+	}
+
+	str := digits[:integerDigits]
+	if decimals := strings.TrimRight(digits[integerDigits:], "0"); decimals != "" {
+		str += "." + decimals
+	}
+	str += "e" + strconv.Itoa(exp)
+	if res < 0 {
+		str = "-" + str
+	}
+	return str
+}
+
+// formatBigFloat formats res with the given number of significant digits, or
+// in the notation of n if its magnitude is out of its limits or its integer
+// part is longer than the digits.
+func formatBigFloat(res *big.Float, digits int, n notation) string {
+	if res.IsInf() {
+		return formatFloat(math.Inf(res.Sign()), n)
+	}
+	abs := new(big.Float).Abs(res)
+
+	decimals := digits
+	if abs.Sign() != 0 {
+		exp10 := bigExponent10(abs)
+		// the integer digits beyond the precision would be made up
+		if exp10 >= digits || abs.Cmp(big.NewFloat(n.min)) < 0 || abs.Cmp(big.NewFloat(n.max)) >= 0 {
+			return formatBigExponent(res, digits, n.engineering)
+		}
+		decimals = max(0, digits-exp10-1)
+	}
+
+	integerPart, decimalPart, _ := strings.Cut(abs.Text('f', decimals), ".")
+	decimalPart = strings.TrimRight(decimalPart, "0")
+
+	str := groupDigits(integerPart, 3)
+	if len(decimalPart) > 0 {
+		str += "." + decimalPart
+	}
+	if res.Sign() < 0 && str != "0" {
+		str = "-" + str
+	}
+	return str
+}
+
+// bigExponent10 returns the exponent of abs in scientific notation, so
+// abs = mant * 10**exp10, with 1 <= mant < 10, maybe off by one.
+func bigExponent10(abs *big.Float) int {
+	mant := new(big.Float)
+	exp2 := abs.MantExp(mant)
+	mantFloat, _ := mant.Float64()
+	return int(math.Floor(math.Log10(mantFloat) + float64(exp2)*math.Log10(2)))
+}
+
+// formatBigExponent formats res rounded to the given number of significant
+// digits with an exponent, eg: "1.4142135623730950488e40", which is a
+// multiple of 3 if engineering.
+func formatBigExponent(res *big.Float, digits int, engineering bool) string {
+	// Text computes the exact decimal value, which takes seconds with huge
+	// exponents like 1e-100000, so it is scaled close to 1 first
+	abs := new(big.Float).Abs(res)
+	scale := 0
+	if abs.Sign() != 0 {
+		scale = bigExponent10(abs)
+		prec := abs.Prec() + bigGuardBits
+		pow, err := bigPowInt(new(big.Float).SetPrec(prec).SetInt64(10), int64(-scale))
+		if err == nil {
+			abs.SetPrec(prec).Mul(abs, pow)
+		} else {
+			scale = 0
+		}
+	}
+	mantissa, exponent, _ := strings.Cut(abs.Text('e', digits-1), "e")
+	exp, _ := strconv.Atoi(exponent)
+	exp += scale
+	mantDigits := strings.Replace(mantissa, ".", "", 1)
+
+	integerDigits := 1
+	if engineering {
+		shift := (exp%3 + 3) % 3
+		exp -= shift
+		integerDigits += shift
+	}
+	mantDigits += strings.Repeat("0", max(0, integerDigits-len(mantDigits)))
+
+	str := mantDigits[:integerDigits]
+	if decimals := strings.TrimRight(mantDigits[integerDigits:], "0"); decimals != "" {
+		str += "." + decimals
+	}
+	str += "e" + strconv.Itoa(exp)
+	if res.Sign() < 0 {
+		str = "-" + str
+	}
+	return str
+}
@@ -1,7 +1,9 @@
-package main
+package calc
 
 import (
 	"fmt"
+	"strings"
+	"unicode/utf8"
 )
 
 type lexerToken struct {
@@ -35,6 +37,7 @@ const (
 	tokenKindNumber
 	tokenKindOperator
 	tokenKindFunction
+	tokenKindComma
 )
 
 func (t tokenKind) String() string {
@@ -59,6 +62,8 @@ func (t tokenKind) String() string {
 		return "kindOperator"
 	case tokenKindFunction:
 		return "kindFunction"
+	case tokenKindComma:
+		return "kindComma"
 	}
 	panic("not implemented")
 }
@@ -67,12 +72,14 @@ type lexer struct {
 	tokens []lexerToken
 	input  []byte
 	idx    int
+	env    *environment // to know the functions and operators
 }
 
-func newLexer(input []byte) lexer {
+func newLexer(input []byte, env *environment) lexer {
 	return lexer{
 		input:  input,
 		tokens: make([]lexerToken, 0, len(input)),
+		env:    env,
 	}
 }
 
@@ -115,9 +122,29 @@ func isAlphanumeric(char byte) bool {
 	return ('a' <= char && char <= 'z') || ('A' <= char && char <= 'Z') || '0' <= char && char <= '9'
 }
 
+// isBasePrefix tells if the number at the current position starts with "0x",
+// "0b" or "0o", followed by some digit.
+func (l *lexer) isBasePrefix() bool {
+	if l.idx+2 >= len(l.input) || l.input[l.idx] != '0' {
+		return false
+	}
+	return strings.IndexByte("xXbBoO", l.input[l.idx+1]) != -1 && isAlphanumeric(l.input[l.idx+2])
+}
+
 func (l *lexer) lexNumber() {
 	s := l.idx
 
+	// the digits are checked by parseNumber, so "0b12" is an invalid number
+	// instead of two numbers
+	if l.isBasePrefix() {
+		l.idx += 2
+		for l.hasNext() && (isAlphanumeric(l.peek()) || l.peek() == '_') {
+			l.consume()
+		}
+		l.addToken(tokenKindNumber, s, string(l.input[s:l.idx]))
+		return
+	}
+
 	if l.peek() == '.' {
 		l.consume()
 		for l.hasNext() && isNumber(l.peek()) {
@@ -135,6 +162,35 @@ func (l *lexer) lexNumber() {
 		}
 	}
 
+	// exponent, eg: "6.022e23" or "1e-9"
+	if l.hasNext() && (l.peek() == 'e' || l.peek() == 'E') {
+		sign := 0
+		if l.idx+1 < len(l.input) && (l.input[l.idx+1] == '+' || l.input[l.idx+1] == '-') {
+			sign = 1
+		}
+		if l.idx+1+sign < len(l.input) && isNumber(l.input[l.idx+1+sign]) {
+			l.idx += 1 + sign
+			for l.hasNext() && isNumber(l.peek()) {
+				l.consume()
+			}
+		}
+	}
+
+	// SI or binary prefix, eg: "4k" or "3Gi"
+	if suffix := l.lexNumberSuffix(); suffix != "" {
+		l.idx += len(suffix)
+		l.addToken(tokenKindNumber, s, string(l.input[s:l.idx]))
+		return
+	}
+
+	// imaginary unit
+	if l.hasNext() && l.peek() == 'i' {
+		l.consume()
+		if l.hasNext() && (isAlphanumeric(l.peek()) || l.peek() == '_') {
+			l.backup()
+		}
+	}
+
 	l.addToken(tokenKindNumber, s, string(l.input[s:l.idx]))
 }
 
@@ -150,6 +206,27 @@ func (l *lexer) lexAlphanumeric() {
 		break
 	}
 
+	// the whole identifier is matched, so "sinh" is not "sin" followed by "h"
+	text := string(l.input[s:l.idx])
+	if _, exists := l.env.functions.lookup(text); exists {
+		l.addToken(tokenKindFunction, s, text)
+		return
+	}
+	l.addToken(tokenKindSymbol, s, text)
+}
+
+// atResultReference tells if there is a "$n" result reference at the current
+// position.
+func (l *lexer) atResultReference() bool {
+	return l.idx+1 < len(l.input) && isNumber(l.input[l.idx+1])
+}
+
+func (l *lexer) lexResultReference() {
+	s := l.idx
+	l.consume() // the "$"
+	for l.hasNext() && isNumber(l.peek()) {
+		l.consume()
+	}
 	l.addToken(tokenKindSymbol, s, string(l.input[s:l.idx]))
 }
 
@@ -161,20 +238,29 @@ func (l *lexer) lexSpace() {
 	l.addToken(tokenKindSpace, s, " ")
 }
 
-func (l *lexer) lexFunction(name string) (found bool) {
-	consumed := 0
-	for l.hasNext() && consumed < len(name) && l.peek() == name[consumed] {
-		l.consume()
-		consumed++
+// lexOperator adds the longest operator symbol found at the current position.
+func (l *lexer) lexOperator() (found bool) {
+	input := string(l.input[l.idx:])
+	symbol := ""
+	for _, op := range builtinOperators {
+		if len(op.symbol) > len(symbol) && strings.HasPrefix(input, op.symbol) {
+			symbol = op.symbol
+		}
+	}
+	if symbol == "" && strings.HasPrefix(input, fnBitwiseNot.symbol) {
+		symbol = fnBitwiseNot.symbol
 	}
-	if consumed == len(name) && (!l.hasNext() || !isAlphanumeric(l.peek())) {
-		l.addToken(tokenKindFunction, l.idx-len(name), name)
-		return true
+	for opSymbol := range l.env.operators {
+		if len(opSymbol) > len(symbol) && strings.HasPrefix(input, opSymbol) {
+			symbol = opSymbol
+		}
 	}
-	for range consumed {
-		l.backup()
+	if symbol == "" {
+		return false
 	}
-	return false
+	l.addToken(tokenKindOperator, l.idx, symbol)
+	l.idx += len(symbol)
+	return true
 }
 
 func (l *lexer) addToken(kind tokenKind, pos int, text string) {
@@ -182,11 +268,15 @@ func (l *lexer) addToken(kind tokenKind, pos int, text string) {
 }
 
 func (l *lexer) addTokenConsume(kind tokenKind) {
-	l.tokens = append(l.tokens, newLexerToken(kind, l.idx, string(l.consume())))
+	pos := l.idx
+	l.addToken(kind, pos, string(l.consume()))
 }
 
-func (l *lexer) newError(msg string) parsingError {
-	return newParsingError(fmt.Sprintf("lexer: char %d: %s", l.idx, msg), l.idx, 1)
+// newError marks the char at the current index, all its bytes if it is a
+// multi-byte one like "µ".
+func (l *lexer) newError(msg string) ParseError {
+	_, size := utf8.DecodeRune(l.input[l.idx:])
+	return newParseError(fmt.Sprintf("lexer: char %d: %s", l.idx, msg), l.idx, max(1, size))
 }
 
 func (l *lexer) tokenize() ([]lexerToken, error) {
@@ -198,77 +288,43 @@ func (l *lexer) tokenize() ([]lexerToken, error) {
 			continue
 		}
 
-		switch ch {
-		case 'v':
+		// "v" alone is the root operator
+		if ch == 'v' {
 			l.consume()
 			if !l.hasNext() || !isAlpha(l.peek()) {
 				l.addToken(tokenKindOperator, l.idx-1, "v")
 				continue
 			}
 			l.backup()
-			l.lexAlphanumeric()
-		case 's':
-			if l.lexFunction("sin") {
-				continue
-			}
-		case 'c':
-			if l.lexFunction("cos") {
-				continue
-			}
-		case 't':
-			if l.lexFunction("tan") {
-				continue
-			}
-		case 'a':
-			if l.lexFunction("asin") {
-				continue
-			}
-			if l.lexFunction("acos") {
-				continue
-			}
-			if l.lexFunction("atan") {
-				continue
-			}
 		}
 
-		if ch != 'v' && isAlpha(ch) {
+		if isAlpha(ch) || ch == '_' {
 			l.lexAlphanumeric()
 			continue
 		}
 
+		if ch == '$' && l.atResultReference() {
+			l.lexResultReference()
+			continue
+		}
+
+		if strings.IndexByte(operatorChars, ch) != -1 && l.lexOperator() {
+			continue
+		}
+
 		switch ch {
 		case ' ':
 			l.lexSpace()
 		case ';':
 			l.addTokenConsume(tokenKindSemicolon)
+		case ',':
+			l.addTokenConsume(tokenKindComma)
 		case '=':
 			l.addTokenConsume(tokenKindEqual)
 		case '(':
 			l.addTokenConsume(tokenKindBracketOpen)
 		case ')':
 			l.addTokenConsume(tokenKindBracketClose)
-		case '+':
-			l.addTokenConsume(tokenKindOperator)
-		case '-':
-			l.addTokenConsume(tokenKindOperator)
-		case '*':
-			l.consume()
-			if l.hasNext() && l.peek() == '*' {
-				l.consume()
-				l.addToken(tokenKindOperator, l.idx-2, "**")
-			} else {
-				l.addToken(tokenKindOperator, l.idx-1, "*")
-			}
-		case '/':
-			l.consume()
-			if l.hasNext() && l.peek() == '/' {
-				l.consume()
-				l.addToken(tokenKindOperator, l.idx-2, "//")
-			} else {
-				l.addToken(tokenKindOperator, l.idx-1, "/")
-			}
-		case '%':
-			l.addTokenConsume(tokenKindOperator)
 		default:
 			return nil, l.newError("unexpected character")
 		}
@@ -277,8 +333,8 @@ func (l *lexer) tokenize() ([]lexerToken, error) {
 	return l.tokens, nil
 }
 
-func lexStatement(input []byte) ([]lexerToken, error) {
-	lexer := newLexer(input)
+func lexStatement(input []byte, env *environment) ([]lexerToken, error) {
+	lexer := newLexer(input, env)
 	tokens, err := lexer.tokenize()
 	if err != nil {
 		return nil, err
@@ -0,0 +1,1484 @@
+package calc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"math/cmplx"
+	"strconv"
+	"strings"
+)
+
+type operator struct {
+	operation func(float64, float64) (float64, error)
+	// intOperation is used in precision mode when both operands are integers,
+	// it returns nil without error when the result is not an integer, in which
+	// case bigOperation is used instead.
+	intOperation func(*big.Int, *big.Int) (*big.Int, error)
+	bigOperation func(*big.Float, *big.Float) (*big.Float, error)
+	// ratOperation is used in rational mode, it returns nil without error when
+	// the result is irrational, in which case operation is used instead.
+	ratOperation func(*big.Rat, *big.Rat) (*big.Rat, error)
+	// complexOperation is used when some operand is complex, or when the
+	// real operation results in NaN. It is nil if not defined for complex numbers.
+	complexOperation func(complex128, complex128) (complex128, error)
+	integers         bool // the operands must be integers, see checkInteger
+	precedence       int
+	associativity    associativity
+	symbol           string
+}
+
+type associativity byte
+
+const (
+	associativityLeft associativity = iota
+	associativityRight
+)
+
+func (a associativity) String() string {
+	switch a {
+	case associativityLeft:
+		return "left"
+	case associativityRight:
+		return "right"
+	}
+	panic("not implemented")
+}
+
+func (o operator) String() string {
+	if len(o.symbol) == 0 {
+		panic(fmt.Errorf("symbol not assigned to operator: %#v", o))
+	}
+	return o.symbol
+}
+
+var (
+	errNaN            = errors.New("NaN")
+	errDivisionByZero = errors.New("division by 0")
+)
+
+// Results of integer powers bigger than this are calculated with floats.
+const maxIntPowerBits = 1 << 20
+
+var (
+	opAddition = operator{
+		operation: func(lhs float64, rhs float64) (float64, error) { return lhs + rhs, nil },
+		intOperation: func(lhs *big.Int, rhs *big.Int) (*big.Int, error) {
+			return new(big.Int).Add(lhs, rhs), nil
+		},
+		bigOperation: func(lhs *big.Float, rhs *big.Float) (*big.Float, error) {
+			return new(big.Float).Add(lhs, rhs), nil
+		},
+		ratOperation: func(lhs *big.Rat, rhs *big.Rat) (*big.Rat, error) {
+			return new(big.Rat).Add(lhs, rhs), nil
+		},
+		complexOperation: func(lhs complex128, rhs complex128) (complex128, error) {
+			return lhs + rhs, nil
+		},
+		precedence: 1,
+		symbol:     "+",
+	}
+	opSubtraction = operator{
+		operation: func(lhs float64, rhs float64) (float64, error) { return lhs - rhs, nil },
+		intOperation: func(lhs *big.Int, rhs *big.Int) (*big.Int, error) {
+			return new(big.Int).Sub(lhs, rhs), nil
+		},
+		bigOperation: func(lhs *big.Float, rhs *big.Float) (*big.Float, error) {
+			return new(big.Float).Sub(lhs, rhs), nil
+		},
+		ratOperation: func(lhs *big.Rat, rhs *big.Rat) (*big.Rat, error) {
+			return new(big.Rat).Sub(lhs, rhs), nil
+		},
+		complexOperation: func(lhs complex128, rhs complex128) (complex128, error) {
+			return lhs - rhs, nil
+		},
+		precedence: 1,
+		symbol:     "-",
+	}
+	opMultiplication = operator{
+		operation: func(lhs float64, rhs float64) (float64, error) { return lhs * rhs, nil },
+		intOperation: func(lhs *big.Int, rhs *big.Int) (*big.Int, error) {
+			return new(big.Int).Mul(lhs, rhs), nil
+		},
+		bigOperation: func(lhs *big.Float, rhs *big.Float) (*big.Float, error) {
+			return new(big.Float).Mul(lhs, rhs), nil
+		},
+		ratOperation: func(lhs *big.Rat, rhs *big.Rat) (*big.Rat, error) {
+			return new(big.Rat).Mul(lhs, rhs), nil
+		},
+		complexOperation: func(lhs complex128, rhs complex128) (complex128, error) {
+			return lhs * rhs, nil
+		},
+		precedence: 2,
+		symbol:     "*",
+	}
+	opModulo = operator{
+		operation: func(lhs float64, rhs float64) (float64, error) {
+			if rhs == 0 {
+				return 0, errDivisionByZero
+			}
+			return math.Mod(lhs, rhs), nil
+		},
+		intOperation: func(lhs *big.Int, rhs *big.Int) (*big.Int, error) {
+			if rhs.Sign() == 0 {
+				return nil, errDivisionByZero
+			}
+			return new(big.Int).Rem(lhs, rhs), nil
+		},
+		bigOperation: func(lhs *big.Float, rhs *big.Float) (*big.Float, error) {
+			if rhs.Sign() == 0 {
+				return nil, errDivisionByZero
+			}
+			// same sign as lhs, like math.Mod
+			quo := new(big.Float).Quo(lhs, rhs)
+			i, _ := quo.Int(nil)
+			quo.SetInt(i)
+			return quo.Sub(lhs, quo.Mul(quo, rhs)), nil
+		},
+		ratOperation: func(lhs *big.Rat, rhs *big.Rat) (*big.Rat, error) {
+			if rhs.Sign() == 0 {
+				return nil, errDivisionByZero
+			}
+			// same sign as lhs, like math.Mod
+			quo := new(big.Rat).Quo(lhs, rhs)
+			quo.SetInt(new(big.Int).Quo(quo.Num(), quo.Denom()))
+			return quo.Sub(lhs, quo.Mul(quo, rhs)), nil
+		},
+		precedence: 2,
+		symbol:     "%",
+	}
+	opDivision = operator{
+		operation: func(lhs float64, rhs float64) (float64, error) {
+			if rhs == 0 {
+				return 0, errDivisionByZero
+			}
+			return lhs / rhs, nil
+		},
+		intOperation: func(lhs *big.Int, rhs *big.Int) (*big.Int, error) {
+			if rhs.Sign() == 0 {
+				return nil, errDivisionByZero
+			}
+			quo, rem := new(big.Int).QuoRem(lhs, rhs, new(big.Int))
+			if rem.Sign() != 0 {
+				return nil, nil
+			}
+			return quo, nil
+		},
+		bigOperation: func(lhs *big.Float, rhs *big.Float) (*big.Float, error) {
+			if rhs.Sign() == 0 {
+				return nil, errDivisionByZero
+			}
+			return new(big.Float).Quo(lhs, rhs), nil
+		},
+		ratOperation: func(lhs *big.Rat, rhs *big.Rat) (*big.Rat, error) {
+			if rhs.Sign() == 0 {
+				return nil, errDivisionByZero
+			}
+			return new(big.Rat).Quo(lhs, rhs), nil
+		},
+		complexOperation: func(lhs complex128, rhs complex128) (complex128, error) {
+			if rhs == 0 {
+				return 0, errDivisionByZero
+			}
+			return lhs / rhs, nil
+		},
+		precedence: 2,
+		symbol:     "/",
+	}
+	opFloorDivision = operator{
+		operation: func(lhs float64, rhs float64) (float64, error) {
+			if rhs == 0 {
+				return 0, errDivisionByZero
+			}
+			return math.Floor(lhs / rhs), nil
+		},
+		intOperation: func(lhs *big.Int, rhs *big.Int) (*big.Int, error) {
+			if rhs.Sign() == 0 {
+				return nil, errDivisionByZero
+			}
+			quo, rem := new(big.Int).QuoRem(lhs, rhs, new(big.Int))
+			if rem.Sign() != 0 && rem.Sign() != rhs.Sign() {
+				quo.Sub(quo, big.NewInt(1))
+			}
+			return quo, nil
+		},
+		bigOperation: func(lhs *big.Float, rhs *big.Float) (*big.Float, error) {
+			if rhs.Sign() == 0 {
+				return nil, errDivisionByZero
+			}
+			return bigFloor(new(big.Float).Quo(lhs, rhs)), nil
+		},
+		ratOperation: func(lhs *big.Rat, rhs *big.Rat) (*big.Rat, error) {
+			if rhs.Sign() == 0 {
+				return nil, errDivisionByZero
+			}
+			// the denominator is always positive, so the euclidean division is the floor division
+			quo := new(big.Rat).Quo(lhs, rhs)
+			return quo.SetInt(new(big.Int).Div(quo.Num(), quo.Denom())), nil
+		},
+		precedence: 2,
+		symbol:     "//",
+	}
+	opRoot = operator{
+		operation: func(lhs float64, rhs float64) (float64, error) {
+			res := math.Pow(rhs, 1/lhs)
+			if math.IsNaN(res) {
+				return 0, fmt.Errorf("%vv%v = %w", lhs, rhs, errNaN)
+			}
+			return res, nil
+		},
+		intOperation: func(lhs *big.Int, rhs *big.Int) (*big.Int, error) {
+			if lhs.Sign() <= 0 || rhs.Sign() < 0 || !lhs.IsInt64() {
+				return nil, nil
+			}
+			return intRoot(lhs.Int64(), rhs), nil
+		},
+		bigOperation: func(lhs *big.Float, rhs *big.Float) (*big.Float, error) {
+			if lhs.Sign() == 0 {
+				return nil, fmt.Errorf("%vv%v = %w", lhs, rhs, errNaN)
+			}
+			exp := new(big.Float).SetPrec(lhs.Prec()).SetInt64(1)
+			res, err := bigPow(rhs, exp.Quo(exp, lhs))
+			if errors.Is(err, errNaN) {
+				return nil, fmt.Errorf("%vv%v = %w", lhs, rhs, errNaN)
+			}
+			return res, err
+		},
+		ratOperation: func(lhs *big.Rat, rhs *big.Rat) (*big.Rat, error) {
+			if !lhs.IsInt() || lhs.Sign() <= 0 || rhs.Sign() < 0 || !lhs.Num().IsInt64() {
+				return nil, nil
+			}
+			num := intRoot(lhs.Num().Int64(), rhs.Num())
+			den := intRoot(lhs.Num().Int64(), rhs.Denom())
+			if num == nil || den == nil {
+				return nil, nil
+			}
+			return new(big.Rat).SetFrac(num, den), nil
+		},
+		complexOperation: func(lhs complex128, rhs complex128) (complex128, error) {
+			if lhs == 0 {
+				return 0, fmt.Errorf("%vv%v = %w", lhs, rhs, errNaN)
+			}
+			return cmplx.Pow(rhs, 1/lhs), nil
+		},
+		precedence:    3,
+		associativity: associativityRight,
+		symbol:        "v",
+	}
+	opPower = operator{
+		operation: func(lhs float64, rhs float64) (float64, error) {
+			res := math.Pow(lhs, rhs)
+			if math.IsNaN(res) {
+				return 0, fmt.Errorf("%v**%v = %w", lhs, rhs, errNaN)
+			}
+			return res, nil
+		},
+		intOperation: func(lhs *big.Int, rhs *big.Int) (*big.Int, error) {
+			if rhs.Sign() < 0 || !rhs.IsInt64() || int64(lhs.BitLen())*rhs.Int64() > maxIntPowerBits {
+				return nil, nil
+			}
+			return new(big.Int).Exp(lhs, rhs, nil), nil
+		},
+		bigOperation: func(lhs *big.Float, rhs *big.Float) (*big.Float, error) {
+			res, err := bigPow(lhs, rhs)
+			if errors.Is(err, errNaN) {
+				return nil, fmt.Errorf("%v**%v = %w", lhs, rhs, errNaN)
+			}
+			return res, err
+		},
+		ratOperation: func(lhs *big.Rat, rhs *big.Rat) (*big.Rat, error) {
+			if !rhs.IsInt() || !rhs.Num().IsInt64() {
+				return nil, nil
+			}
+			exp := rhs.Num().Int64()
+			if exp < 0 {
+				if lhs.Sign() == 0 {
+					return nil, errDivisionByZero
+				}
+				exp = -exp
+				lhs = new(big.Rat).Inv(lhs)
+			}
+			if int64(lhs.Num().BitLen()+lhs.Denom().BitLen())*exp > maxIntPowerBits {
+				return nil, nil
+			}
+			bigExp := big.NewInt(exp)
+			num := new(big.Int).Exp(lhs.Num(), bigExp, nil)
+			den := new(big.Int).Exp(lhs.Denom(), bigExp, nil)
+			return new(big.Rat).SetFrac(num, den), nil
+		},
+		complexOperation: func(lhs complex128, rhs complex128) (complex128, error) {
+			if lhs == 0 && real(rhs) < 0 {
+				return 0, errDivisionByZero
+			}
+			return cmplx.Pow(lhs, rhs), nil
+		},
+		precedence:    3,
+		associativity: associativityRight,
+		symbol:        "**",
+	}
+)
+
+// intRoot returns the n-th root of x, or nil if it is not an integer.
+func intRoot(n int64, x *big.Int) *big.Int {
+	if x.Sign() == 0 || n == 1 {
+		return new(big.Int).Set(x)
+	}
+	if n > int64(x.BitLen()) {
+		if x.Cmp(big.NewInt(1)) == 0 {
+			return big.NewInt(1)
+		}
+		return nil
+	}
+
+	// newton's method starting above the root
+	bigN := big.NewInt(n)
+	bigN1 := big.NewInt(n - 1)
+	r := new(big.Int).Lsh(big.NewInt(1), uint((int64(x.BitLen())+n-1)/n))
+	t := new(big.Int)
+	for {
+		// next = ((n-1)*r + x/r**(n-1)) / n
+		t.Exp(r, bigN1, nil)
+		t.Quo(x, t)
+		t.Add(t, new(big.Int).Mul(bigN1, r))
+		t.Quo(t, bigN)
+		if t.Cmp(r) >= 0 {
+			break
+		}
+		r.Set(t)
+	}
+
+	if t.Exp(r, bigN, nil).Cmp(x) != 0 {
+		return nil
+	}
+	return r
+}
+
+const functionPrecedence = 100
+
+type function struct {
+	fn    func(args []float64) (float64, error)
+	bigFn func(args []*big.Float) (*big.Float, error)
+	// ratFn is optional, it returns nil without error when the result is
+	// irrational, in which case fn is used instead.
+	ratFn func(args []*big.Rat) (*big.Rat, error)
+	// complexFn is nil if not defined for complex numbers.
+	complexFn func(args []complex128) (complex128, error)
+	// domain is optional, it rejects real arguments before any of the above
+	// is called. Errors wrapping errNaN make the complex version be tried.
+	domain  func(args []value) error
+	minArgs int
+	maxArgs int // -1 if variadic
+	symbol  string
+	usage   string // eg: "log(x[, base])"
+	doc     string
+
+	// the arguments or the result are angles, in degrees in the degree mode
+	angleArgs   bool
+	angleResult bool
+
+	integerArgs bool // see checkInteger
+	exactArgs   bool // evaluated exactly in the float mode, see exactMode
+}
+
+func (f function) checkArity(count int) error {
+	switch {
+	case f.minArgs == f.maxArgs && count != f.minArgs:
+		return fmt.Errorf("%s: expected %s, got %d", f.symbol, countArguments(f.minArgs), count)
+	case count < f.minArgs:
+		return fmt.Errorf("%s: expected at least %s, got %d", f.symbol, countArguments(f.minArgs), count)
+	case f.maxArgs != -1 && count > f.maxArgs:
+		return fmt.Errorf("%s: expected at most %s, got %d", f.symbol, countArguments(f.maxArgs), count)
+	}
+	return nil
+}
+
+// countArguments returns "1 argument" or "n arguments".
+func countArguments(n int) string {
+	if n == 1 {
+		return "1 argument"
+	}
+	return fmt.Sprintf("%d arguments", n)
+}
+
+var (
+	fnSin function = function{
+		fn: func(args []float64) (float64, error) {
+			x := args[0]
+			res := math.Sin(x)
+			if math.IsNaN(res) {
+				return 0, fmt.Errorf("sin(%v) = %w", x, errNaN)
+			}
+			return res, nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			sin, _, err := bigSinCos(args[0])
+			return sin, err
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			// only sin(0) is rational
+			if args[0].Sign() != 0 {
+				return nil, nil
+			}
+			return new(big.Rat), nil
+		},
+		complexFn: func(args []complex128) (complex128, error) {
+			return cmplx.Sin(args[0]), nil
+		},
+		minArgs:   1,
+		maxArgs:   1,
+		symbol:    "sin",
+		usage:     "sin(x)",
+		doc:       "Sine",
+		angleArgs: true,
+	}
+	fnCos function = function{
+		fn: func(args []float64) (float64, error) {
+			x := args[0]
+			res := math.Cos(x)
+			if math.IsNaN(res) {
+				return 0, fmt.Errorf("cos(%v) = %w", x, errNaN)
+			}
+			return res, nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			_, cos, err := bigSinCos(args[0])
+			return cos, err
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			// only cos(0) is rational
+			if args[0].Sign() != 0 {
+				return nil, nil
+			}
+			return big.NewRat(1, 1), nil
+		},
+		complexFn: func(args []complex128) (complex128, error) {
+			return cmplx.Cos(args[0]), nil
+		},
+		minArgs:   1,
+		maxArgs:   1,
+		symbol:    "cos",
+		usage:     "cos(x)",
+		doc:       "Cosine",
+		angleArgs: true,
+	}
+	fnTan function = function{
+		fn: func(args []float64) (float64, error) {
+			x := args[0]
+			res := math.Tan(x)
+			if math.IsNaN(res) {
+				return 0, fmt.Errorf("tan(%v) = %w", x, errNaN)
+			}
+			return res, nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			sin, cos, err := bigSinCos(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return sin.Quo(sin, cos), nil
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			// only tan(0) is rational
+			if args[0].Sign() != 0 {
+				return nil, nil
+			}
+			return new(big.Rat), nil
+		},
+		complexFn: func(args []complex128) (complex128, error) {
+			return cmplx.Tan(args[0]), nil
+		},
+		minArgs:   1,
+		maxArgs:   1,
+		symbol:    "tan",
+		usage:     "tan(x)",
+		doc:       "Tangent",
+		angleArgs: true,
+	}
+	fnAsin function = function{
+		fn: func(args []float64) (float64, error) {
+			x := args[0]
+			res := math.Asin(x)
+			if math.IsNaN(res) {
+				return 0, fmt.Errorf("asin(%v) = %w", x, errNaN)
+			}
+			return res, nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			x := args[0]
+			res, err := bigAsin(x)
+			if err != nil {
+				return nil, fmt.Errorf("asin(%v) = %w", x, errNaN)
+			}
+			return res, nil
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			// only asin(0) is rational
+			if args[0].Sign() != 0 {
+				return nil, nil
+			}
+			return new(big.Rat), nil
+		},
+		complexFn: func(args []complex128) (complex128, error) {
+			return cmplx.Asin(args[0]), nil
+		},
+		minArgs:     1,
+		maxArgs:     1,
+		symbol:      "asin",
+		usage:       "asin(x)",
+		doc:         "Arc sine",
+		angleResult: true,
+	}
+	fnAcos function = function{
+		fn: func(args []float64) (float64, error) {
+			x := args[0]
+			res := math.Acos(x)
+			if math.IsNaN(res) {
+				return 0, fmt.Errorf("acos(%v) = %w", x, errNaN)
+			}
+			return res, nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			// acos(x) = pi/2 - asin(x)
+			x := args[0]
+			res, err := bigAsin(x)
+			if err != nil {
+				return nil, fmt.Errorf("acos(%v) = %w", x, errNaN)
+			}
+			return res.Sub(bigHalfPi(x.Prec()), res), nil
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			// only acos(1) is rational
+			if args[0].Cmp(big.NewRat(1, 1)) != 0 {
+				return nil, nil
+			}
+			return new(big.Rat), nil
+		},
+		complexFn: func(args []complex128) (complex128, error) {
+			return cmplx.Acos(args[0]), nil
+		},
+		minArgs:     1,
+		maxArgs:     1,
+		symbol:      "acos",
+		usage:       "acos(x)",
+		doc:         "Arc cosine",
+		angleResult: true,
+	}
+	fnAtan function = function{
+		fn: func(args []float64) (float64, error) {
+			return math.Atan(args[0]), nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			return bigAtan(args[0]), nil
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			// only atan(0) is rational
+			if args[0].Sign() != 0 {
+				return nil, nil
+			}
+			return new(big.Rat), nil
+		},
+		complexFn: func(args []complex128) (complex128, error) {
+			return cmplx.Atan(args[0]), nil
+		},
+		minArgs:     1,
+		maxArgs:     1,
+		symbol:      "atan",
+		usage:       "atan(x)",
+		doc:         "Arc tangent",
+		angleResult: true,
+	}
+	fnAtan2 function = function{
+		fn: func(args []float64) (float64, error) {
+			return math.Atan2(args[0], args[1]), nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			return bigAtan2(args[0], args[1]), nil
+		},
+		minArgs:     2,
+		maxArgs:     2,
+		symbol:      "atan2",
+		usage:       "atan2(y, x)",
+		doc:         "Arc tangent of y/x, using the signs to find the quadrant",
+		angleResult: true,
+	}
+	fnRe function = function{
+		fn: func(args []float64) (float64, error) {
+			return args[0], nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			return args[0], nil
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			return args[0], nil
+		},
+		complexFn: func(args []complex128) (complex128, error) {
+			return complex(real(args[0]), 0), nil
+		},
+		minArgs: 1,
+		maxArgs: 1,
+		symbol:  "re",
+		usage:   "re(x)",
+		doc:     "Real part",
+	}
+	fnIm function = function{
+		fn: func(args []float64) (float64, error) {
+			return 0, nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			return new(big.Float).SetPrec(args[0].Prec()), nil
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			return new(big.Rat), nil
+		},
+		complexFn: func(args []complex128) (complex128, error) {
+			return complex(imag(args[0]), 0), nil
+		},
+		minArgs: 1,
+		maxArgs: 1,
+		symbol:  "im",
+		usage:   "im(x)",
+		doc:     "Imaginary part",
+	}
+	fnAbs function = function{
+		fn: func(args []float64) (float64, error) {
+			return math.Abs(args[0]), nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			return new(big.Float).Abs(args[0]), nil
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			return new(big.Rat).Abs(args[0]), nil
+		},
+		complexFn: func(args []complex128) (complex128, error) {
+			return complex(cmplx.Abs(args[0]), 0), nil
+		},
+		minArgs: 1,
+		maxArgs: 1,
+		symbol:  "abs",
+		usage:   "abs(x)",
+		doc:     "Absolute value, or modulus of complex numbers",
+	}
+	fnArg function = function{
+		fn: func(args []float64) (float64, error) {
+			if args[0] < 0 {
+				return math.Pi, nil
+			}
+			return 0, nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			x := args[0]
+			if x.Sign() < 0 {
+				return bigPi(x.Prec()), nil
+			}
+			return new(big.Float).SetPrec(x.Prec()), nil
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			if args[0].Sign() < 0 {
+				return nil, nil
+			}
+			return new(big.Rat), nil
+		},
+		complexFn: func(args []complex128) (complex128, error) {
+			return complex(cmplx.Phase(args[0]), 0), nil
+		},
+		minArgs:     1,
+		maxArgs:     1,
+		symbol:      "arg",
+		usage:       "arg(x)",
+		doc:         "Argument (angle) of complex numbers",
+		angleResult: true,
+	}
+	fnConj function = function{
+		fn: func(args []float64) (float64, error) {
+			return args[0], nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			return args[0], nil
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			return args[0], nil
+		},
+		complexFn: func(args []complex128) (complex128, error) {
+			return cmplx.Conj(args[0]), nil
+		},
+		minArgs: 1,
+		maxArgs: 1,
+		symbol:  "conj",
+		usage:   "conj(x)",
+		doc:     "Complex conjugate",
+	}
+	fnLog function = function{
+		fn: func(args []float64) (float64, error) {
+			res := math.Log(args[0])
+			if len(args) == 2 {
+				base := math.Log(args[1])
+				if base == 0 {
+					return 0, errDivisionByZero
+				}
+				res /= base
+			}
+			return res, nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			res := bigLog(args[0])
+			if len(args) == 2 {
+				base := bigLog(args[1])
+				if base.Sign() == 0 {
+					return nil, errDivisionByZero
+				}
+				res.Quo(res, base)
+			}
+			return res, nil
+		},
+		complexFn: func(args []complex128) (complex128, error) {
+			for _, arg := range args {
+				if arg == 0 {
+					return 0, fmt.Errorf("log(0) = -Inf")
+				}
+			}
+			res := cmplx.Log(args[0])
+			if len(args) == 2 {
+				base := cmplx.Log(args[1])
+				if base == 0 {
+					return 0, errDivisionByZero
+				}
+				res /= base
+			}
+			return res, nil
+		},
+		domain: func(args []value) error {
+			for _, arg := range args {
+				switch arg.sign() {
+				case 0:
+					return fmt.Errorf("log(0) = -Inf")
+				case -1:
+					return fmt.Errorf("log(%v) = %w", arg, errNaN)
+				}
+			}
+			return nil
+		},
+		minArgs: 1,
+		maxArgs: 2,
+		symbol:  "log",
+		usage:   "log(x[, base])",
+		doc:     "Logarithm, natural by default",
+	}
+	fnRound function = function{
+		fn: func(args []float64) (float64, error) {
+			if len(args) == 1 {
+				return math.Round(args[0]), nil
+			}
+			digits, err := roundDigits(args[1])
+			if err != nil {
+				return 0, err
+			}
+			scale := math.Pow(10, float64(digits))
+			switch {
+			case math.IsInf(scale, 0):
+				return args[0], nil
+			case scale == 0:
+				return 0, nil
+			}
+			return math.Round(args[0]*scale) / scale, nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			digits := int64(0)
+			if len(args) == 2 {
+				f, _ := args[1].Float64()
+				d, err := roundDigits(f)
+				if err != nil {
+					return nil, err
+				}
+				digits = d
+			}
+			x := args[0]
+			scale := new(big.Float).SetPrec(x.Prec()).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(abs(digits)), nil))
+			res := new(big.Float).SetPrec(x.Prec())
+			if digits >= 0 {
+				res.Mul(x, scale)
+			} else {
+				res.Quo(x, scale)
+			}
+			// half away from zero
+			half := big.NewFloat(0.5)
+			if res.Sign() < 0 {
+				half.Neg(half)
+			}
+			i, _ := res.Add(res, half).Int(nil)
+			res.SetInt(i)
+			if digits >= 0 {
+				return res.Quo(res, scale), nil
+			}
+			return res.Mul(res, scale), nil
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			digits := int64(0)
+			if len(args) == 2 {
+				f, _ := args[1].Float64()
+				d, err := roundDigits(f)
+				if err != nil {
+					return nil, err
+				}
+				digits = d
+			}
+			scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(abs(digits)), nil))
+			if digits < 0 {
+				scale.Inv(scale)
+			}
+			res := new(big.Rat).Mul(args[0], scale)
+			// half away from zero
+			half := big.NewRat(1, 2)
+			if res.Sign() < 0 {
+				half.Neg(half)
+			}
+			res.Add(res, half)
+			res.SetInt(new(big.Int).Quo(res.Num(), res.Denom()))
+			return res.Quo(res, scale), nil
+		},
+		minArgs: 1,
+		maxArgs: 2,
+		symbol:  "round",
+		usage:   "round(x[, digits])",
+		doc:     "Round half away from zero",
+	}
+	fnMax function = function{
+		fn: func(args []float64) (float64, error) {
+			res := args[0]
+			for _, arg := range args[1:] {
+				res = max(res, arg)
+			}
+			return res, nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			res := args[0]
+			for _, arg := range args[1:] {
+				if arg.Cmp(res) > 0 {
+					res = arg
+				}
+			}
+			return res, nil
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			res := args[0]
+			for _, arg := range args[1:] {
+				if arg.Cmp(res) > 0 {
+					res = arg
+				}
+			}
+			return res, nil
+		},
+		minArgs: 1,
+		maxArgs: -1,
+		symbol:  "max",
+		usage:   "max(x, ...)",
+		doc:     "Maximum",
+	}
+	fnMin function = function{
+		fn: func(args []float64) (float64, error) {
+			res := args[0]
+			for _, arg := range args[1:] {
+				res = min(res, arg)
+			}
+			return res, nil
+		},
+		bigFn: func(args []*big.Float) (*big.Float, error) {
+			res := args[0]
+			for _, arg := range args[1:] {
+				if arg.Cmp(res) < 0 {
+					res = arg
+				}
+			}
+			return res, nil
+		},
+		ratFn: func(args []*big.Rat) (*big.Rat, error) {
+			res := args[0]
+			for _, arg := range args[1:] {
+				if arg.Cmp(res) < 0 {
+					res = arg
+				}
+			}
+			return res, nil
+		},
+		minArgs: 1,
+		maxArgs: -1,
+		symbol:  "min",
+		usage:   "min(x, ...)",
+		doc:     "Minimum",
+	}
+)
+
+// roundDigits validates the number of decimal places passed to round.
+func roundDigits(digits float64) (int64, error) {
+	if digits != math.Trunc(digits) || math.Abs(digits) > 1000 {
+		return 0, fmt.Errorf("round: invalid number of digits: %v", digits)
+	}
+	return int64(digits), nil
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+type constant struct {
+	value  func(env *environment) value
+	symbol string
+}
+
+var (
+	constImaginary = constant{
+		value: func(env *environment) value {
+			return newComplexValue(1i)
+		},
+		symbol: "i",
+	}
+	constPi = constant{
+		value: func(env *environment) value {
+			if env.mode == evalModePrecision {
+				return newBigFloatValue(bigPi(env.precisionBits()))
+			}
+			// irrational, so a float also in rational mode
+			return newFloatValue(math.Pi)
+		},
+		symbol: "PI",
+	}
+)
+
+type parserNode struct {
+	data  any
+	token lexerToken
+}
+
+type nodeKindOperation struct {
+	op  operator
+	lhs *parserNode
+	rhs *parserNode
+}
+
+func newParserNodeOperation(token lexerToken, op operator, lhs, rhs *parserNode) *parserNode {
+	return &parserNode{
+		data: nodeKindOperation{
+			op:  op,
+			lhs: lhs,
+			rhs: rhs,
+		},
+		token: token,
+	}
+}
+
+type nodeKindFunction struct {
+	fn   function
+	args []*parserNode
+}
+
+func newParserNodeFunction(token lexerToken, fn function, args []*parserNode) *parserNode {
+	return &parserNode{
+		data: nodeKindFunction{
+			fn:   fn,
+			args: args,
+		},
+		token: token,
+	}
+}
+
+// nodeKindUserCall is resolved by name when evaluated, so a function can be
+// redefined after being used in another one.
+type nodeKindUserCall struct {
+	name string
+	args []*parserNode
+}
+
+func newParserNodeUserCall(token lexerToken, args []*parserNode) *parserNode {
+	return &parserNode{
+		data: nodeKindUserCall{
+			name: token.text,
+			args: args,
+		},
+		token: token,
+	}
+}
+
+// nodeKindUserOperation is resolved by symbol when evaluated, like
+// nodeKindUserCall.
+type nodeKindUserOperation struct {
+	symbol string
+	lhs    *parserNode
+	rhs    *parserNode
+}
+
+func newParserNodeUserOperation(token lexerToken, lhs, rhs *parserNode) *parserNode {
+	return &parserNode{
+		data: nodeKindUserOperation{
+			symbol: token.text,
+			lhs:    lhs,
+			rhs:    rhs,
+		},
+		token: token,
+	}
+}
+
+type nodeKindNumber struct {
+	number value
+}
+
+func newParserNodeNumber(token lexerToken, number value) *parserNode {
+	return &parserNode{
+		data: nodeKindNumber{
+			number: number,
+		},
+		token: token,
+	}
+}
+
+type nodeKindSymbol struct {
+}
+
+func newParserNodeSymbol(token lexerToken) *parserNode {
+	return &parserNode{
+		data:  nodeKindSymbol{},
+		token: token,
+	}
+}
+
+type parser struct {
+	tokens []lexerToken
+	idx    int
+	env    *environment
+}
+
+func newParser(tokens []lexerToken, env *environment) parser {
+	return parser{
+		tokens: tokens,
+		env:    env,
+	}
+}
+
+func (p *parser) hasNext() bool {
+	return p.idx < len(p.tokens)
+}
+
+func (p *parser) lastToken() lexerToken {
+	if p.idx == 0 {
+		panic(fmt.Errorf("token %d: why do i call this first?", p.idx))
+	}
+	return p.tokens[p.idx-1]
+}
+
+func (p *parser) peek() lexerToken {
+	if !p.hasNext() {
+		panic(fmt.Errorf("token %d: tokens length not previously checked", p.idx))
+	}
+	return p.tokens[p.idx]
+}
+
+func (p *parser) consume() lexerToken {
+	if !p.hasNext() {
+		panic(fmt.Errorf("token %d: tokens length not previously checked", p.idx))
+	}
+	token := p.tokens[p.idx]
+	p.idx++
+	return token
+}
+
+func (p *parser) newError(msg string) ParseError {
+	if !p.hasNext() {
+		lastToken := p.lastToken()
+		return newParseError(fmt.Sprintf("parser: token %d: %s", p.idx, msg), lastToken.pos+lastToken.size(), 1)
+	}
+	token := p.peek()
+	return newParseError(fmt.Sprintf("parser: token %d: %s", p.idx, msg), token.pos, token.size())
+}
+
+// parseContext tells where the expression being parsed is, to know which
+// tokens can end it.
+type parseContext byte
+
+const (
+	parseContextTop      parseContext = iota
+	parseContextBrackets              // ended by ")"
+	parseContextCall                  // function arguments, ended by ")" or ","
+)
+
+func (p *parser) parse(ctx parseContext, minPrecedence int) (*parserNode, error) {
+	lhs, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.hasNext() {
+		switch p.peek().kind {
+		case tokenKindBracketClose:
+			if ctx == parseContextTop {
+				return nil, p.newError("closing bracket never opened")
+			}
+			return lhs, nil
+
+		case tokenKindComma:
+			if ctx != parseContextCall {
+				return nil, p.newError("comma outside function call")
+			}
+			return lhs, nil
+		}
+
+		var op operator
+		isUserOp := false
+		opToken := p.peek()
+
+		switch opToken.kind {
+		case tokenKindOperator:
+			if userOp, exists := p.env.operators[opToken.text]; exists {
+				// only what is needed to parse it, it is evaluated as a call
+				op = operator{
+					precedence:    userOp.precedence,
+					associativity: userOp.associativity,
+					symbol:        opToken.text,
+				}
+				isUserOp = true
+				break
+			}
+			if opToken.text == fnBitwiseNot.symbol {
+				return nil, p.newError(fmt.Sprintf("%q is not a binary operator", opToken.text))
+			}
+			op = parseOperator(opToken.text)
+		case tokenKindBracketOpen:
+			op = opMultiplication
+		case tokenKindNumber:
+			if p.lastToken().kind != tokenKindBracketClose {
+				return nil, p.newError("operator expected")
+			}
+			op = opMultiplication
+		default:
+			return nil, p.newError("operator expected")
+		}
+
+		if op.precedence < minPrecedence {
+			return lhs, nil
+		}
+
+		if p.peek().kind == tokenKindOperator {
+			p.consume()
+		}
+
+		nextPrecedence := op.precedence + 1
+		if op.associativity == associativityRight {
+			nextPrecedence = op.precedence
+		}
+		rhs, err := p.parse(ctx, nextPrecedence)
+		if err != nil {
+			return nil, err
+		}
+
+		if isUserOp {
+			lhs = newParserNodeUserOperation(opToken, lhs, rhs)
+			continue
+		}
+		lhs = newParserNodeOperation(opToken, op, lhs, rhs)
+	}
+
+	return lhs, nil
+}
+
+// parseBrackets parses the expression after an opening bracket, the closing
+// one being optional at the end of the input.
+func (p *parser) parseBrackets() (*parserNode, error) {
+	node, err := p.parse(parseContextBrackets, lowestPrecedence)
+	if err != nil {
+		return nil, err
+	}
+	if p.hasNext() {
+		p.consume() // the ")"
+	}
+	return node, nil
+}
+
+// parseCall parses the arguments of a function call after the opening
+// bracket, the closing one being optional at the end of the input.
+func (p *parser) parseCall(token lexerToken, checkArity func(count int) error) ([]*parserNode, error) {
+	args := []*parserNode{}
+
+	if p.hasNext() && p.peek().kind == tokenKindBracketClose {
+		p.consume()
+	} else {
+		for {
+			arg, err := p.parse(parseContextCall, lowestPrecedence)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			if !p.hasNext() {
+				break
+			}
+			if p.consume().kind == tokenKindBracketClose {
+				break
+			}
+		}
+	}
+
+	if err := checkArity(len(args)); err != nil {
+		end := p.lastToken().pos + p.lastToken().size()
+		return nil, newParseError(fmt.Sprintf("parser: %s", err), token.pos, end-token.pos)
+	}
+
+	return args, nil
+}
+
+// parseFunctionArgs parses the arguments of a function, with or without
+// brackets.
+func (p *parser) parseFunctionArgs(token lexerToken, checkArity func(count int) error) ([]*parserNode, error) {
+	if p.hasNext() && p.peek().kind == tokenKindBracketOpen {
+		p.consume()
+		return p.parseCall(token, checkArity)
+	}
+
+	arg, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArity(1); err != nil {
+		return nil, newParseError(fmt.Sprintf("parser: %s", err), token.pos, token.size())
+	}
+	return []*parserNode{arg}, nil
+}
+
+// isBaseLiteral tells if a number is written in base 16, 2 or 8, eg: "0x1F",
+// "-0b101" or "0o755".
+func isBaseLiteral(text string) bool {
+	text = strings.TrimPrefix(text, "-")
+	return len(text) > 2 && text[0] == '0' && strings.IndexByte("xXbBoO", text[1]) != -1
+}
+
+func parseNumber(text string, env *environment) (value, error) {
+	text = strings.ReplaceAll(text, "_", "")
+
+	if isBaseLiteral(text) {
+		i, ok := new(big.Int).SetString(text, 0)
+		if !ok {
+			return value{}, fmt.Errorf("invalid number: %q", text)
+		}
+		switch env.evalMode() {
+		case evalModeRational:
+			return newRatValue(new(big.Rat).SetInt(i)), nil
+		case evalModePrecision:
+			return newIntValue(i), nil
+		}
+		f, _ := new(big.Float).SetInt(i).Float64()
+		return newFloatValue(f), nil
+	}
+
+	if exponentOutOfRange(text) {
+		return value{}, fmt.Errorf("exponent out of range: %q: must be between -%d and %d", text, maxExponent, maxExponent)
+	}
+
+	if number, factor, found := cutNumberSuffix(text); found {
+		r, ok := new(big.Rat).SetString(number)
+		if !ok {
+			return value{}, fmt.Errorf("invalid number: %q", text)
+		}
+		r.Mul(r, factor)
+		switch env.evalMode() {
+		case evalModeRational:
+			return newRatValue(r), nil
+		case evalModePrecision:
+			if r.IsInt() {
+				return newIntValue(r.Num()), nil
+			}
+			return newBigFloatValue(new(big.Float).SetPrec(env.precisionBits()).SetRat(r)), nil
+		}
+		f, _ := r.Float64()
+		return newFloatValue(f), nil
+	}
+
+	if imaginary, ok := strings.CutSuffix(text, "i"); ok {
+		// complex numbers are always calculated with floats
+		f, err := strconv.ParseFloat(imaginary, 64)
+		if err != nil {
+			return value{}, err
+		}
+		return newComplexValue(complex(0, f)), nil
+	}
+
+	switch env.evalMode() {
+	case evalModeRational:
+		r, ok := new(big.Rat).SetString(text)
+		if !ok {
+			return value{}, fmt.Errorf("invalid number: %q", text)
+		}
+		return newRatValue(r), nil
+
+	case evalModePrecision:
+		if i, ok := new(big.Int).SetString(text, 10); ok {
+			return newIntValue(i), nil
+		}
+		f, _, err := big.ParseFloat(text, 10, env.precisionBits(), big.ToNearestEven)
+		if err != nil {
+			return value{}, err
+		}
+		return newBigFloatValue(f), nil
+	}
+
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return value{}, err
+	}
+	return newFloatValue(f), nil
+}
+
+// maxExponent limits the exponents of literals, since exact numbers like
+// "1e-10000000" would take too long to compute or print.
+const maxExponent = 100_000
+
+// exponentOutOfRange tells if the exponent of a decimal literal is beyond
+// maxExponent, eg: "1e-999999".
+func exponentOutOfRange(text string) bool {
+	idx := strings.IndexAny(text, "eE")
+	if idx == -1 {
+		return false
+	}
+	digits := strings.TrimLeft(text[idx+1:], "+-")
+	end := 0
+	for end < len(digits) && isNumber(digits[end]) {
+		end++
+	}
+	digits = strings.TrimLeft(digits[:end], "0")
+	if len(digits) > len(strconv.Itoa(maxExponent)) {
+		return true
+	}
+	exp, _ := strconv.Atoi(digits)
+	return exp > maxExponent
+}
+
+func (p *parser) parsePrimary() (*parserNode, error) {
+	if !p.hasNext() {
+		return nil, p.newError("expression expected")
+	}
+
+	switch p.peek().kind {
+	case tokenKindBracketOpen:
+		p.consume()
+		return p.parseBrackets()
+
+	case tokenKindNumber:
+		// the error is shown at the number, so it is consumed after parsing it
+		number, err := parseNumber(p.peek().text, p.env)
+		if err != nil {
+			return nil, p.newError(fmt.Sprintf("parsing number: %v", err))
+		}
+		node := newParserNodeNumber(p.consume(), number)
+		return node, nil
+
+	case tokenKindSymbol:
+		node := newParserNodeSymbol(p.consume())
+		return node, nil
+
+	case tokenKindOperator:
+		if p.peek().text != fnBitwiseNot.symbol {
+			break
+		}
+		token := p.consume()
+		args, err := p.parseFunctionArgs(token, fnBitwiseNot.checkArity)
+		if err != nil {
+			return nil, err
+		}
+		return newParserNodeFunction(token, fnBitwiseNot, args), nil
+
+	case tokenKindFunction:
+		token := p.consume()
+		if fn, exists := p.env.funcs[token.text]; exists {
+			args, err := p.parseFunctionArgs(token, fn.checkArity)
+			if err != nil {
+				return nil, err
+			}
+			return newParserNodeUserCall(token, args), nil
+		}
+
+		fn, exists := p.env.functions.lookup(token.text)
+		if !exists {
+			// a user function deleted after being used in another one
+			args, err := p.parseFunctionArgs(token, func(int) error { return nil })
+			if err != nil {
+				return nil, err
+			}
+			return newParserNodeUserCall(token, args), nil
+		}
+		if fn.exactArgs {
+			defer p.env.exactMode()()
+		}
+		args, err := p.parseFunctionArgs(token, fn.checkArity)
+		if err != nil {
+			return nil, err
+		}
+		return newParserNodeFunction(token, fn, args), nil
+	}
+	return nil, p.newError("expression expected")
+}
+
+func parseTokens(tokens []lexerToken, env *environment) (*parserNode, error) {
+	parser := newParser(tokens, env)
+	tree, err := parser.parse(parseContextTop, lowestPrecedence)
+	if err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+var builtinOperators = []operator{
+	opAddition,
+	opSubtraction,
+	opMultiplication,
+	opDivision,
+	opFloorDivision,
+	opModulo,
+	opRoot,
+	opPower,
+	opBitwiseAnd,
+	opBitwiseOr,
+	opBitwiseXor,
+	opShiftLeft,
+	opShiftRight,
+}
+
+func parseOperator(text string) operator {
+	switch text {
+	case opAddition.symbol:
+		return opAddition
+	case opSubtraction.symbol:
+		return opSubtraction
+	case opMultiplication.symbol:
+		return opMultiplication
+	case opDivision.symbol:
+		return opDivision
+	case opFloorDivision.symbol:
+		return opFloorDivision
+	case opModulo.symbol:
+		return opModulo
+	case opRoot.symbol:
+		return opRoot
+	case opPower.symbol:
+		return opPower
+	case opBitwiseAnd.symbol:
+		return opBitwiseAnd
+	case opBitwiseOr.symbol:
+		return opBitwiseOr
+	case opBitwiseXor.symbol:
+		return opBitwiseXor
+	case opShiftLeft.symbol:
+		return opShiftLeft
+	case opShiftRight.symbol:
+		return opShiftRight
+	}
+	panic("unexpected operator")
+}
+
+func lookupConstant(text string) (constant, bool) {
+	switch text {
+	case constPi.symbol:
+		return constPi, true
+	case constImaginary.symbol:
+		return constImaginary, true
+	}
+	return constant{}, false
+}
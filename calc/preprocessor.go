@@ -1,4 +1,4 @@
-package main
+package calc
 
 import (
 	"fmt"
@@ -59,12 +59,12 @@ func (p *preprocessor) addToken(token lexerToken) {
 	}
 }
 
-func (p *preprocessor) newError(msg string) parsingError {
+func (p *preprocessor) newError(msg string) ParseError {
 	if !p.hasNext() {
-		return newParsingError(fmt.Sprintf("preprocessor: token %d: %s", p.idx, msg), len(p.inTokens), 1)
+		return newParseError(fmt.Sprintf("preprocessor: token %d: %s", p.idx, msg), len(p.inTokens), 1)
 	}
 	token := p.peek()
-	return newParsingError(fmt.Sprintf("preprocessor: token %d: %s", p.idx, msg), token.pos, token.size())
+	return newParseError(fmt.Sprintf("preprocessor: token %d: %s", p.idx, msg), token.pos, token.size())
 }
 
 func (p *preprocessor) expandSpace() {
@@ -73,6 +73,10 @@ func (p *preprocessor) expandSpace() {
 	if prev == tokenKindBracketOpen {
 		return
 	}
+	// the arguments are already in brackets, eg: "max (1, 2)"
+	if prev == tokenKindFunction && p.hasNext() && p.peek().kind == tokenKindBracketOpen {
+		return
+	}
 	if prev == tokenKindOperator || prev == tokenKindFunction {
 		p.addToken(lexerToken{kind: tokenKindBracketOpen, text: "("})
 		openBrackets := 0
@@ -86,6 +90,10 @@ func (p *preprocessor) expandSpace() {
 					break Loop
 				}
 				openBrackets--
+			case tokenKindComma:
+				if openBrackets == 0 {
+					break Loop
+				}
 			case tokenKindSpace:
 				if openBrackets == 0 && p.prev().kind != tokenKindOperator && p.prev().kind != tokenKindFunction {
 					break Loop
@@ -110,10 +118,12 @@ func (p *preprocessor) expandSpace() {
 	if next == tokenKindOperator {
 		p.addToken(lexerToken{kind: tokenKindBracketClose, text: ")"})
 		i := len(p.outTokens) - 1
-		for ; i >= 0 && p.outTokens[i].kind != tokenKindBracketOpen; i-- {
+		for ; i >= 0 && p.outTokens[i].kind != tokenKindBracketOpen && p.outTokens[i].kind != tokenKindComma; i-- {
 		}
 		if i < 0 {
 			i = 0
+		} else if p.outTokens[i].kind == tokenKindComma {
+			i++ // the argument starts after the comma
 		}
 
 		prevCap := cap(p.outTokens)
@@ -153,7 +163,7 @@ func (p *preprocessor) process() ([]lexerToken, error) {
 		if next.kind == tokenKindSpace {
 			if nextIdx+1 >= len(p.inTokens) {
 				recalcPositions(p.inTokens, -1)
-				return p.inTokens, newParsingError(
+				return p.inTokens, newParseError(
 					fmt.Sprintf("preprocessor: token: %d: missing operand at the end", i),
 					curr.pos,
 					curr.size(),
@@ -165,10 +175,12 @@ func (p *preprocessor) process() ([]lexerToken, error) {
 		if next.kind != tokenKindNumber {
 			continue
 		}
-		if prev.kind == tokenKindNumber {
+		if prev.kind == tokenKindNumber || prev.kind == tokenKindSymbol || prev.kind == tokenKindBracketClose {
 			continue
 		}
 		p.inTokens[nextIdx].text = "-" + next.text
+		// the positions are recalculated from the first token
+		p.inTokens[nextIdx].pos = curr.pos
 		p.inTokens = slices.Delete(p.inTokens, i, i+1)
 	}
 
@@ -181,7 +193,7 @@ func (p *preprocessor) process() ([]lexerToken, error) {
 		next := p.inTokens[i+1]
 		if prev.kind == tokenKindNumber && next.kind == tokenKindNumber {
 			recalcPositions(p.inTokens, -1)
-			return p.inTokens, newParsingError(
+			return p.inTokens, newParseError(
 				fmt.Sprintf("preprocessor: token: %d: two consecutive operands without operator", i),
 				prev.pos,
 				next.pos+next.size()-prev.pos,
@@ -204,9 +216,10 @@ func (p *preprocessor) process() ([]lexerToken, error) {
 			nextIdx = i + 2
 			next = p.inTokens[nextIdx]
 		}
-		if next.kind == tokenKindOperator {
+		// except the unary "~", eg: "x & ~1"
+		if next.kind == tokenKindOperator && next.text != fnBitwiseNot.symbol {
 			recalcPositions(p.inTokens, -1)
-			return p.inTokens, newParsingError(
+			return p.inTokens, newParseError(
 				fmt.Sprintf("preprocessor: token: %d: two consecutive operators", i),
 				curr.pos,
 				next.pos+next.size()-curr.pos,
@@ -241,7 +254,7 @@ func (p *preprocessor) process() ([]lexerToken, error) {
 	return p.outTokens, nil
 }
 
-func PreprocessTokens(tokens []lexerToken) ([]lexerToken, error) {
+func preprocessTokens(tokens []lexerToken) ([]lexerToken, error) {
 	preprocessor := newPreprocessor(tokens)
 	newTokens, err := preprocessor.process()
 	if err != nil {
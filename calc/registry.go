@@ -0,0 +1,98 @@
+package calc
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var errAlreadyRegistered = errors.New("already registered")
+
+var builtinFunctions = []function{
+	fnSin,
+	fnCos,
+	fnTan,
+	fnAsin,
+	fnAcos,
+	fnAtan,
+	fnAtan2,
+	fnRe,
+	fnIm,
+	fnAbs,
+	fnArg,
+	fnConj,
+	fnLog,
+	fnRound,
+	fnMax,
+	fnMin,
+	fnU8,
+	fnU16,
+	fnU32,
+	fnU64,
+	fnI8,
+	fnI16,
+	fnI32,
+	fnI64,
+}
+
+// functionRegistry holds the functions known by the lexer and the parser,
+// more can be registered at runtime.
+type functionRegistry struct {
+	functions map[string]function
+}
+
+func newFunctionRegistry() *functionRegistry {
+	r := &functionRegistry{functions: make(map[string]function, len(builtinFunctions))}
+	for _, fn := range builtinFunctions {
+		if err := r.register(fn); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+func isIdentifier(name string) bool {
+	if len(name) == 0 || !isAlpha(name[0]) {
+		return false
+	}
+	for i := range len(name) {
+		if !isAlphanumeric(name[i]) && name[i] != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *functionRegistry) register(fn function) error {
+	switch {
+	case !isIdentifier(fn.symbol) || fn.symbol == opRoot.symbol:
+		return fmt.Errorf("register function: invalid name: %q", fn.symbol)
+	case fn.fn == nil:
+		return fmt.Errorf("register function: %s: missing implementation", fn.symbol)
+	case fn.minArgs < 0 || (fn.maxArgs != -1 && fn.maxArgs < fn.minArgs):
+		return fmt.Errorf("register function: %s: invalid arity: %d to %d", fn.symbol, fn.minArgs, fn.maxArgs)
+	}
+	if _, exists := r.functions[fn.symbol]; exists {
+		return fmt.Errorf("register function: %s: %w", fn.symbol, errAlreadyRegistered)
+	}
+	if _, exists := lookupConstant(fn.symbol); exists {
+		return fmt.Errorf("register function: %s: is a constant", fn.symbol)
+	}
+	r.functions[fn.symbol] = fn
+	return nil
+}
+
+func (r *functionRegistry) lookup(name string) (function, bool) {
+	fn, exists := r.functions[name]
+	return fn, exists
+}
+
+// names returns the names of the registered functions, sorted.
+func (r *functionRegistry) names() []string {
+	names := make([]string, 0, len(r.functions))
+	for name := range r.functions {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
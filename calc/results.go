@@ -0,0 +1,41 @@
+package calc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// isResultReference tells if name refers to a previous result: "ans" and "_"
+// are the last one, and "$n" the nth one.
+func isResultReference(name string) bool {
+	if name == "ans" || name == "_" {
+		return true
+	}
+	digits, ok := strings.CutPrefix(name, "$")
+	if !ok || digits == "" {
+		return false
+	}
+	for i := range len(digits) {
+		if !isNumber(digits[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupResult returns the result referenced by name, failing if there is no
+// such result yet.
+func (env *environment) lookupResult(name string) (value, error) {
+	if name == "ans" || name == "_" {
+		if len(env.results) == 0 {
+			return value{}, fmt.Errorf("%s: no previous result", name)
+		}
+		return env.results[len(env.results)-1], nil
+	}
+	n, err := strconv.Atoi(name[1:])
+	if err != nil || n < 1 || n > len(env.results) {
+		return value{}, fmt.Errorf("no result %s", name)
+	}
+	return env.results[n-1], nil
+}
@@ -0,0 +1,83 @@
+package calc
+
+import (
+	"cmp"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Session returns the settings, variables and user definitions of the engine
+// as statements and commands, one per line, which restore them when evaluated
+// in order. Variables that can't be written as a number, like infinity, are
+// skipped.
+func (e *Engine) Session() string {
+	lines := []string{}
+	for _, s := range settings {
+		lines = append(lines, ":"+s.name+" "+s.get(e.env))
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(e.env.vars)) {
+		if literal, ok := valueLiteral(e.env.vars[name]); ok {
+			lines = append(lines, name+" = "+literal)
+		}
+	}
+
+	// in the order they were defined, since they may use the previous ones
+	definitions := []*userFunction{}
+	for _, fn := range e.env.funcs {
+		definitions = append(definitions, fn)
+	}
+	for _, op := range e.env.operators {
+		definitions = append(definitions, op.fn)
+	}
+	slices.SortFunc(definitions, func(a, b *userFunction) int {
+		return cmp.Compare(a.order, b.order)
+	})
+	for _, fn := range definitions {
+		lines = append(lines, fn.source())
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// valueLiteral returns v as a number that is parsed back to the same value,
+// without rounding it like formatValue does.
+func valueLiteral(v value) (string, bool) {
+	switch v.kind {
+	case valueKindFloat:
+		return floatLiteral(v.float)
+	case valueKindInt:
+		return v.int.String(), true
+	case valueKindBigFloat:
+		if v.bigFloat.IsInf() {
+			return "", false
+		}
+		return v.bigFloat.Text('f', -1), true
+	case valueKindRat:
+		return v.rat.RatString(), true
+	case valueKindComplex:
+		realStr, ok := floatLiteral(real(v.complex))
+		if !ok {
+			return "", false
+		}
+		imagStr, ok := floatLiteral(math.Abs(imag(v.complex)))
+		if !ok {
+			return "", false
+		}
+		if imag(v.complex) < 0 {
+			return realStr + "-" + imagStr + "i", true
+		}
+		return realStr + "+" + imagStr + "i", true
+	}
+	return "", false
+}
+
+func floatLiteral(f float64) (string, bool) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", false
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64), true
+}
@@ -0,0 +1,330 @@
+package calc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// setting can be changed with "--name=arg" from the command line, or with
+// ":name arg" in the REPL.
+type setting struct {
+	name  string
+	usage string
+	doc   string
+	set   func(env *environment, arg string) error
+	get   func(env *environment) string
+}
+
+var settings = []setting{
+	{
+		name:  "precision",
+		usage: "digits|off",
+		doc:   "Evaluate with arbitrary precision, to the given significant digits",
+		set: func(env *environment, arg string) error {
+			if arg == "off" {
+				if env.mode == evalModePrecision {
+					env.mode = evalModeFloat
+				}
+				return nil
+			}
+			digits, err := strconv.Atoi(arg)
+			if err != nil || digits <= 0 || digits > maxPrecision {
+				return fmt.Errorf("invalid precision: %q: must be a number of digits between 1 and %d", arg, maxPrecision)
+			}
+			env.mode = evalModePrecision
+			env.precision = digits
+			return nil
+		},
+		get: func(env *environment) string {
+			if env.mode != evalModePrecision {
+				return "off"
+			}
+			return strconv.Itoa(env.precision)
+		},
+	},
+	{
+		name:  "rational",
+		usage: "on|off|mixed|decimal,...",
+		doc:   "Evaluate with exact fractions, also shown as mixed numbers or decimals",
+		set: func(env *environment, arg string) error {
+			if arg == "" {
+				arg = "on"
+			}
+			mode := evalModeRational
+			showMixed, showDecimal := false, false
+			for _, option := range strings.Split(arg, ",") {
+				switch strings.TrimSpace(option) {
+				case "on":
+				case "off":
+					mode = evalModeFloat
+				case "mixed":
+					showMixed = true
+				case "decimal":
+					showDecimal = true
+				default:
+					return fmt.Errorf("invalid rational option: %q: must be on, off, mixed or decimal", option)
+				}
+			}
+			if mode == evalModeFloat && env.mode != evalModeRational {
+				mode = env.mode
+			}
+			env.mode = mode
+			env.showMixed = showMixed
+			env.showDecimal = showDecimal
+			return nil
+		},
+		get: func(env *environment) string {
+			if env.mode != evalModeRational {
+				return "off"
+			}
+			options := []string{"on"}
+			if env.showMixed {
+				options = append(options, "mixed")
+			}
+			if env.showDecimal {
+				options = append(options, "decimal")
+			}
+			return strings.Join(options, ",")
+		},
+	},
+	{
+		name:  "complex",
+		usage: "rect|polar",
+		doc:   "Format of complex numbers",
+		set: func(env *environment, arg string) error {
+			switch arg {
+			case "rect":
+				env.polar = false
+			case "polar":
+				env.polar = true
+			default:
+				return fmt.Errorf("invalid complex format: %q: must be rect or polar", arg)
+			}
+			return nil
+		},
+		get: func(env *environment) string {
+			if env.polar {
+				return "polar"
+			}
+			return "rect"
+		},
+	},
+	{
+		name:  "mode",
+		usage: "deg|rad",
+		doc:   "Unit of the angles in trigonometric functions",
+		set: func(env *environment, arg string) error {
+			switch arg {
+			case "deg":
+				env.degrees = true
+			case "rad":
+				env.degrees = false
+			default:
+				return fmt.Errorf("invalid angle mode: %q: must be deg or rad", arg)
+			}
+			return nil
+		},
+		get: func(env *environment) string {
+			if env.degrees {
+				return "deg"
+			}
+			return "rad"
+		},
+	},
+	{
+		name:  "base",
+		usage: "dec|hex|bin|oct",
+		doc:   "Base of the integer results",
+		set: func(env *environment, arg string) error {
+			base, ok := baseNames[arg]
+			if !ok {
+				return fmt.Errorf("invalid base: %q: must be dec, hex, bin or oct", arg)
+			}
+			env.base = base
+			return nil
+		},
+		get: func(env *environment) string {
+			for name, base := range baseNames {
+				if base == env.base {
+					return name
+				}
+			}
+			panic("unexpected base")
+		},
+	},
+	{
+		name:  "notation",
+		usage: "sci|eng[,min,max]",
+		doc:   "Notation of the results out of the magnitudes shown with decimals",
+		set: func(env *environment, arg string) error {
+			name, limits, hasLimits := strings.Cut(arg, ",")
+			n := env.notation
+			switch name {
+			case "sci":
+				n.engineering = false
+			case "eng":
+				n.engineering = true
+			default:
+				return fmt.Errorf("invalid notation: %q: must be sci or eng", name)
+			}
+			if hasLimits {
+				minStr, maxStr, _ := strings.Cut(limits, ",")
+				var err error
+				n.min, err = strconv.ParseFloat(strings.TrimSpace(minStr), 64)
+				if err != nil || n.min < 0 {
+					return fmt.Errorf("invalid notation min: %q: must be a positive number", minStr)
+				}
+				n.max, err = strconv.ParseFloat(strings.TrimSpace(maxStr), 64)
+				if err != nil || n.max < n.min {
+					return fmt.Errorf("invalid notation max: %q: must be a number not less than min", maxStr)
+				}
+			}
+			env.notation = n
+			return nil
+		},
+		get: func(env *environment) string {
+			name := "sci"
+			if env.notation.engineering {
+				name = "eng"
+			}
+			return name + "," + formatLimit(env.notation.min) + "," + formatLimit(env.notation.max)
+		},
+	},
+	{
+		name:  "int",
+		usage: "off|u8|u16|u32|u64|i8|i16|i32|i64[,wrap|trap]",
+		doc:   "Compute every result as a fixed-width integer, wrapping around or failing on overflow",
+		set: func(env *environment, arg string) error {
+			name, overflow, _ := strings.Cut(arg, ",")
+			if name == "off" {
+				env.intType = intType{}
+				return nil
+			}
+			t, ok := lookupIntType(name)
+			if !ok {
+				return fmt.Errorf("invalid integer type: %q: must be off, u8, u16, u32, u64, i8, i16, i32 or i64", name)
+			}
+			switch overflow {
+			case "", "wrap":
+			case "trap":
+				t.trap = true
+			default:
+				return fmt.Errorf("invalid overflow behavior: %q: must be wrap or trap", overflow)
+			}
+			env.intType = t
+			return nil
+		},
+		get: func(env *environment) string {
+			switch {
+			case env.intType.bits == 0:
+				return "off"
+			case env.intType.trap:
+				return env.intType.String() + ",trap"
+			}
+			return env.intType.String() + ",wrap"
+		},
+	},
+	{
+		name:  "suffixes",
+		usage: "on|off",
+		doc:   "SI and binary prefixes after numbers, like 4k or 3Gi",
+		set: func(env *environment, arg string) error {
+			switch arg {
+			case "on":
+				env.noSuffixes = false
+			case "off":
+				env.noSuffixes = true
+			default:
+				return fmt.Errorf("invalid suffixes option: %q: must be on or off", arg)
+			}
+			return nil
+		},
+		get: func(env *environment) string {
+			if env.noSuffixes {
+				return "off"
+			}
+			return "on"
+		},
+	},
+}
+
+// formatLimit formats a limit of the notation like "1e-6", to be parsed back.
+func formatLimit(f float64) string {
+	str := strconv.FormatFloat(f, 'g', -1, 64)
+	mantissa, exponent, found := strings.Cut(str, "e")
+	if !found {
+		return str
+	}
+	exp, _ := strconv.Atoi(exponent)
+	return mantissa + "e" + strconv.Itoa(exp)
+}
+
+var baseNames = map[string]int{"dec": 10, "hex": 16, "bin": 2, "oct": 8}
+
+func lookupSetting(name string) (setting, bool) {
+	for _, s := range settings {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// parseArgs applies the "--name=arg" options to env and returns the remaining
+// arguments.
+func parseArgs(args []string, env *environment) ([]string, error) {
+	rest := make([]string, 0, len(args))
+
+	for _, arg := range args {
+		option, isOption := strings.CutPrefix(arg, "--")
+		if !isOption {
+			rest = append(rest, arg)
+			continue
+		}
+
+		name, value, _ := strings.Cut(option, "=")
+		s, ok := lookupSetting(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown option: %q", arg)
+		}
+		if err := s.set(env, value); err != nil {
+			return nil, fmt.Errorf("option %q: %w", name, err)
+		}
+	}
+
+	return rest, nil
+}
+
+// runCommand executes a REPL command of the form ":name [arg]", returning
+// the text to show to the user.
+func runCommand(line string, env *environment) (string, error) {
+	command, ok := strings.CutPrefix(line, ":")
+	if !ok {
+		return "", errors.New("command: missing \":\" prefix")
+	}
+
+	name, arg, _ := strings.Cut(strings.TrimSpace(command), " ")
+	arg = strings.TrimSpace(arg)
+
+	if c, ok := lookupCommand(name); ok {
+		output, err := c.run(env, arg)
+		if err != nil {
+			return "", fmt.Errorf("command: %s: %w", name, err)
+		}
+		return output, nil
+	}
+
+	s, ok := lookupSetting(name)
+	if !ok {
+		return "", fmt.Errorf("command: unknown command: %q", name)
+	}
+	if arg == "" {
+		return fmt.Sprintf("%s = %s", s.name, s.get(env)), nil
+	}
+	if err := s.set(env, arg); err != nil {
+		return "", fmt.Errorf("command: %w", err)
+	}
+	return "", nil
+}
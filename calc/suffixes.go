@@ -0,0 +1,84 @@
+package calc
+
+import (
+	"math/big"
+	"strings"
+)
+
+// numberSuffix is an SI or binary prefix written after a number, eg: "4k" is
+// 4000 and "3Gi" is 3*2**30.
+type numberSuffix struct {
+	symbol string
+	factor *big.Rat
+}
+
+// numberSuffixes are sorted so the binary ones are matched before the SI
+// ones, eg: "Ki" before "K".
+var numberSuffixes = []numberSuffix{
+	{"Ki", powerOf(2, 10)},
+	{"Mi", powerOf(2, 20)},
+	{"Gi", powerOf(2, 30)},
+	{"Ti", powerOf(2, 40)},
+	{"Pi", powerOf(2, 50)},
+	{"Ei", powerOf(2, 60)},
+	{"p", powerOf(10, -12)},
+	{"n", powerOf(10, -9)},
+	{"µ", powerOf(10, -6)},
+	{"u", powerOf(10, -6)},
+	{"m", powerOf(10, -3)},
+	{"k", powerOf(10, 3)},
+	{"M", powerOf(10, 6)},
+	{"G", powerOf(10, 9)},
+	{"T", powerOf(10, 12)},
+	{"P", powerOf(10, 15)},
+	{"E", powerOf(10, 18)},
+}
+
+// powerOf returns base**exp as an exact fraction.
+func powerOf(base int64, exp int64) *big.Rat {
+	abs := exp
+	if abs < 0 {
+		abs = -abs
+	}
+	power := new(big.Int).Exp(big.NewInt(base), big.NewInt(abs), nil)
+	if exp < 0 {
+		return new(big.Rat).SetFrac(big.NewInt(1), power)
+	}
+	return new(big.Rat).SetInt(power)
+}
+
+// lexNumberSuffix returns the suffix of the number at the current position,
+// or "" if there is none or they are disabled. It must end the word, so "2km"
+// is not "2k" followed by "m", but the root operator can follow it, eg: "8kv2".
+func (l *lexer) lexNumberSuffix() string {
+	if l.env.noSuffixes {
+		return ""
+	}
+	input := string(l.input[l.idx:])
+	for _, suffix := range numberSuffixes {
+		rest, found := strings.CutPrefix(input, suffix.symbol)
+		if !found {
+			continue
+		}
+		if rest == "" || !isWordByte(rest[0]) || (rest[0] == 'v' && (len(rest) == 1 || !isAlpha(rest[1]))) {
+			return suffix.symbol
+		}
+	}
+	return ""
+}
+
+// isWordByte tells if char can be part of an identifier or a multi-byte
+// character like "µ".
+func isWordByte(char byte) bool {
+	return isAlphanumeric(char) || char == '_' || char >= 0x80
+}
+
+// cutNumberSuffix removes the suffix of a number, returning its factor.
+func cutNumberSuffix(text string) (number string, factor *big.Rat, found bool) {
+	for _, suffix := range numberSuffixes {
+		if number, found := strings.CutSuffix(text, suffix.symbol); found {
+			return number, suffix.factor, true
+		}
+	}
+	return text, nil, false
+}
@@ -0,0 +1,86 @@
+package calc
+
+// TokenKind classifies the tokens of a statement for syntax highlighting.
+type TokenKind byte
+
+const (
+	TokenInvalid       TokenKind = iota // the rest of the statement after a lexer error
+	TokenSpace                          // spaces
+	TokenPunctuation                    // ";", "," and "="
+	TokenBracket                        // "(" and ")"
+	TokenNumber                         // number literals, eg: "1_000", "2.5i"
+	TokenOperator                       // builtin and user operators
+	TokenFunction                       // builtin and user functions
+	TokenSymbol                         // variables, constants and results
+	TokenUnknownSymbol                  // symbols that are not defined
+)
+
+// Token is a part of a statement, Text being the exact text at Pos.
+type Token struct {
+	Text string
+	Pos  int
+	Kind TokenKind
+}
+
+// Tokens splits a statement as the lexer does, knowing the functions,
+// operators and variables of the engine. If there is an unexpected character,
+// the statement from there is a single TokenInvalid token, so an incomplete
+// statement can still be highlighted.
+func (e *Engine) Tokens(statement string) []Token {
+	lexer := newLexer([]byte(statement), e.env)
+	lexerTokens, err := lexer.tokenize()
+	if err != nil {
+		lexerTokens = lexer.tokens
+	}
+
+	tokens := make([]Token, 0, len(lexerTokens)+1)
+	for i, token := range lexerTokens {
+		end := lexer.idx
+		if i+1 < len(lexerTokens) {
+			end = lexerTokens[i+1].pos
+		}
+		tokens = append(tokens, Token{
+			Text: statement[token.pos:end],
+			Pos:  token.pos,
+			Kind: e.tokenKind(token),
+		})
+	}
+	if err != nil {
+		tokens = append(tokens, Token{Text: statement[lexer.idx:], Pos: lexer.idx, Kind: TokenInvalid})
+	}
+	return tokens
+}
+
+func (e *Engine) tokenKind(token lexerToken) TokenKind {
+	switch token.kind {
+	case tokenKindSpace:
+		return TokenSpace
+	case tokenKindSemicolon, tokenKindComma, tokenKindEqual:
+		return TokenPunctuation
+	case tokenKindBracketOpen, tokenKindBracketClose:
+		return TokenBracket
+	case tokenKindNumber:
+		return TokenNumber
+	case tokenKindOperator:
+		return TokenOperator
+	case tokenKindFunction:
+		return TokenFunction
+	case tokenKindSymbol:
+		if _, exists := e.env.funcs[token.text]; exists {
+			return TokenFunction
+		}
+		if _, exists := e.env.vars[token.text]; exists {
+			return TokenSymbol
+		}
+		if _, exists := lookupConstant(token.text); exists {
+			return TokenSymbol
+		}
+		if isResultReference(token.text) {
+			if _, err := e.env.lookupResult(token.text); err == nil {
+				return TokenSymbol
+			}
+		}
+		return TokenUnknownSymbol
+	}
+	panic("unexpected token kind")
+}
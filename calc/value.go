@@ -0,0 +1,337 @@
+package calc
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"math/big"
+	"slices"
+)
+
+type evalMode byte
+
+const (
+	evalModeFloat evalMode = iota
+	evalModePrecision
+	evalModeRational
+)
+
+func (m evalMode) String() string {
+	switch m {
+	case evalModeFloat:
+		return "float"
+	case evalModePrecision:
+		return "precision"
+	case evalModeRational:
+		return "rational"
+	}
+	panic("not implemented")
+}
+
+type valueKind byte
+
+const (
+	valueKindFloat    valueKind = iota
+	valueKindInt                // exact integer, only produced in precision and fixed-width integer modes
+	valueKindBigFloat           // only produced in precision mode
+	valueKindRat                // only produced in rational mode
+	valueKindComplex
+	valueKindFunction // result of a function definition
+)
+
+func (k valueKind) String() string {
+	switch k {
+	case valueKindFloat:
+		return "kindFloat"
+	case valueKindInt:
+		return "kindInt"
+	case valueKindBigFloat:
+		return "kindBigFloat"
+	case valueKindRat:
+		return "kindRat"
+	case valueKindComplex:
+		return "kindComplex"
+	case valueKindFunction:
+		return "kindFunction"
+	}
+	panic("not implemented")
+}
+
+type value struct {
+	kind     valueKind
+	float    float64
+	int      *big.Int
+	bigFloat *big.Float
+	rat      *big.Rat
+	complex  complex128
+	fn       *userFunction
+}
+
+func newFloatValue(f float64) value {
+	return value{kind: valueKindFloat, float: f}
+}
+
+func newIntValue(i *big.Int) value {
+	return value{kind: valueKindInt, int: i}
+}
+
+func newBigFloatValue(f *big.Float) value {
+	return value{kind: valueKindBigFloat, bigFloat: f}
+}
+
+func newRatValue(r *big.Rat) value {
+	return value{kind: valueKindRat, rat: r}
+}
+
+func newComplexValue(c complex128) value {
+	return value{kind: valueKindComplex, complex: c}
+}
+
+func newFunctionValue(fn *userFunction) value {
+	return value{kind: valueKindFunction, fn: fn}
+}
+
+func (v value) String() string {
+	switch v.kind {
+	case valueKindFloat:
+		return fmt.Sprint(v.float)
+	case valueKindInt:
+		return v.int.String()
+	case valueKindBigFloat:
+		return v.bigFloat.String()
+	case valueKindRat:
+		return v.rat.RatString()
+	case valueKindComplex:
+		return fmt.Sprint(v.complex)
+	case valueKindFunction:
+		return v.fn.body
+	}
+	panic("not implemented")
+}
+
+func (v value) toFloat() float64 {
+	switch v.kind {
+	case valueKindFloat:
+		return v.float
+	case valueKindInt:
+		f, _ := new(big.Float).SetInt(v.int).Float64()
+		return f
+	case valueKindBigFloat:
+		f, _ := v.bigFloat.Float64()
+		return f
+	case valueKindRat:
+		f, _ := v.rat.Float64()
+		return f
+	case valueKindComplex:
+		panic("complex value converted to float")
+	case valueKindFunction:
+		panic("function converted to float")
+	}
+	panic("not implemented")
+}
+
+func (v value) toComplex() complex128 {
+	if v.kind == valueKindComplex {
+		return v.complex
+	}
+	return complex(v.toFloat(), 0)
+}
+
+func (v value) toBigFloat(prec uint) *big.Float {
+	switch v.kind {
+	case valueKindFloat:
+		if math.IsInf(v.float, 0) {
+			panic(fmt.Errorf("infinite value in precision mode: %v", v.float))
+		}
+		return new(big.Float).SetPrec(prec).SetFloat64(v.float)
+	case valueKindInt:
+		return new(big.Float).SetPrec(prec).SetInt(v.int)
+	case valueKindBigFloat:
+		return new(big.Float).SetPrec(prec).Set(v.bigFloat)
+	case valueKindRat:
+		return new(big.Float).SetPrec(prec).SetRat(v.rat)
+	case valueKindComplex:
+		panic("complex value converted to big float")
+	case valueKindFunction:
+		panic("function converted to big float")
+	}
+	panic("not implemented")
+}
+
+// sign returns -1, 0 or +1 depending on the sign of a real value.
+func (v value) sign() int {
+	switch v.kind {
+	case valueKindFloat:
+		switch {
+		case v.float < 0:
+			return -1
+		case v.float > 0:
+			return 1
+		}
+		return 0
+	case valueKindInt:
+		return v.int.Sign()
+	case valueKindBigFloat:
+		return v.bigFloat.Sign()
+	case valueKindRat:
+		return v.rat.Sign()
+	case valueKindComplex:
+		panic("sign of complex value")
+	case valueKindFunction:
+		panic("sign of function")
+	}
+	panic("not implemented")
+}
+
+func (v value) isInf() bool {
+	return v.kind == valueKindFloat && math.IsInf(v.float, 0)
+}
+
+// toRat returns the value as a fraction, only if it is known to be exact.
+func (v value) toRat() (*big.Rat, bool) {
+	switch v.kind {
+	case valueKindInt:
+		return new(big.Rat).SetInt(v.int), true
+	case valueKindRat:
+		return v.rat, true
+	}
+	return nil, false
+}
+
+// toInt returns the value as an integer, only if it is a real number without
+// decimals.
+func (v value) toInt() (*big.Int, bool) {
+	switch v.kind {
+	case valueKindFloat:
+		if math.IsInf(v.float, 0) || math.IsNaN(v.float) || v.float != math.Trunc(v.float) {
+			return nil, false
+		}
+		i, _ := big.NewFloat(v.float).Int(nil)
+		return i, true
+	case valueKindInt:
+		return v.int, true
+	case valueKindBigFloat:
+		if v.bigFloat.IsInf() || !v.bigFloat.IsInt() {
+			return nil, false
+		}
+		i, _ := v.bigFloat.Int(nil)
+		return i, true
+	case valueKindRat:
+		if !v.rat.IsInt() {
+			return nil, false
+		}
+		return v.rat.Num(), true
+	}
+	return nil, false
+}
+
+type environment struct {
+	vars      map[string]value
+	funcs     map[string]*userFunction
+	functions *functionRegistry
+	operators map[string]*userOperator
+	mode      evalMode
+	precision int // significant decimal digits in precision mode
+
+	// extra representations of fractions in rational mode
+	showMixed   bool
+	showDecimal bool
+
+	polar bool // complex numbers format
+
+	base int // of the integer results, see formatValue
+
+	notation notation // of the floats too large or too small
+
+	noSuffixes bool // numbers like "4k" are not lexed
+
+	// the fixed-width integer mode, and if some result of the statement
+	// being evaluated was wrapped around
+	intType intType
+	wrapped bool
+
+	degrees bool // unit of the angles in trigonometric functions
+
+	// parameters of the user function being evaluated, and how many calls
+	// are nested
+	locals map[string]value
+	depth  int
+
+	// the maps belong to the environment it was forked from, see own
+	shared bool
+
+	// user definitions made, to keep their order when saved
+	definitions int
+
+	// results of the evaluated statements, referenced as "$n", see
+	// lookupResult
+	results []value
+}
+
+// definitionOrder returns the order of a new user definition, keeping the one
+// of prev if it is redefined, since later definitions may use it.
+func (env *environment) definitionOrder(prev *userFunction) int {
+	if prev != nil {
+		return prev.order
+	}
+	env.definitions++
+	return env.definitions
+}
+
+func newEnvironment() *environment {
+	return &environment{
+		vars:      make(map[string]value),
+		funcs:     make(map[string]*userFunction),
+		functions: newFunctionRegistry(),
+		operators: make(map[string]*userOperator),
+		mode:      evalModeFloat,
+		precision: defaultPrecision,
+		base:      10,
+		notation:  defaultNotation,
+	}
+}
+
+// fork returns a copy of env that shares its definitions until it changes
+// them, so they are only copied when needed.
+func (env *environment) fork() *environment {
+	forked := *env
+	forked.shared = true
+	forked.locals = nil
+	forked.depth = 0
+	// so appending to the results of the fork doesn't write to the ones of env
+	forked.results = slices.Clip(env.results)
+	return &forked
+}
+
+// own copies the maps shared with the environment it was forked from, it
+// must be called before changing them.
+func (env *environment) own() {
+	if !env.shared {
+		return
+	}
+	env.vars = maps.Clone(env.vars)
+	env.funcs = maps.Clone(env.funcs)
+	env.functions = &functionRegistry{functions: maps.Clone(env.functions.functions)}
+	env.operators = maps.Clone(env.operators)
+	env.shared = false
+}
+
+// evalMode returns the mode used to evaluate, which is the rational one in
+// the fixed-width integer mode, so the integers are exact.
+func (env *environment) evalMode() evalMode {
+	if env.intType.bits != 0 {
+		return evalModeRational
+	}
+	return env.mode
+}
+
+const (
+	defaultPrecision = 50
+	maxPrecision     = 100_000
+)
+
+// precisionBits returns the mantissa size used for big.Float computations,
+// with some extra bits so the printed digits are not affected by rounding.
+func (e *environment) precisionBits() uint {
+	return uint(math.Ceil(float64(e.precision)*math.Log2(10))) + 32
+}
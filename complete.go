@@ -0,0 +1,74 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// completion is the state of the Tab completion of the word under the cursor.
+type completion struct {
+	start      int // of the word in the line
+	end        int
+	candidates []string
+	idx        int // of the candidate in the line, -1 for their common prefix
+}
+
+// newCompletion completes the word before the cursor with the longest prefix
+// shared by the candidates. It returns nil if there is no word or candidate.
+func newCompletion(input *TerminalInput, complete func(prefix string) []string) *completion {
+	end := input.cursorIdx
+	start := end
+	for start > 0 && isWordChar(input.line[start-1]) {
+		start--
+	}
+	// "0x1F" is a number, but "2x" is 2*x
+	if end-start > 1 && input.line[start] == '0' && strings.IndexByte("xXbBoO", input.line[start+1]) != -1 {
+		return nil
+	}
+	for start < end && isNumber(input.line[start]) {
+		start++
+	}
+	if start == end {
+		return nil
+	}
+
+	candidates := complete(string(input.line[start:end]))
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	c := &completion{start: start, end: end, candidates: candidates, idx: -1}
+	if len(candidates) == 1 {
+		c.idx = 0
+	}
+	c.replace(input, commonPrefix(candidates))
+	return c
+}
+
+// Ambiguous tells if there is more than one candidate to cycle through.
+func (c *completion) Ambiguous() bool {
+	return len(c.candidates) > 1
+}
+
+// Next replaces the word with the next candidate, going back to the first one
+// after the last.
+func (c *completion) Next(input *TerminalInput) {
+	c.idx = (c.idx + 1) % len(c.candidates)
+	c.replace(input, c.candidates[c.idx])
+}
+
+func (c *completion) replace(input *TerminalInput, text string) {
+	input.line = slices.Replace(input.line, c.start, c.end, []byte(text)...)
+	c.end = c.start + len(text)
+	input.cursorIdx = c.end
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
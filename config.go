@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/MarcosTypeAP/calc/calc"
+)
+
+// configPath returns the file with the definitions loaded on startup,
+// following the XDG base directory specification.
+func configPath() (string, error) {
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("config path: %w", err)
+		}
+		configDir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configDir, "sweet-calc", "config"), nil
+}
+
+// loadConfig evaluates the config file, usually function and operator
+// definitions, without printing anything. A missing file is an empty config.
+func loadConfig(path string, engine *calc.Engine) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	return prefixError("config", engine.Load(string(data)))
+}
+
+// prefixError adds the prefix to the message of err, keeping the type of
+// parse errors so they are still shown in the statement.
+func prefixError(prefix string, err error) error {
+	var perr calc.ParseError
+	if errors.As(err, &perr) {
+		perr.Msg = prefix + ": " + perr.Msg
+		return perr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", prefix, err)
+	}
+	return nil
+}
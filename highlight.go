@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/MarcosTypeAP/calc/calc"
+)
+
+var tokenColors = map[calc.TokenKind]string{
+	calc.TokenNumber:   ansiFgMagenta,
+	calc.TokenOperator: ansiFgCyan,
+	calc.TokenFunction: ansiFgGreen,
+	calc.TokenSymbol:   ansiFgBlue,
+}
+
+// highlightLine colors the tokens of the line, and the bracket under the
+// cursor with its matching one, or in red if it has none. The cursor is
+// ignored if it is -1.
+func highlightLine(tokens []calc.Token, line string, cursor int) string {
+	bracket, match := -1, -1
+	for _, pos := range []int{cursor, cursor - 1} {
+		if 0 <= pos && pos < len(line) && (line[pos] == '(' || line[pos] == ')') {
+			bracket = pos
+			match = matchingBracket(line, pos)
+			break
+		}
+	}
+
+	builder := strings.Builder{}
+	for _, token := range tokens {
+		// from the line, since the tokens may come from its inputStatement
+		text := line[token.Pos : token.Pos+len(token.Text)]
+		switch {
+		case token.Pos == bracket && match == -1:
+			builder.WriteString(ansiFgRed + ansiBold + text + ansiReset)
+		case token.Pos == bracket || token.Pos == match:
+			builder.WriteString(ansiReverse + text + ansiReset)
+		case tokenColors[token.Kind] != "":
+			builder.WriteString(tokenColors[token.Kind] + text + ansiReset)
+		default:
+			builder.WriteString(text)
+		}
+	}
+	return builder.String()
+}
+
+// matchingBracket returns the position of the bracket that closes or opens
+// the one at pos, or -1 if there is none.
+func matchingBracket(line string, pos int) int {
+	step, opening, closing := 1, byte('('), byte(')')
+	if line[pos] == ')' {
+		step, opening, closing = -1, ')', '('
+	}
+	depth := 0
+	for i := pos; 0 <= i && i < len(line); i += step {
+		switch line[i] {
+		case opening:
+			depth++
+		case closing:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
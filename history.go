@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// Entries kept in the history file, the oldest ones are dropped.
+const historyCap = 1000
+
+var (
+	historyEscaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	historyUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+)
+
+// historyPath returns the file where the REPL history is saved, following
+// the XDG base directory specification.
+func historyPath() (string, error) {
+	stateDir := os.Getenv("XDG_STATE_HOME")
+	if stateDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("history path: %w", err)
+		}
+		stateDir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(stateDir, "sweet-calc", "history"), nil
+}
+
+// loadHistory returns the saved entries, from oldest to newest.
+func loadHistory(path string) ([]string, error) {
+	unlock, err := lockHistory(path, syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return readHistory(path)
+}
+
+// appendHistory adds an entry to the history file, removing older copies of
+// it and the entries over the cap. Other processes can append at the same
+// time.
+func appendHistory(path string, entry string, cap int) error {
+	unlock, err := lockHistory(path, syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := readHistory(path)
+	if err != nil {
+		return err
+	}
+	entries = slices.DeleteFunc(entries, func(e string) bool { return e == entry })
+	entries = append(entries, entry)
+	if len(entries) > cap {
+		entries = entries[len(entries)-cap:]
+	}
+
+	builder := strings.Builder{}
+	for _, e := range entries {
+		builder.WriteString(historyEscaper.Replace(e))
+		builder.WriteByte('\n')
+	}
+
+	// replaced at once, so readers never see a half written file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(builder.String()), 0o600); err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	return nil
+}
+
+func readHistory(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
+
+	entries := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		entries = append(entries, historyUnescaper.Replace(line))
+	}
+	return entries, nil
+}
+
+// lockHistory locks a file next to the history one, since the history file is
+// replaced when written.
+func lockHistory(path string, how int) (unlock func(), err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
+	lockFile, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
+	if err := syscall.Flock(int(lockFile.Fd()), how); err != nil {
+		lockFile.Close()
+		return nil, fmt.Errorf("history: lock: %w", err)
+	}
+	return func() {
+		syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+		lockFile.Close()
+	}, nil
+}
@@ -5,12 +5,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math"
+	"io/fs"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unicode/utf8"
 	"unsafe"
+
+	"github.com/MarcosTypeAP/calc/calc"
 )
 
 const (
@@ -19,34 +25,23 @@ const (
 	ansiFgYellow  = "\033[33m"
 	ansiFgBlue    = "\033[34m"
 	ansiFgMagenta = "\033[35m"
+	ansiFgCyan    = "\033[36m"
 
 	ansiReset     = "\033[0m"
 	ansiBold      = "\033[1m"
+	ansiDim       = "\033[2m"
 	ansiUnderline = "\033[4m"
+	ansiReverse   = "\033[7m"
 )
 
-type parsingError struct {
-	msg  string
-	pos  int
-	size int
-}
-
-func newParsingError(msg string, pos int, size int) parsingError {
-	return parsingError{msg: msg, pos: pos, size: size}
-}
-
-func (p parsingError) Error() string {
-	return p.msg
-}
-
-func printError(input string, err error, repl bool) {
+func printError(err error, repl bool) {
 	if !repl {
 		os.Stdout = os.Stderr
 	}
 
 	fmt.Println()
 
-	var perr parsingError
+	var perr calc.ParseError
 	if ok := errors.As(err, &perr); !ok {
 		fmt.Printf(ansiFgRed+"error"+ansiReset+": %s\n", err)
 		fmt.Println()
@@ -56,244 +51,128 @@ func printError(input string, err error, repl bool) {
 		return
 	}
 
-	if perr.pos >= len(input) {
-		if perr.pos != len(input) {
+	input := perr.Source
+	if perr.Pos >= len(input) {
+		if perr.Pos != len(input) {
 			panic("miscalculated token position")
 		}
 		input += " "
-		perr.size = 1
+		perr.Size = 1
 	}
 
-	inputLeft := input[:perr.pos]
-	inputMid := input[perr.pos : perr.pos+perr.size]
-	inputRight := input[perr.pos+perr.size:]
+	inputLeft := input[:perr.Pos]
+	inputMid := input[perr.Pos : perr.Pos+perr.Size]
+	inputRight := input[perr.Pos+perr.Size:]
 
 	fmt.Println("    " + inputLeft + ansiFgRed + inputMid + ansiReset + inputRight)
-	fmt.Println("    " + ansiFgRed + strings.Repeat(" ", perr.pos) + strings.Repeat("^", perr.size) + ansiReset)
+	fmt.Println("    " + ansiFgRed + strings.Repeat(" ", utf8.RuneCountInString(inputLeft)) + strings.Repeat("^", utf8.RuneCountInString(inputMid)) + ansiReset)
 
-	fmt.Printf(ansiFgRed+"error"+ansiReset+" at position %d:\n", perr.pos)
-	fmt.Println("    " + perr.msg)
+	fmt.Printf(ansiFgRed+"error"+ansiReset+" at position %d:\n", perr.Pos)
+	fmt.Println("    " + perr.Msg)
 	fmt.Println()
 	if !repl {
 		os.Exit(1)
 	}
 }
 
-func tokensToString(tokens []lexerToken) string {
-	builder := strings.Builder{}
-	for _, token := range tokens {
-		builder.WriteString(token.text)
-	}
-	return builder.String()
+func isNumber(char byte) bool {
+	return '0' <= char && char <= '9'
 }
 
-func EvalStatement(statement []byte, vars map[string]float64) (res float64, assignedSymbol string, processed string, err error) {
-	tokens, err := lexStatement(statement)
-	if err != nil {
-		return 0, "", string(statement), err
-	}
-
-	if len(tokens) == 0 {
-		return 0, "", tokensToString(tokens), errors.New("statement eval: empty statement")
-	}
-
-	if tokens[0].kind == tokenKindSpace || tokens[len(tokens)-1].kind == tokenKindSpace {
-		panic("statement not trimmed properlly")
-	}
-
-	recalcPositions(tokens, 0)
-
-	isAssignment := false
-	for _, token := range tokens {
-		if token.kind == tokenKindEqual {
-			isAssignment = true
-			break
-		}
-	}
-
-	if !isAssignment {
-		res, processed, err = EvalExpression(tokens, vars)
-		if err != nil {
-			return 0, "", processed, err
-		}
-		return res, "", processed, nil
-	}
-
-	symbol := tokens[0]
-	idx := 1
-
-	if idx < len(tokens) && tokens[idx].kind == tokenKindSpace {
-		idx++
-	}
-
-	idx++ // the "="
-
-	if idx < len(tokens) && tokens[idx].kind == tokenKindSpace {
-		idx++
-	}
-
-	if idx >= len(tokens) {
-		return 0, symbol.text, tokensToString(tokens), newParsingError("statement eval: expression expected", idx, 1)
-	}
-
-	res, processed, err = EvalExpression(tokens[idx:], vars)
-	processed = symbol.text + " = " + processed
-	if err != nil {
-		if perr, ok := err.(parsingError); ok {
-			perr.pos += 2 // spaces around the equal
-			return 0, symbol.text, processed, perr
-		}
-		return 0, symbol.text, processed, err
-	}
-	vars[symbol.text] = res
-
-	return res, symbol.text, processed, nil
+func isAlphanumeric(char byte) bool {
+	return ('a' <= char && char <= 'z') || ('A' <= char && char <= 'Z') || '0' <= char && char <= '9'
 }
 
-func recalcPositions(tokens []lexerToken, start int) {
-	nextPos := start
-	if start == -1 {
-		nextPos = tokens[0].pos
-	}
-	for i := range tokens {
-		tokens[i].pos = nextPos
-		nextPos += tokens[i].size()
-	}
+// isWordChar tells if a char is part of the words moved over with Alt-B and
+// Alt-F, the identifiers and numbers. The bytes of multi-byte chars like "µ"
+// are too, so the cursor doesn't stop inside them.
+func isWordChar(char byte) bool {
+	return isAlphanumeric(char) || char == '_' || char >= utf8.RuneSelf
 }
 
-func EvalExpression(tokens []lexerToken, vars map[string]float64) (res float64, processed string, err error) {
-	tokens, err = PreprocessTokens(tokens)
-	if err != nil {
-		return 0, tokensToString(tokens), err
-	}
-
-	tree, err := ParseTokens(tokens)
-	if err != nil {
-		return 0, tokensToString(tokens), err
-	}
-
-	result, err := EvalTree(tree, vars)
-	if err != nil {
-		return 0, tokensToString(tokens), err
+// processInput evaluates the statements separated by ";" or newlines, and
+// runs the commands of the form ":name [arg]". Lines starting with "#" are
+// comments.
+func processInput(input []byte, engine *calc.Engine, repl bool) {
+	statements := [][]byte{}
+	for _, line := range bytes.Split(input, []byte{'\n'}) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, " \t"), []byte{'#'}) {
+			continue
+		}
+		statements = append(statements, bytes.Split(line, []byte{';'})...)
 	}
 
-	return result, tokensToString(tokens), nil
-}
-
-func EvalTree(node *parserNode, vars map[string]float64) (float64, error) {
-	switch n := node.data.(type) {
-	case nodeKindNumber:
-		return n.number, nil
-
-	case nodeKindSymbol:
-		if value, exists := vars[node.token.text]; exists {
-			return value, nil
-		}
-		return 0, newParsingError(
-			fmt.Sprintf("eval tree: undefined variable: %q", node.token.text),
-			node.token.pos,
-			node.token.size(),
-		)
-
-	case nodeKindFunction:
-		if n.arg == nil {
-			panic("function with nil arg")
+	for i, stmt := range statements {
+		stmt = bytes.Trim(stmt, " \t\r\n")
+		if len(stmt) == 0 {
+			continue
 		}
-		arg, err := EvalTree(n.arg, vars)
-		if err != nil {
-			return 0, err
+		if stmt[0] == ':' {
+			output, err := engine.Command(string(stmt))
+			if err != nil {
+				printError(fmt.Errorf("statement %d: %w", i, err), repl)
+			} else if len(output) > 0 {
+				fmt.Println(output)
+			}
+			continue
 		}
-		res, err := n.fn.fn(arg)
+		res, err := engine.Eval(string(stmt))
 		if err != nil {
-			return 0, newParsingError(
-				fmt.Sprintf("eval tree: %s", err),
-				node.token.pos,
-				node.token.size(),
-			)
-		}
-		return res, nil
-
-	case nodeKindOperation:
-		if n.lhs == nil || n.rhs == nil {
-			panic("operator with nil lhs and rhs")
+			printError(fmt.Errorf("statement %d: %w", i, err), repl)
+			continue
 		}
-
-		lhs, err := EvalTree(n.lhs, vars)
-		if err != nil {
-			return 0, err
+		// the REPL shows how to reference the result, eg: "$3 = 69"
+		prefix := "="
+		if repl && res.Number() > 0 {
+			prefix = ansiDim + "$" + strconv.Itoa(res.Number()) + ansiReset + " ="
 		}
-		rhs, err := EvalTree(n.rhs, vars)
-		if err != nil {
-			return 0, err
+		output := ansiFgYellow + res.String() + ansiReset
+		if res.Wrapped() {
+			output += ansiDim + " (wrapped)" + ansiReset
 		}
-		res, err := n.op.operation(lhs, rhs)
-		if err != nil {
-			return 0, newParsingError(
-				fmt.Sprintf("eval tree: %s", err),
-				node.token.pos,
-				node.token.size(),
-			)
+		if len(res.Assigned()) > 0 {
+			fmt.Println(prefix, res.Assigned(), "=", output)
+		} else {
+			fmt.Println(prefix, output)
 		}
-		return res, nil
-
-	default:
-		panic("unexpected parser node kind")
+	}
+	if repl {
+		fmt.Println()
 	}
 }
 
-func processInput(input []byte, vars map[string]float64, repl bool) {
-	statements := bytes.Split(input, []byte{';'})
+// inputStatement returns the REPL input as a single line, the lines of a
+// multi-line input being joined by spaces so the positions don't change.
+func inputStatement(line string) string {
+	return strings.ReplaceAll(line, "\n", " ")
+}
 
-	for i, stmt := range statements {
-		stmt = bytes.Trim(stmt, " \t\r\n")
-		if len(stmt) == 0 {
-			continue
+// needsContinuation tells if the input is not finished, because some bracket
+// is not closed or it ends with an operator, so Enter starts a new line.
+func needsContinuation(tokens []calc.Token) bool {
+	depth := 0
+	last := calc.Token{Kind: calc.TokenSpace}
+	for _, token := range tokens {
+		switch {
+		case token.Text == "(":
+			depth++
+		case token.Text == ")":
+			depth--
 		}
-		res, assignedSymbol, processed, err := EvalStatement(stmt, vars)
-		if err != nil {
-			printError(processed, fmt.Errorf("statement %d: %w", i, err), repl)
-		} else {
-			integerPart := int64(math.Abs(res))
-			decimalPart := math.Abs(res - float64(int64(res)))
-
-			const maxNormalIntegerLength = 5
-
-			str := fmt.Sprint(integerPart)
-			if len(str) > maxNormalIntegerLength {
-				s := make([]byte, 0, len(str)+len(str)/maxNormalIntegerLength+1)
-
-				for i := range str {
-					if i%3 == 0 && i > 0 {
-						s = append(s, '_')
-					}
-					s = append(s, byte(str[len(str)-1-i]))
-				}
-				if res < 0 {
-					s = append(s, '-')
-				}
-
-				slices.Reverse(s)
-				str = string(s)
-			} else if res < 0 {
-				str = "-" + str
-			}
-			if decimalPart > 0 {
-				str += strings.TrimRight(fmt.Sprintf("%.32f", decimalPart)[1:1+7], "0")
-				if str[len(str)-1] == '.' {
-					str += "0"
-				}
-			}
-
-			if len(assignedSymbol) > 0 {
-				fmt.Println("=", assignedSymbol, "=", ansiFgYellow+str+ansiReset)
-			} else {
-				fmt.Println("=", ansiFgYellow+str+ansiReset)
-			}
+		if token.Kind != calc.TokenSpace {
+			last = token
 		}
 	}
-	if repl {
-		fmt.Println()
+	if depth > 0 {
+		return true
 	}
+	switch last.Kind {
+	case calc.TokenOperator:
+		return true
+	case calc.TokenPunctuation:
+		return last.Text == "=" || last.Text == ","
+	}
+	return false
 }
 
 func getTermios() syscall.Termios {
@@ -324,6 +203,8 @@ func setTermios(term syscall.Termios) {
 	}
 }
 
+// TerminalInput is a line being edited, where the cursor moves over whole
+// UTF-8 chars, eg: "µ" is 2 bytes.
 type TerminalInput struct {
 	cursorIdx int
 	line      []byte
@@ -343,46 +224,198 @@ func (t *TerminalInput) Line() string {
 }
 
 func (t *TerminalInput) MoveCursorLeft() {
-	if t.cursorIdx == 0 {
-		return
-	}
-	t.cursorIdx--
+	_, size := utf8.DecodeLastRune(t.line[:t.cursorIdx])
+	t.cursorIdx -= size
 }
 
 func (t *TerminalInput) MoveCursorRight() {
-	if t.cursorIdx == len(t.line) {
-		return
-	}
-	t.cursorIdx++
+	_, size := utf8.DecodeRune(t.line[t.cursorIdx:])
+	t.cursorIdx += size
 }
 
-func (t *TerminalInput) WriteChar(char byte) {
-	t.line = slices.Insert(t.line, t.cursorIdx, char)
+func (t *TerminalInput) WriteChar(char rune) {
+	t.line = slices.Insert(t.line, t.cursorIdx, utf8.AppendRune(nil, char)...)
 	t.MoveCursorRight()
 }
 
 func (t *TerminalInput) DeleteLeft() {
-	if t.cursorIdx == 0 {
-		return
-	}
-	t.line = slices.Delete(t.line, t.cursorIdx-1, t.cursorIdx)
-	t.MoveCursorLeft()
+	_, size := utf8.DecodeLastRune(t.line[:t.cursorIdx])
+	t.line = slices.Delete(t.line, t.cursorIdx-size, t.cursorIdx)
+	t.cursorIdx -= size
 }
 
 func (t *TerminalInput) DeleteRight() {
-	if t.cursorIdx == len(t.line) {
-		return
+	_, size := utf8.DecodeRune(t.line[t.cursorIdx:])
+	t.line = slices.Delete(t.line, t.cursorIdx, t.cursorIdx+size)
+}
+
+// MoveCursorUp moves the cursor to the previous line of a multi-line input,
+// keeping the column if possible. It returns false if it is in the first one.
+func (t *TerminalInput) MoveCursorUp() bool {
+	start := t.lineStart(t.cursorIdx)
+	if start == 0 {
+		return false
 	}
-	t.line = slices.Delete(t.line, t.cursorIdx, t.cursorIdx+1)
+	column := utf8.RuneCount(t.line[start:t.cursorIdx])
+	t.cursorIdx = t.columnIndex(t.lineStart(start-1), start-1, column)
+	return true
+}
+
+// MoveCursorDown moves the cursor to the next line of a multi-line input,
+// keeping the column if possible. It returns false if it is in the last one.
+func (t *TerminalInput) MoveCursorDown() bool {
+	end := t.lineEnd(t.cursorIdx)
+	if end == len(t.line) {
+		return false
+	}
+	column := utf8.RuneCount(t.line[t.lineStart(t.cursorIdx):t.cursorIdx])
+	t.cursorIdx = t.columnIndex(end+1, t.lineEnd(end+1), column)
+	return true
+}
+
+// columnIndex returns the index of the char at column in the line from start
+// to end, or end if the line is shorter.
+func (t *TerminalInput) columnIndex(start, end, column int) int {
+	idx := start
+	for ; idx < end && column > 0; column-- {
+		_, size := utf8.DecodeRune(t.line[idx:end])
+		idx += size
+	}
+	return idx
+}
+
+// lineStart returns the index where the line that contains idx starts.
+func (t *TerminalInput) lineStart(idx int) int {
+	return bytes.LastIndexByte(t.line[:idx], '\n') + 1
+}
+
+// lineEnd returns the index of the newline that ends the line that contains
+// idx, or the length of the input if it is the last line.
+func (t *TerminalInput) lineEnd(idx int) int {
+	end := bytes.IndexByte(t.line[idx:], '\n')
+	if end == -1 {
+		return len(t.line)
+	}
+	return idx + end
+}
+
+func (t *TerminalInput) MoveCursorStart() {
+	t.cursorIdx = 0
+}
+
+func (t *TerminalInput) MoveCursorEnd() {
+	t.cursorIdx = len(t.line)
+}
+
+// MoveWordLeft moves the cursor to the start of the current or previous word.
+func (t *TerminalInput) MoveWordLeft() {
+	for t.cursorIdx > 0 && !isWordChar(t.line[t.cursorIdx-1]) {
+		t.cursorIdx--
+	}
+	for t.cursorIdx > 0 && isWordChar(t.line[t.cursorIdx-1]) {
+		t.cursorIdx--
+	}
+}
+
+// MoveWordRight moves the cursor to the end of the current or next word.
+func (t *TerminalInput) MoveWordRight() {
+	for t.cursorIdx < len(t.line) && !isWordChar(t.line[t.cursorIdx]) {
+		t.cursorIdx++
+	}
+	for t.cursorIdx < len(t.line) && isWordChar(t.line[t.cursorIdx]) {
+		t.cursorIdx++
+	}
+}
+
+// DeleteWordLeft deletes from the start of the word to the cursor, returning
+// the deleted text.
+func (t *TerminalInput) DeleteWordLeft() []byte {
+	end := t.cursorIdx
+	t.MoveWordLeft()
+	return t.kill(t.cursorIdx, end)
+}
+
+// KillToStart deletes from the start of the current line to the cursor,
+// returning the deleted text.
+func (t *TerminalInput) KillToStart() []byte {
+	start, end := t.lineStart(t.cursorIdx), t.cursorIdx
+	t.cursorIdx = start
+	return t.kill(start, end)
+}
+
+// KillToEnd deletes from the cursor to the end of the current line, returning
+// the deleted text.
+func (t *TerminalInput) KillToEnd() []byte {
+	return t.kill(t.cursorIdx, t.lineEnd(t.cursorIdx))
+}
+
+func (t *TerminalInput) kill(start, end int) []byte {
+	killed := slices.Clone(t.line[start:end])
+	t.line = slices.Delete(t.line, start, end)
+	return killed
+}
+
+// Yank inserts text at the cursor, leaving the cursor after it.
+func (t *TerminalInput) Yank(text []byte) {
+	t.line = slices.Insert(t.line, t.cursorIdx, text...)
+	t.cursorIdx += len(text)
+}
+
+// pendingInput tells if there are more bytes to read soon, to distinguish the
+// Escape key from escape sequences.
+func pendingInput(fd int) bool {
+	fds := syscall.FdSet{}
+	fds.Bits[fd/64] |= 1 << (fd % 64)
+	timeout := syscall.NsecToTimeval((50 * time.Millisecond).Nanoseconds())
+	n, err := syscall.Select(fd+1, &fds, nil, nil, &timeout)
+	return err == nil && n > 0
 }
 
 func main() {
-	vars := make(map[string]float64)
-	vars["PI"] = math.Pi
+	engine := calc.New()
+
+	// without a home there is no config
+	if path, err := configPath(); err == nil {
+		if err := loadConfig(path, engine); err != nil {
+			printError(err, false)
+		}
+	}
 
-	if len(os.Args) > 1 {
-		input := []byte(os.Args[1])
-		processInput(input, vars, false)
+	sessionFile, args, err := sessionArg(os.Args[1:])
+	if err != nil {
+		printError(err, false)
+	}
+	// loaded before the other options, so they can override its settings
+	var sessionHistory []string
+	if sessionFile != "" {
+		sessionHistory, err = loadSession(sessionFile, engine)
+		// a new session, created when it is saved
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			printError(err, false)
+		}
+	}
+
+	settings := sessionSettings(engine)
+	args, err = engine.ParseArgs(args)
+	if err != nil {
+		printError(err, false)
+	}
+	// the options only apply to this run
+	flags := flagSettings(settings, sessionSettings(engine))
+
+	saveSessionFile := func(history []string, repl bool) {
+		if sessionFile == "" {
+			return
+		}
+		if err := saveSession(sessionFile, engine, history, flags); err != nil {
+			printError(err, repl)
+		}
+	}
+
+	if len(args) > 0 {
+		input := []byte(args[0])
+		processInput(input, engine, false)
+		saveSessionFile(sessionHistory, false)
 		return
 	}
 
@@ -393,7 +426,8 @@ func main() {
 	if stat.Mode()&os.ModeCharDevice == 0 {
 		input, err := io.ReadAll(os.Stdin)
 		if err == nil {
-			processInput(input, vars, false)
+			processInput(input, engine, false)
+			saveSessionFile(sessionHistory, false)
 			return
 		}
 	}
@@ -404,44 +438,217 @@ func main() {
 	termNew := termOriginal
 	// See termios(3)
 	termNew.Lflag &^= syscall.ICANON | syscall.ISIG | syscall.ECHO
+	termNew.Iflag &^= syscall.IXON // to receive Ctrl-S
 	termNew.Cc[syscall.VMIN] = 1
 	termNew.Cc[syscall.VTIME] = 0
 	setTermios(termNew)
 
 	// See https://en.wikipedia.org/wiki/Control_character
 	const (
-		EndOfText         = 0x03 // ^C
-		EndofTransmission = 0x04 // ^D
-		Escape            = 0x1b // ^[
-		LineFeed          = 0x0a // \n
+		StartOfHeading         = 0x01 // ^A
+		EndOfText              = 0x03 // ^C
+		EndofTransmission      = 0x04 // ^D
+		Enquiry                = 0x05 // ^E
+		HorizontalTab          = 0x09 // ^I
+		LineFeed               = 0x0a // \n
+		VerticalTab            = 0x0b // ^K
+		FormFeed               = 0x0c // ^L
+		DeviceControl2         = 0x12 // ^R
+		DeviceControl3         = 0x13 // ^S
+		NegativeAcknowledge    = 0x15 // ^U
+		EndOfTransmissionBlock = 0x17 // ^W
+		EndOfMedium            = 0x19 // ^Y
+		Escape                 = 0x1b // ^[
 	)
 
 	const (
-		EraseLine  = "\033[0K\033[1K" // ESC[2K don't work properlly
-		MoveCursor = "\033[%dG"       // 1-indexed
+		EraseBelow     = "\033[0J"
+		MoveCursor     = "\033[%dG" // 1-indexed
+		MoveCursorUp   = "\033[%dA"
+		MoveCursorDown = "\033[%dB"
+		ClearScreen    = "\033[H\033[2J"
 	)
 
-	const allowedChars = ";%/()=*+-._ "
+	const (
+		prompt             = "> "
+		continuationPrompt = ".. "
+	)
+
+	const allowedChars = ";:,%/()=*+-._ !#$&<>?@^|~"
+	const allowedRunes = "µ" // read as UTF-8, multiple bytes
+
+	// termMu guards the terminal and the input, which the preview goroutine
+	// also renders, it is only released while waiting for a key.
+	// engineMu guards the evaluations and the changes to the engine, so the
+	// preview doesn't block the input. Reading the engine, like to highlight
+	// the input, only needs termMu, since it is also held when changing it.
+	termMu := sync.Mutex{}
+	engineMu := sync.Mutex{}
 
 	stdinFd := int(os.Stdin.Fd())
 	readChar := func() byte {
 		charBuf := []byte{0}
+		termMu.Unlock()
 		_, err := syscall.Read(stdinFd, charBuf)
+		termMu.Lock()
 		if err != nil {
 			panic(err)
 		}
 		return charBuf[0]
 	}
+	// readRune reads the rest of the UTF-8 char that starts with first.
+	readRune := func(first byte) rune {
+		buf := []byte{first}
+		for !utf8.FullRune(buf) {
+			buf = append(buf, readChar())
+		}
+		r, _ := utf8.DecodeRune(buf)
+		return r
+	}
 
-	printPrompt := func(input *TerminalInput) {
-		fmt.Print(EraseLine)
+	history := []TerminalInput{} // the last one is always the new input
+	historyFile, err := historyPath()
+	if err == nil {
+		var entries []string
+		entries, err = loadHistory(historyFile)
+		for _, entry := range entries {
+			history = append(history, TerminalInput{line: []byte(entry), cursorIdx: len(entry)})
+		}
+	}
+	if err != nil {
+		printError(err, true)
+		historyFile = ""
+	}
+	for _, entry := range sessionHistory {
+		history = append(history, TerminalInput{line: []byte(entry), cursorIdx: len(entry)})
+	}
+	history = append(history, TerminalInput{})
+	historyIdx := len(history) - 1
+
+	// the entries without the new input
+	historyEntries := func() []string {
+		entries := make([]string, 0, len(history)-1)
+		for _, entry := range history[:len(history)-1] {
+			entries = append(entries, entry.Line())
+		}
+		return entries
+	}
+
+	defer func() {
+		engineMu.Lock()
+		defer engineMu.Unlock()
+		saveSessionFile(historyEntries(), true)
+	}()
+
+	var search *historySearch // nil if not searching
+	var tab *completion       // nil if not completing
+	var killed []byte         // the last text deleted with Ctrl-W, Ctrl-U or Ctrl-K
+
+	var preview *livePreview
+	requested := ""  // the last line sent to preview
+	requestedID := 0 // and its id
+	previewID := 0   // the request previewText is for
+	previewText := ""
+
+	// rows of the cursor and of the last line in the printed input, from its
+	// first line
+	promptRow, promptLastRow := 0, 0
+
+	// leavePrompt moves the cursor below the printed input, to print after it.
+	leavePrompt := func() {
+		if promptLastRow > promptRow {
+			fmt.Printf(MoveCursorDown, promptLastRow-promptRow)
+		}
+		fmt.Println()
+		promptRow, promptLastRow = 0, 0
+	}
+
+	// clearPrompt moves the cursor to the start of the printed input, and
+	// erases it.
+	clearPrompt := func() {
+		if promptRow > 0 {
+			fmt.Printf(MoveCursorUp, promptRow)
+		}
 		fmt.Printf(MoveCursor, 1)
-		fmt.Print(ansiFgBlue + ansiBold + "> " + ansiReset + input.Line())
-		fmt.Printf(MoveCursor, 3+input.CursorPosition())
+		fmt.Print(EraseBelow)
+	}
+
+	// printInput prints the input highlighted, the lines after the first one
+	// with the continuation prompt. The cursor is ignored if it is -1.
+	printInput := func(input *TerminalInput, cursor int) {
+		line := input.Line()
+		tokens := engine.Tokens(inputStatement(line))
+		highlighted := highlightLine(tokens, line, cursor)
+		fmt.Print(ansiFgBlue + ansiBold + prompt + ansiReset)
+		fmt.Print(strings.ReplaceAll(highlighted, "\n", "\n"+ansiFgBlue+ansiBold+continuationPrompt+ansiReset))
+		promptRow = strings.Count(line, "\n")
+		promptLastRow = promptRow
 	}
 
-	history := []TerminalInput{{}} // the last one is always the new input
-	historyIdx := 0
+	printPrompt := func(input *TerminalInput) {
+		clearPrompt()
+
+		if search != nil {
+			searchPrompt := search.Prompt()
+			entry, pos, found := search.Match(history)
+			if !found {
+				entry, pos = input.Line(), input.CursorPosition()
+			}
+			end := pos
+			if found {
+				end += len(search.query)
+			}
+			entry = inputStatement(entry)
+			fmt.Print(ansiFgBlue + ansiBold + searchPrompt + ansiReset)
+			fmt.Print(entry[:pos] + ansiUnderline + entry[pos:end] + ansiReset + entry[end:])
+			fmt.Printf(MoveCursor, utf8.RuneCountInString(searchPrompt+entry[:pos])+1)
+			promptRow, promptLastRow = 0, 0
+			return
+		}
+
+		printInput(input, input.CursorPosition())
+		if input.Line() != requested {
+			requested = input.Line()
+			requestedID = preview.Request(requested)
+		}
+		if previewID == requestedID && previewText != "" {
+			fmt.Print("  " + ansiDim + previewText + ansiReset)
+		}
+
+		beforeCursor := input.Line()[:input.CursorPosition()]
+		promptRow = strings.Count(beforeCursor, "\n")
+		column := utf8.RuneCountInString(beforeCursor[strings.LastIndexByte(beforeCursor, '\n')+1:])
+		if promptRow == 0 {
+			column += len(prompt)
+		} else {
+			column += len(continuationPrompt)
+		}
+		if promptLastRow > promptRow {
+			fmt.Printf(MoveCursorUp, promptLastRow-promptRow)
+		}
+		fmt.Printf(MoveCursor, column+1)
+	}
+
+	preview = newLivePreview(
+		func(line string) string {
+			engineMu.Lock()
+			defer engineMu.Unlock()
+			return previewInput(inputStatement(line), engine)
+		},
+		func(id int, text string) {
+			termMu.Lock()
+			defer termMu.Unlock()
+			if id != requestedID {
+				return
+			}
+			previewID, previewText = id, text
+			if search == nil {
+				printPrompt(&history[historyIdx])
+			}
+		},
+	)
+
+	termMu.Lock()
 
 	for {
 		input := &history[historyIdx]
@@ -452,40 +659,163 @@ func main() {
 		for {
 			ch := readChar()
 
+			if search != nil {
+				switch {
+				case ch == DeviceControl2:
+					search.Next(history, true)
+					printPrompt(input)
+					continue
+				case ch == DeviceControl3:
+					search.Next(history, false)
+					printPrompt(input)
+					continue
+				case ch == 0x7f: // Backspace
+					search.DeleteLeft()
+					printPrompt(input)
+					continue
+				case isAlphanumeric(ch) || strings.Contains(allowedChars, string(ch)):
+					search.WriteChar(history, rune(ch))
+					printPrompt(input)
+					continue
+				case ch >= utf8.RuneSelf:
+					if r := readRune(ch); strings.ContainsRune(allowedRunes, r) {
+						search.WriteChar(history, r)
+					}
+					printPrompt(input)
+					continue
+				}
+
+				start := search.start
+				_, pos, found := search.Match(history)
+				if found {
+					historyIdx = search.idx
+					input = &history[historyIdx]
+					input.cursorIdx = pos
+				}
+				search = nil
+
+				if ch == Escape {
+					// an escape sequence accepts the match, the Escape key alone cancels
+					if pendingInput(stdinFd) {
+						for ch := readChar(); ch == '[' || isNumber(ch) || ch == ';'; ch = readChar() {
+						}
+					} else {
+						historyIdx = start
+					}
+				}
+				if ch != LineFeed {
+					break LineLoop
+				}
+			}
+
+			if ch != HorizontalTab {
+				tab = nil
+			}
+
 			switch {
+			case ch == HorizontalTab:
+				if tab != nil && tab.Ambiguous() {
+					tab.Next(input)
+					break
+				}
+				engineMu.Lock()
+				tab = newCompletion(input, engine.Complete)
+				engineMu.Unlock()
+				if tab != nil && tab.Ambiguous() {
+					leavePrompt()
+					fmt.Println(strings.Join(tab.candidates, "  "))
+				}
+
+			case ch == DeviceControl2 || ch == DeviceControl3:
+				search = newHistorySearch(historyIdx, ch == DeviceControl2)
+
 			case ch == EndOfText:
-				fmt.Println()
+				leavePrompt()
 				return
 
 			case ch == EndofTransmission:
-				historyIdx = len(history) - 1
-				history[len(history)-1].Reset()
-				break LineLoop
-
-			case ch == Escape:
-				if readChar() != '[' {
-					break
+				if input.Line() == "" {
+					leavePrompt()
+					return
 				}
-				switch readChar() {
-				case 'A': // Arrow UP
-					historyIdx = max(0, historyIdx-1)
-					break LineLoop
+				input.DeleteRight()
 
-				case 'B': // Arrow Down
-					historyIdx = min(len(history)-1, historyIdx+1)
-					break LineLoop
+			case ch == StartOfHeading:
+				input.MoveCursorStart()
+
+			case ch == Enquiry:
+				input.MoveCursorEnd()
+
+			case ch == EndOfTransmissionBlock:
+				killed = input.DeleteWordLeft()
+
+			case ch == NegativeAcknowledge:
+				killed = input.KillToStart()
+
+			case ch == VerticalTab:
+				killed = input.KillToEnd()
 
-				case 'C': // Arrow Right
-					input.MoveCursorRight()
+			case ch == EndOfMedium:
+				input.Yank(killed)
 
-				case 'D': // Arrow Left
-					input.MoveCursorLeft()
+			case ch == FormFeed:
+				fmt.Print(ClearScreen)
+				promptRow, promptLastRow = 0, 0
 
-				case 0x33: // Delete
-					if readChar() != 0x7e {
-						break
+			case ch == Escape:
+				switch readChar() {
+				case 'b': // Alt-B
+					input.MoveWordLeft()
+
+				case 'f': // Alt-F
+					input.MoveWordRight()
+
+				case '[', 'O':
+					// ESC [ params final, eg: "ESC [ 3 ~"
+					params := []byte{}
+					final := readChar()
+					for isNumber(final) || final == ';' {
+						params = append(params, final)
+						final = readChar()
+					}
+
+					switch final {
+					case 'A': // Arrow UP
+						if input.MoveCursorUp() {
+							break
+						}
+						historyIdx = max(0, historyIdx-1)
+						break LineLoop
+
+					case 'B': // Arrow Down
+						if input.MoveCursorDown() {
+							break
+						}
+						historyIdx = min(len(history)-1, historyIdx+1)
+						break LineLoop
+
+					case 'C': // Arrow Right
+						input.MoveCursorRight()
+
+					case 'D': // Arrow Left
+						input.MoveCursorLeft()
+
+					case 'H': // Home
+						input.MoveCursorStart()
+
+					case 'F': // End
+						input.MoveCursorEnd()
+
+					case '~':
+						switch string(params) {
+						case "1", "7": // Home
+							input.MoveCursorStart()
+						case "4", "8": // End
+							input.MoveCursorEnd()
+						case "3": // Delete
+							input.DeleteRight()
+						}
 					}
-					input.DeleteRight()
 				}
 
 			case ch == 0x7f: // Backspace
@@ -495,9 +825,47 @@ func main() {
 				if input.Line() == "" {
 					continue
 				}
+				statement := inputStatement(input.Line())
+				if needsContinuation(engine.Tokens(statement)) {
+					input.MoveCursorEnd()
+					input.WriteChar('\n')
+					break
+				}
 
-				fmt.Println()
-				processInput([]byte(input.Line()), vars, true)
+				// the preview of the input is replaced by its output
+				clearPrompt()
+				printInput(input, -1)
+				leavePrompt()
+
+				var loadedHistory []string
+				engineMu.Lock()
+				if name, path, withHistory, ok := parseSessionCommand(statement); ok {
+					var err error
+					switch {
+					case path == "":
+						err = fmt.Errorf("command: %s: missing file", name)
+					case name == "save" && withHistory:
+						err = saveSession(path, engine, historyEntries(), nil)
+					case name == "save":
+						err = saveSession(path, engine, nil, nil)
+					case name == "load":
+						loadedHistory, err = loadSession(path, engine)
+					}
+					if err != nil {
+						printError(err, true)
+					} else {
+						fmt.Println()
+					}
+				} else {
+					processInput([]byte(statement), engine, true)
+				}
+				engineMu.Unlock()
+
+				if historyFile != "" {
+					if err := appendHistory(historyFile, input.Line(), historyCap); err != nil {
+						printError(err, true)
+					}
+				}
 
 				switch {
 				case len(history) == 1:
@@ -505,18 +873,26 @@ func main() {
 
 				case len(history) >= 2 && input.Line() != history[len(history)-2].Line():
 					if historyIdx != len(history)-1 {
-						history[len(history)-1] = *input
+						history[len(history)-1] = TerminalInput{line: slices.Clone(input.line), cursorIdx: input.cursorIdx}
 					}
 					history = append(history, TerminalInput{})
 				}
 
 				history[len(history)-1].Reset()
+				for _, entry := range loadedHistory {
+					history = slices.Insert(history, len(history)-1, TerminalInput{line: []byte(entry), cursorIdx: len(entry)})
+				}
 				historyIdx = len(history) - 1
 
 				break LineLoop
 
 			case isAlphanumeric(ch) || strings.Contains(allowedChars, string(ch)):
-				input.WriteChar(ch)
+				input.WriteChar(rune(ch))
+
+			case ch >= utf8.RuneSelf:
+				if r := readRune(ch); strings.ContainsRune(allowedRunes, r) {
+					input.WriteChar(r)
+				}
 			}
 
 			printPrompt(input)
@@ -1,269 +1,591 @@
 package main
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
-	"math"
-	"math/rand"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+
+	"github.com/MarcosTypeAP/calc/calc"
 )
 
-func TestCalculations(t *testing.T) {
-	// single number
-	testStatement(t, nil, "1", 1)
-	testStatement(t, nil, "69", 69)
-	testStatement(t, nil, ".420", .420)
-	testStatement(t, nil, "33.33", 33.33)
-	testStatement(t, nil, "1337.", 1337)
-	testStatement(t, nil, "69_420", 69420)
-	testStatement(t, nil, "69___420__", 69420)
-	assertStatementError(t, "__69___420__")
-	assertStatementError(t, "4.2_0")
-
-	// operations
-	testStatement(t, nil, "3+4", 7)
-	testStatement(t, nil, "2-5", -3)
-	testStatement(t, nil, "3*2", 6)
-	testStatement(t, nil, "3(-2)", -6)
-	testStatement(t, nil, "(3)2", 6)
-	testStatement(t, nil, "(3)(-2)", -6)
-	testStatement(t, nil, "3/2", 1.5)
-	testStatement(t, nil, "4//6", 0)
-	testStatement(t, nil, "7%10", 7)
-	testStatement(t, nil, "3v27", 3)
-	assertStatementError(t, "2v-2")
-	testStatement(t, nil, "(1+2)v27", 3)
-	testStatement(t, nil, "2**8", 256)
-
-	// functions
-	testStatement(t, nil, "sin 2", math.Sin(2))
-	testStatement(t, nil, "cos 2", math.Cos(2))
-	testStatement(t, nil, "tan 2", math.Tan(2))
-	testStatement(t, nil, "asin .1", math.Asin(0.1))
-	assertStatementError(t, "asin 2")
-	testStatement(t, nil, "acos .1", math.Acos(0.1))
-	assertStatementError(t, "acos 2")
-	testStatement(t, nil, "atan 2", math.Atan(2))
-	testStatement(t, nil, "sin -.2", math.Sin(-0.2))
-	testStatement(t, nil, "sin cos 2", math.Sin(math.Cos(2)))
-	testStatement(t, nil, "sin cos -2 * 2", math.Sin(math.Cos(-2))*2)
-	testStatement(t, nil, "sin 4*2", math.Sin(4*2))
-	testStatement(t, nil, "sin 4 *2", math.Sin(4)*2)
-	testStatement(t, nil, "sin (4 *2", math.Sin(4*2))
-
-	// associative property
-	testStatement(t, nil, "3+4+5+6", 18)
-	testStatement(t, nil, "3+4-5+6", 8)
-	testStatement(t, nil, "3-4+5+6", 10)
-	testStatement(t, nil, "3-4-5+6", 0)
-
-	testStatement(t, nil, "3*4*5*2", 120)
-	testStatement(t, nil, "3*4/5*2", 4.8)
-	testStatement(t, nil, "3/4*5*2", 7.5)
-	testStatement(t, nil, "3/4/5*2", 0.3)
-
-	// operators precedence
-	testStatement(t, nil, "3+4*5", 23)
-	testStatement(t, nil, "3*4+5", 17)
-	testStatement(t, nil, "3*4v5", 4.486046343663661)
-	testStatement(t, nil, "3-4**5", -1021)
-
-	// brackets
-	testStatement(t, nil, "2+(3)", 5)
-	testStatement(t, nil, "(2)+(3)", 5)
-	testStatement(t, nil, "(2+3)", 5)
-	testStatement(t, nil, "((2)+(3))", 5)
-	testStatement(t, nil, "(2)+(3)4(2+3-1)", 50)
-	testStatement(t, nil, "(((2(2", 4)
-
-	// space expansion
-	testStatement(t, nil, "1+ 1", 2)
-	testStatement(t, nil, "1 + 1 + 1 * 2", 4)
-	testStatement(t, nil, "1+1 *2", 4)
-	testStatement(t, nil, "( 1+1*2)", 3)
-	testStatement(t, nil, "(1+1 *2", 4)
-	testStatement(t, nil, "1+1 *2 **2", 16)
-	testStatement(t, nil, "1+1 *2** 2", 8)
+func TestHistoryFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sweet-calc", "history")
+
+	entries, err := loadHistory(path)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("empty history expected: %q: %v", entries, err)
+	}
+
+	for _, entry := range []string{"1+1", "A = 2", "1+1", "with\nnewline", `back\slash\n`} {
+		if err := appendHistory(path, entry, 4); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	entries, err = loadHistory(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"A = 2", "1+1", "with\nnewline", `back\slash\n`}
+	if !slices.Equal(entries, expected) {
+		t.Errorf("unexpected history: expected %q, got %q", expected, entries)
+	}
+
+	if err := appendHistory(path, "new", 4); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, _ = loadHistory(path)
+	if len(entries) != 4 || entries[0] != "1+1" || entries[3] != "new" {
+		t.Errorf("history not capped: %q", entries)
+	}
 }
 
-func TestVariables(t *testing.T) {
-	vars := make(map[string]float64)
-
-	testStatement(t, vars, "A = 1+1 *2", 4)
-	testStatement(t, vars, "A", 4)
-	testStatement(t, vars, "A+1", 5)
-	testStatement(t, vars, "A+A", 8)
-	testStatement(t, vars, "B = A*A", 16)
-	testStatement(t, vars, "B", 16)
-	testStatement(t, vars, "snake_case_69 = B", 16)
-	testStatement(t, vars, "snake_case_69 + 1", 17)
+func TestHistoryFileConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+
+	wg := sync.WaitGroup{}
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := appendHistory(path, fmt.Sprint(i), historyCap); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries, err := loadHistory(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 20 {
+		t.Errorf("entries lost: %q", entries)
+	}
 }
 
-func TestInvalidSyntax(t *testing.T) {
-	assertStatementError(t, "1(")
-	assertStatementError(t, ")1")
-	assertStatementError(t, "1+")
-	assertStatementError(t, "+1")
-	assertStatementError(t, "1+1++1")
-	assertStatementError(t, "1+1()")
-	assertStatementError(t, "1+1 1")
-	assertStatementError(t, "1+1+")
-	assertStatementError(t, "1+1(")
-	assertStatementError(t, "1+1)")
+func TestHistoryPath(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", "/state")
+	if path, _ := historyPath(); path != "/state/sweet-calc/history" {
+		t.Errorf("unexpected path: %q", path)
+	}
+
+	t.Setenv("XDG_STATE_HOME", "")
+	t.Setenv("HOME", "/home/user")
+	if path, _ := historyPath(); path != "/home/user/.local/state/sweet-calc/history" {
+		t.Errorf("unexpected path: %q", path)
+	}
 }
 
-func TestFuzzyInput(t *testing.T) {
-	seed := rand.Int63()
-	fmt.Println("seed:", seed)
-	random := rand.New(rand.NewSource(seed))
+func TestConfigFile(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", "/config")
+	if path, _ := configPath(); path != "/config/sweet-calc/config" {
+		t.Errorf("unexpected path: %q", path)
+	}
 
-	m := make(map[string]float64)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("HOME", "/home/user")
+	if path, _ := configPath(); path != "/home/user/.config/sweet-calc/config" {
+		t.Errorf("unexpected path: %q", path)
+	}
 
-	t.Run("good tokens", func(t *testing.T) {
-		for range 1_000_000 {
-			input := createRandomInput(random)
-			EvalStatement(input, m)
-		}
-	})
+	path := filepath.Join(t.TempDir(), "config")
+	engine := calc.New()
+	if err := loadConfig(path, engine); err != nil {
+		t.Errorf("empty config expected: %v", err)
+	}
 
-	t.Run("bad tokens", func(t *testing.T) {
-		for range 100_000 {
-			input := createRandomBadInput(random)
-			EvalStatement(input, m)
-		}
-	})
-
-	t.Run("good input", func(t *testing.T) {
-		for range 1_000_000 {
-			input := createRandomGoodInput(random)
-			_, _, _, err := EvalStatement(input, m)
-			if err != nil {
-				if strings.HasSuffix(err.Error(), "division by 0") {
-					continue
-				}
-				if strings.HasSuffix(err.Error(), "= NaN") {
-					continue
-				}
-				t.Errorf("error: input = %q: %v", input, err)
-				return
-			}
-		}
-	})
+	config := "# helpers\nsq(x) = x*x\ncube(x) = x*sq(x)\nop <> prec 2 = (lhs+rhs)/2\n"
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := loadConfig(path, engine); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res, err := engine.Eval("cube 3"); err != nil || res.Float64() != 27 || res.Number() != 1 {
+		t.Errorf("config not loaded: %v: %v", res, err)
+	}
+	if res, err := engine.Eval("1 <> 3"); err != nil || res.Float64() != 2 {
+		t.Errorf("config operator not loaded: %v: %v", res, err)
+	}
+
+	if err := os.WriteFile(path, []byte("f(x) = x\ng(x) = x +* 2\n"), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var perr calc.ParseError
+	if err := loadConfig(path, engine); !errors.As(err, &perr) || !strings.HasPrefix(perr.Msg, "config: line 2: ") {
+		t.Errorf("config error expected: %v", err)
+	}
 }
 
-func createRandomGoodInput(random *rand.Rand) []byte {
-	n := random.Int()%100 + 1
-	digits := []byte("0123456789")
-	operators := []string{"+", "-", "*", "/", "//", "%", "v", "**"}
-	functions := []string{"asin", "acos", "atan", "sin", "cos", "tan"} // supersets at the end
-	input := make([]byte, 0, n+8)
+func newTestHistory(lines ...string) []TerminalInput {
+	history := []TerminalInput{}
+	for _, line := range lines {
+		history = append(history, TerminalInput{line: []byte(line), cursorIdx: len(line)})
+	}
+	return append(history, TerminalInput{})
+}
 
-	for len(input) < n {
-		if random.Intn(15) == 0 {
-			input = append(input, ' ')
-		}
-		if random.Intn(15) == 0 {
-			input = append(input, '(')
-		}
+func assertSearchMatch(t *testing.T, history []TerminalInput, search *historySearch, entry string, pos int) {
+	t.Helper()
+	e, p, found := search.Match(history)
+	if !found || e != entry || p != pos {
+		t.Errorf("wrong match: query=%q: expected %q at %d, got %q at %d (found=%v)", search.query, entry, pos, e, p, found)
+	}
+}
 
-		var digit byte
-		for {
-			random.Shuffle(len(digits), func(i, j int) {
-				digits[i], digits[j] = digits[j], digits[i]
-			})
-			digit = digits[0]
-			if len(input) > 0 && (input[len(input)-1] == '/' || input[len(input)-1] == '%') && digit == '0' {
-				continue
-			}
-			break
+func TestHistorySearch(t *testing.T) {
+	history := newTestHistory("A = 10", "1+1", "A*2", "sin 1")
+
+	search := newHistorySearch(len(history)-1, true)
+	if _, _, found := search.Match(history); found {
+		t.Errorf("no match expected before typing")
+	}
+
+	search.WriteChar(history, 'A')
+	assertSearchMatch(t, history, search, "A*2", 0)
+	search.Next(history, true)
+	assertSearchMatch(t, history, search, "A = 10", 0)
+
+	// stays in the last match when failing
+	search.Next(history, true)
+	assertSearchMatch(t, history, search, "A = 10", 0)
+	if search.Prompt() != "(failed reverse-i-search)`A': " {
+		t.Errorf("unexpected prompt: %q", search.Prompt())
+	}
+
+	search.Next(history, false)
+	assertSearchMatch(t, history, search, "A*2", 0)
+	if search.Prompt() != "(i-search)`A': " {
+		t.Errorf("unexpected prompt: %q", search.Prompt())
+	}
+
+	search.WriteChar(history, '*')
+	assertSearchMatch(t, history, search, "A*2", 0)
+	search.WriteChar(history, '3')
+	if !search.failed {
+		t.Errorf("failed search expected")
+	}
+	search.DeleteLeft()
+	assertSearchMatch(t, history, search, "A*2", 0)
+
+	search = newHistorySearch(len(history)-1, true)
+	for _, ch := range "1" {
+		search.WriteChar(history, ch)
+	}
+	assertSearchMatch(t, history, search, "sin 1", 4)
+	search.Next(history, true)
+	assertSearchMatch(t, history, search, "1+1", 2)
+
+	history = newTestHistory("5µ+1", "5m")
+	search = newHistorySearch(len(history)-1, true)
+	search.WriteChar(history, '5')
+	search.WriteChar(history, 'µ')
+	assertSearchMatch(t, history, search, "5µ+1", 0)
+	search.DeleteLeft()
+	assertSearchMatch(t, history, search, "5m", 0)
+	if search.Prompt() != "(reverse-i-search)`5': " {
+		t.Errorf("unexpected prompt: %q", search.Prompt())
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	engine := calc.New()
+	for _, statement := range []string{"total = 1", "tan2 = 2", "twice(x) = x*2", "x1 = 3"} {
+		if _, err := engine.Eval(statement); err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
-		input = append(input, digit)
-
-		random.Shuffle(len(operators), func(i, j int) {
-			operators[i], operators[j] = operators[j], operators[i]
-		})
-		input = append(input, operators[0]...)
-
-		if random.Intn(10) == 0 && input[len(input)-1] != 'v' {
-			fnIdx := random.Intn(len(functions))
-			input = append(input, functions[fnIdx]...)
-			if random.Intn(2) == 0 {
-				input = append(input, ' ')
-			} else {
-				input = append(input, '(')
-			}
+	}
+
+	assertLine := func(input *TerminalInput, line string, cursor int) {
+		t.Helper()
+		if input.Line() != line || input.CursorPosition() != cursor {
+			t.Errorf("unexpected input: expected %q at %d, got %q at %d", line, cursor, input.Line(), input.CursorPosition())
 		}
 	}
 
-	if input[len(input)-1] == '(' || input[len(input)-1] == ' ' {
-		input = input[:len(input)-1]
+	input := &TerminalInput{line: []byte("1+2to"), cursorIdx: 5}
+	tab := newCompletion(input, engine.Complete)
+	if tab == nil || tab.Ambiguous() {
+		t.Fatalf("single candidate expected: %v", tab)
+	}
+	assertLine(input, "1+2total", 8)
+
+	// completes the common prefix, then cycles
+	input = &TerminalInput{line: []byte("t+1"), cursorIdx: 1}
+	tab = newCompletion(input, engine.Complete)
+	if tab == nil || !slices.Equal(tab.candidates, []string{"tan(", "tan2", "total", "twice("}) {
+		t.Fatalf("unexpected candidates: %v", tab)
 	}
-	for _, fn := range functions {
-		for bytes.HasSuffix(input, []byte(fn)) {
-			input = input[:len(input)-len(fn)]
+	assertLine(input, "t+1", 1)
+	tab.Next(input)
+	assertLine(input, "tan(+1", 4)
+	tab.Next(input)
+	assertLine(input, "tan2+1", 4)
+
+	input = &TerminalInput{line: []byte("ta"), cursorIdx: 2}
+	tab = newCompletion(input, engine.Complete)
+	assertLine(input, "tan", 3)
+	for _, expected := range []string{"tan(", "tan2", "tan("} {
+		tab.Next(input)
+		assertLine(input, expected, 4)
+	}
+
+	input = &TerminalInput{line: []byte("1+2"), cursorIdx: 3}
+	if tab := newCompletion(input, engine.Complete); tab != nil {
+		t.Errorf("no completion expected: %q", tab.candidates)
+	}
+	input = &TerminalInput{line: []byte("xyz"), cursorIdx: 3}
+	if tab := newCompletion(input, engine.Complete); tab != nil {
+		t.Errorf("no completion expected: %q", tab.candidates)
+	}
+	input = &TerminalInput{line: []byte("0x1"), cursorIdx: 3}
+	if tab := newCompletion(input, engine.Complete); tab != nil {
+		t.Errorf("no completion expected: %q", tab.candidates)
+	}
+}
+
+func TestTerminalInput(t *testing.T) {
+	assertLine := func(input *TerminalInput, line string, cursor int) {
+		t.Helper()
+		if input.Line() != line || input.CursorPosition() != cursor {
+			t.Errorf("unexpected input: expected %q at %d, got %q at %d", line, cursor, input.Line(), input.CursorPosition())
 		}
 	}
 
-	for _, op := range operators {
-		for bytes.HasSuffix(input, []byte(op)) {
-			input = input[:len(input)-len(op)]
+	input := &TerminalInput{}
+	for _, ch := range "sin(x_1) + 20" {
+		input.WriteChar(ch)
+	}
+	assertLine(input, "sin(x_1) + 20", 13)
+
+	input.MoveCursorStart()
+	assertLine(input, "sin(x_1) + 20", 0)
+	input.MoveCursorEnd()
+	assertLine(input, "sin(x_1) + 20", 13)
+
+	input.MoveWordLeft()
+	assertLine(input, "sin(x_1) + 20", 11)
+	input.MoveWordLeft()
+	assertLine(input, "sin(x_1) + 20", 4)
+	input.MoveWordLeft()
+	input.MoveWordLeft()
+	assertLine(input, "sin(x_1) + 20", 0)
+	input.MoveWordRight()
+	assertLine(input, "sin(x_1) + 20", 3)
+	input.MoveWordRight()
+	assertLine(input, "sin(x_1) + 20", 7)
+
+	killed := input.DeleteWordLeft()
+	if string(killed) != "x_1" {
+		t.Errorf("unexpected killed text: %q", killed)
+	}
+	assertLine(input, "sin() + 20", 4)
+	input.Yank(killed)
+	assertLine(input, "sin(x_1) + 20", 7)
+
+	killed = input.KillToEnd()
+	if string(killed) != ") + 20" {
+		t.Errorf("unexpected killed text: %q", killed)
+	}
+	assertLine(input, "sin(x_1", 7)
+
+	input.MoveCursorLeft()
+	input.MoveCursorLeft()
+	killed = input.KillToStart()
+	if string(killed) != "sin(x" {
+		t.Errorf("unexpected killed text: %q", killed)
+	}
+	assertLine(input, "_1", 0)
+	input.MoveCursorEnd()
+	input.Yank(killed)
+	assertLine(input, "_1sin(x", 7)
+
+	// nothing to kill
+	if killed := input.KillToEnd(); len(killed) != 0 {
+		t.Errorf("unexpected killed text: %q", killed)
+	}
+	input.MoveCursorStart()
+	if killed := input.DeleteWordLeft(); len(killed) != 0 {
+		t.Errorf("unexpected killed text: %q", killed)
+	}
+	assertLine(input, "_1sin(x", 0)
+
+	// multi-byte chars are written, moved over and deleted whole
+	input = &TerminalInput{}
+	for _, ch := range "5µ+1" {
+		input.WriteChar(ch)
+	}
+	assertLine(input, "5µ+1", 5)
+	input.MoveCursorLeft()
+	input.MoveCursorLeft()
+	assertLine(input, "5µ+1", 3)
+	input.MoveCursorLeft()
+	assertLine(input, "5µ+1", 1)
+	input.DeleteRight()
+	assertLine(input, "5+1", 1)
+	input.WriteChar('µ')
+	input.DeleteLeft()
+	assertLine(input, "5+1", 1)
+	input.WriteChar('µ')
+	input.MoveCursorStart()
+	input.MoveWordRight()
+	assertLine(input, "5µ+1", 3)
+}
+
+func TestPreviewInput(t *testing.T) {
+	engine := calc.New()
+	if _, err := engine.Eval("A = 2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"A*3", "= 6"},
+		{"A = 5; A+1", "= 6"},
+		{"B = A", "= B = 2"},
+		{"1/0; 2", "error: eval tree: division by 0"},
+		{":precision 10", ""},
+		{" ; ", ""},
+	}
+	for _, test := range tests {
+		if preview := previewInput(test.input, engine); preview != test.expected {
+			t.Errorf("wrong preview: %q: expected %q, got %q", test.input, test.expected, preview)
 		}
 	}
 
-	input = bytes.Trim(input, " \t\r\n")
-	return input
+	if res, _ := engine.Var("A"); res.String() != "2" {
+		t.Errorf("variable changed by the preview: %q", res.String())
+	}
+	if _, exists := engine.Var("B"); exists {
+		t.Errorf("variable assigned by the preview")
+	}
 }
 
-func createRandomInput(random *rand.Rand) []byte {
-	n := random.Int()%100 + 1
-	tokens := []string{
-		"0", "1", "2", "3", "4", "5", "6", "7", "8", "9",
-		".", "+", "-", "*", "/", "//", "%", "v", "**", "(", ")", " ",
-		"sin", "cos", "tan", "asin", "acos", "atan",
-		"a", "b", "c", "d",
+func TestHighlightLine(t *testing.T) {
+	line := "sin(A*(1+x)) + (2"
+	for pos, expected := range map[int]int{3: 11, 11: 3, 6: 10, 10: 6, 15: -1} {
+		if match := matchingBracket(line, pos); match != expected {
+			t.Errorf("wrong matching bracket: %d: expected %d, got %d", pos, expected, match)
+		}
+	}
+
+	engine := calc.New()
+	if _, err := engine.Eval("A = 1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	input := make([]byte, 0, n+8)
+	tokens := engine.Tokens("sin(A)+x")
 
-	for len(input) < n {
-		random.Shuffle(len(tokens), func(i, j int) {
-			tokens[i], tokens[j] = tokens[j], tokens[i]
-		})
-		input = append(input, tokens[0]...)
+	expected := ansiFgGreen + "sin" + ansiReset + "(" + ansiFgBlue + "A" + ansiReset + ")" + ansiFgCyan + "+" + ansiReset + "x"
+	if highlighted := highlightLine(tokens, "sin(A)+x", -1); highlighted != expected {
+		t.Errorf("wrong highlight:\n\texpected %q\n\tgot      %q", expected, highlighted)
 	}
 
-	input = bytes.Trim(input, " \t\r\n")
-	return input
+	// the cursor after ")"
+	expected = ansiFgGreen + "sin" + ansiReset + ansiReverse + "(" + ansiReset + ansiFgBlue + "A" + ansiReset + ansiReverse + ")" + ansiReset + ansiFgCyan + "+" + ansiReset + "x"
+	if highlighted := highlightLine(tokens, "sin(A)+x", 6); highlighted != expected {
+		t.Errorf("wrong highlight:\n\texpected %q\n\tgot      %q", expected, highlighted)
+	}
+
+	tokens = engine.Tokens("(1+[")
+	expected = ansiFgRed + ansiBold + "(" + ansiReset + ansiFgMagenta + "1" + ansiReset + ansiFgCyan + "+" + ansiReset + "["
+	if highlighted := highlightLine(tokens, "(1+[", 0); highlighted != expected {
+		t.Errorf("wrong highlight:\n\texpected %q\n\tgot      %q", expected, highlighted)
+	}
 }
 
-func createRandomBadInput(random *rand.Rand) []byte {
-	n := random.Int()%100 + 1
-	input := make([]byte, 0, n+8)
+func TestMultiLineInput(t *testing.T) {
+	input := &TerminalInput{line: []byte("max(1,\n2\n,30)"), cursorIdx: 5}
+	cursors := []int{}
+	for input.MoveCursorDown() {
+		cursors = append(cursors, input.CursorPosition())
+	}
+	if !slices.Equal(cursors, []int{8, 10}) {
+		t.Errorf("wrong cursor positions moving down: %v", cursors)
+	}
+	input.MoveCursorEnd()
+	if !input.MoveCursorUp() || input.CursorPosition() != 8 {
+		t.Errorf("wrong cursor position moving up: %d", input.CursorPosition())
+	}
+	if !input.MoveCursorUp() || input.CursorPosition() != 1 {
+		t.Errorf("wrong cursor position moving up: %d", input.CursorPosition())
+	}
+	if input.MoveCursorUp() {
+		t.Errorf("moved up from the first line")
+	}
+
+	// the column counts chars, not bytes
+	input = &TerminalInput{line: []byte("2µ+\n3µ"), cursorIdx: 3}
+	if !input.MoveCursorDown() || input.CursorPosition() != 8 {
+		t.Errorf("wrong cursor position moving down: %d", input.CursorPosition())
+	}
+	if !input.MoveCursorUp() || input.CursorPosition() != 3 {
+		t.Errorf("wrong cursor position moving up: %d", input.CursorPosition())
+	}
 
-	for len(input) < n {
-		input = append(input, byte(random.Int()%256))
+	// killing stops at the current line
+	input = &TerminalInput{line: []byte("max(1,\n2+3\n,30)"), cursorIdx: 9}
+	if killed := input.KillToEnd(); string(killed) != "3" {
+		t.Errorf("unexpected killed text: %q", killed)
+	}
+	if killed := input.KillToStart(); string(killed) != "2+" || string(input.line) != "max(1,\n\n,30)" || input.cursorIdx != 7 {
+		t.Errorf("unexpected killed text: %q, line=%q, cursor=%d", killed, input.line, input.cursorIdx)
 	}
 
-	input = bytes.Trim(input, " \t\r\n")
-	return input
+	engine := calc.New()
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"max(1,\n2", true},
+		{"max(1,\n2)", false},
+		{"1 +\n", true},
+		{"f(x) =", true},
+		{"1+1)", false},
+		{"A = 1;", false},
+		{"1+[", false},
+	}
+	for _, test := range tests {
+		tokens := engine.Tokens(inputStatement(test.input))
+		if continues := needsContinuation(tokens); continues != test.expected {
+			t.Errorf("wrong continuation: %q: expected %v, got %v", test.input, test.expected, continues)
+		}
+	}
 }
 
-func testStatement(t *testing.T, vars map[string]float64, input string, expected float64) {
-	t.Helper()
-	errMargin := 0.0000000001
-	res, _, processed, err := EvalStatement([]byte(input), vars)
+func TestSessionFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "work.calc")
+
+	engine := calc.New()
+	for _, statement := range []string{"A = 2", "f(x) = x*A"} {
+		if _, err := engine.Eval(statement); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := saveSession(path, engine, []string{"1+1", "max(1,\n2)"}, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	restored := calc.New()
+	history, err := loadSession(path, restored)
 	if err != nil {
-		t.Errorf("error: input=%q, processed=%q: %v", input, processed, err)
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(history, []string{"1+1", "max(1,\n2)"}) {
+		t.Errorf("unexpected history: %q", history)
+	}
+	if res, err := restored.Eval("f(3)"); err != nil || res.Float64() != 6 {
+		t.Errorf("session not restored: %v: %v", res, err)
+	}
+
+	// loaded quietly, without numbering the results
+	if res, err := restored.Eval("A"); err != nil || res.Number() != 2 {
+		t.Errorf("session results numbered: $%d: %v", res.Number(), err)
+	}
+
+	// only --session creates a missing file, :load reports it
+	if _, err = loadSession(filepath.Join(t.TempDir(), "missing"), restored); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file error expected: %v", err)
 	}
-	if res < expected-errMargin || res > expected+errMargin {
-		t.Errorf("calculation error: input=%q, processed=%q: expected %.20f, got %.20f", input, processed, expected, res)
+
+	// the values are not changed by the fixed-width integer mode
+	engine = calc.New()
+	for _, statement := range []string{"A = 0.5", "B = 300", "C = 1+2i", ":int u8"} {
+		if err := engine.Load(statement); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := saveSession(path, engine, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	restored = calc.New()
+	if _, err := loadSession(path, restored); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if restored.Session() != engine.Session() {
+		t.Errorf("session not restored:\n%s", restored.Session())
 	}
 }
 
-func assertStatementError(t *testing.T, input string) {
-	t.Helper()
-	_, _, _, err := EvalStatement([]byte(input), nil)
-	if err == nil {
-		t.Errorf("error expected: input=%q", input)
+func TestSessionFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "work.calc")
+
+	engine := calc.New()
+	settings := sessionSettings(engine)
+	if _, err := engine.ParseArgs([]string{"--precision=20", "--mode=deg"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	flags := flagSettings(settings, sessionSettings(engine))
+	if len(flags) != 2 || flags["precision"] != (flagSetting{session: "off", flag: "20"}) {
+		t.Errorf("unexpected flags: %v", flags)
+	}
+
+	// the options are not saved, unless changed again
+	if _, err := engine.Command(":precision 30"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := saveSession(path, engine, nil, flags); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	restored := calc.New()
+	if _, err := loadSession(path, restored); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mode, _ := restored.Get("mode"); mode != "rad" {
+		t.Errorf("option saved: mode = %s", mode)
+	}
+	if precision, _ := restored.Get("precision"); precision != "30" {
+		t.Errorf("changed option not saved: precision = %s", precision)
+	}
+}
+
+func TestSessionArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		path string
+		rest []string
+	}{
+		{[]string{"--session=a.calc", "1+1"}, "a.calc", []string{"1+1"}},
+		{[]string{"--precision=10", "--session", "a.calc"}, "a.calc", []string{"--precision=10"}},
+		{[]string{"1+1"}, "", []string{"1+1"}},
+	}
+	for _, test := range tests {
+		path, rest, err := sessionArg(test.args)
+		if err != nil || path != test.path || !slices.Equal(rest, test.rest) {
+			t.Errorf("wrong session arg: %q: got %q, %q: %v", test.args, path, rest, err)
+		}
+	}
+	for _, args := range [][]string{{"--session"}, {"--session="}} {
+		if _, _, err := sessionArg(args); err == nil {
+			t.Errorf("error expected: %q", args)
+		}
+	}
+
+	commands := []struct {
+		line        string
+		name        string
+		path        string
+		withHistory bool
+	}{
+		{":save a.calc", "save", "a.calc", false},
+		{":save --history a.calc", "save", "a.calc", true},
+		{":save --historya.calc", "save", "--historya.calc", false},
+		{": load  a.calc ", "load", "a.calc", false},
+	}
+	for _, test := range commands {
+		name, path, withHistory, ok := parseSessionCommand(test.line)
+		if !ok || name != test.name || path != test.path || withHistory != test.withHistory {
+			t.Errorf("wrong session command: %q: got %q, %q, %v", test.line, name, path, withHistory)
+		}
+	}
+	if _, _, _, ok := parseSessionCommand(":vars"); ok {
+		t.Errorf("not a session command: \":vars\"")
 	}
 }
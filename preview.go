@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/MarcosTypeAP/calc/calc"
+)
+
+// livePreview evaluates the input in the background while it is typed, only
+// the last requested line being evaluated if the previous ones are still
+// waiting.
+type livePreview struct {
+	requests chan previewRequest
+	lastID   int
+}
+
+type previewRequest struct {
+	line string
+	id   int
+}
+
+// newLivePreview starts the goroutine that calls eval with the requested
+// lines, and then show with the id of the request and the preview.
+func newLivePreview(eval func(line string) string, show func(id int, preview string)) *livePreview {
+	p := &livePreview{requests: make(chan previewRequest, 1)}
+	go func() {
+		for req := range p.requests {
+			show(req.id, eval(req.line))
+		}
+	}()
+	return p
+}
+
+// Request replaces the line waiting to be evaluated, if any, and returns the
+// id that show will receive with its preview. It must be called from a single
+// goroutine.
+func (p *livePreview) Request(line string) int {
+	select {
+	case <-p.requests:
+	default:
+	}
+	p.lastID++
+	p.requests <- previewRequest{line: line, id: p.lastID}
+	return p.lastID
+}
+
+// previewInput evaluates the statements of the input in a fork of the engine,
+// returning the last result or the first error, eg: "= 2", "error: ...". The
+// commands are not previewed.
+func previewInput(input string, engine *calc.Engine) string {
+	if strings.HasPrefix(input, ":") {
+		return ""
+	}
+
+	fork := engine.Fork()
+	preview := ""
+	for _, stmt := range strings.Split(input, ";") {
+		stmt = strings.Trim(stmt, " \t\r\n")
+		if len(stmt) == 0 {
+			continue
+		}
+		res, err := fork.Eval(stmt)
+		if err != nil {
+			var perr calc.ParseError
+			if errors.As(err, &perr) {
+				return "error: " + perr.Msg
+			}
+			return "error: " + err.Error()
+		}
+		if len(res.Assigned()) > 0 {
+			preview = "= " + res.Assigned() + " = " + res.String()
+		} else {
+			preview = "= " + res.String()
+		}
+	}
+	return preview
+}
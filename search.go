@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// historySearch is the state of an incremental search in the history, like
+// Ctrl-R in readline.
+type historySearch struct {
+	query    []byte
+	backward bool
+	start    int // entry where the search started
+	idx      int // last matching entry
+	pos      int // of the match in the entry
+	failed   bool
+
+	// state before each char of the query, restored when deleted
+	prev []historySearchState
+}
+
+type historySearchState struct {
+	idx    int
+	pos    int
+	failed bool
+}
+
+func newHistorySearch(start int, backward bool) *historySearch {
+	return &historySearch{backward: backward, start: start, idx: start}
+}
+
+// find looks for the query from the entry at from, skipping the last one,
+// which is the input being written.
+func (s *historySearch) find(history []TerminalInput, from int) {
+	step := 1
+	if s.backward {
+		step = -1
+		from = min(from, len(history)-2)
+	}
+	for i := from; 0 <= i && i < len(history)-1; i += step {
+		line := history[i].Line()
+		pos := strings.Index(line, string(s.query))
+		if s.backward {
+			pos = strings.LastIndex(line, string(s.query))
+		}
+		if pos != -1 {
+			s.idx = i
+			s.pos = pos
+			s.failed = false
+			return
+		}
+	}
+	s.failed = true
+}
+
+func (s *historySearch) WriteChar(history []TerminalInput, char rune) {
+	s.prev = append(s.prev, historySearchState{idx: s.idx, pos: s.pos, failed: s.failed})
+	s.query = utf8.AppendRune(s.query, char)
+	s.find(history, s.idx)
+}
+
+func (s *historySearch) DeleteLeft() {
+	if len(s.query) == 0 {
+		return
+	}
+	_, size := utf8.DecodeLastRune(s.query)
+	s.query = s.query[:len(s.query)-size]
+	prev := s.prev[len(s.prev)-1]
+	s.prev = s.prev[:len(s.prev)-1]
+	s.idx, s.pos, s.failed = prev.idx, prev.pos, prev.failed
+}
+
+// Next looks for the next match in the given direction.
+func (s *historySearch) Next(history []TerminalInput, backward bool) {
+	from := s.idx
+	if len(s.query) > 0 && s.idx < len(history)-1 {
+		if backward {
+			from--
+		} else {
+			from++
+		}
+	}
+	s.backward = backward
+	s.find(history, from)
+}
+
+// Match returns the last matching entry, and the position of the query in it.
+func (s *historySearch) Match(history []TerminalInput) (entry string, pos int, found bool) {
+	if s.idx >= len(history)-1 {
+		return "", 0, false
+	}
+	return history[s.idx].Line(), s.pos, true
+}
+
+// Prompt returns the text shown before the match, eg: "(reverse-i-search)`1+': ".
+func (s *historySearch) Prompt() string {
+	prompt := "i-search"
+	if s.backward {
+		prompt = "reverse-" + prompt
+	}
+	if s.failed {
+		prompt = "failed " + prompt
+	}
+	return "(" + prompt + ")`" + string(s.query) + "': "
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/MarcosTypeAP/calc/calc"
+)
+
+// History entries are saved in sessions as comments with this prefix, so they
+// are ignored when the session is evaluated.
+const sessionHistoryPrefix = "#> "
+
+// flagSetting is a setting changed by a command line option, which is not
+// saved in the session unless it is changed again.
+type flagSetting struct {
+	session string // the value before the option
+	flag    string
+}
+
+// sessionSettings returns the settings of the engine by name, as written in
+// its session.
+func sessionSettings(engine *calc.Engine) map[string]string {
+	settings := map[string]string{}
+	for _, line := range strings.Split(engine.Session(), "\n") {
+		if command, ok := strings.CutPrefix(line, ":"); ok {
+			name, value, _ := strings.Cut(command, " ")
+			settings[name] = value
+		}
+	}
+	return settings
+}
+
+// flagSettings returns the settings that changed from before to after
+// applying the command line options.
+func flagSettings(before map[string]string, after map[string]string) map[string]flagSetting {
+	flags := map[string]flagSetting{}
+	for name, value := range after {
+		if before[name] != value {
+			flags[name] = flagSetting{session: before[name], flag: value}
+		}
+	}
+	return flags
+}
+
+// saveSession writes the settings, variables and definitions of the engine
+// as a text file that restores them when evaluated, followed by the history
+// entries if any. The settings still with the value of their flags are saved
+// with their previous value.
+func saveSession(path string, engine *calc.Engine, history []string, flags map[string]flagSetting) error {
+	builder := strings.Builder{}
+	builder.WriteString("# sweet-calc session\n")
+	for _, line := range strings.SplitAfter(engine.Session(), "\n") {
+		if command, ok := strings.CutPrefix(line, ":"); ok {
+			name, value, _ := strings.Cut(strings.TrimSuffix(command, "\n"), " ")
+			if flag, ok := flags[name]; ok && value == flag.flag {
+				line = ":" + name + " " + flag.session + "\n"
+			}
+		}
+		builder.WriteString(line)
+	}
+	for _, entry := range history {
+		builder.WriteString(sessionHistoryPrefix + historyEscaper.Replace(entry) + "\n")
+	}
+	if err := os.WriteFile(path, []byte(builder.String()), 0o600); err != nil {
+		return fmt.Errorf("session: %w", err)
+	}
+	return nil
+}
+
+// loadSession evaluates a session file quietly, and returns its history
+// entries.
+func loadSession(path string, engine *calc.Engine) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("session: %w", err)
+	}
+
+	if err := engine.Load(string(data)); err != nil {
+		return nil, prefixError("session", err)
+	}
+
+	history := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if entry, ok := strings.CutPrefix(line, sessionHistoryPrefix); ok {
+			history = append(history, historyUnescaper.Replace(entry))
+		}
+	}
+	return history, nil
+}
+
+// sessionArg removes the "--session=file" or "--session file" option from the
+// arguments, returning its file.
+func sessionArg(args []string) (path string, rest []string, err error) {
+	rest = make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case strings.HasPrefix(arg, "--session="):
+			path = strings.TrimPrefix(arg, "--session=")
+		case arg == "--session":
+			if i+1 >= len(args) {
+				return "", nil, errors.New("option \"session\": missing file")
+			}
+			i++
+			path = args[i]
+		default:
+			rest = append(rest, arg)
+			continue
+		}
+		if path == "" {
+			return "", nil, errors.New("option \"session\": missing file")
+		}
+	}
+	return path, rest, nil
+}
+
+// parseSessionCommand parses the ":save [--history] file" and ":load file"
+// commands, which are run by the REPL instead of the engine. ok is false for
+// other input.
+func parseSessionCommand(line string) (name string, path string, withHistory bool, ok bool) {
+	command, isCommand := strings.CutPrefix(line, ":")
+	if !isCommand {
+		return "", "", false, false
+	}
+	name, path, _ = strings.Cut(strings.TrimSpace(command), " ")
+	if name != "save" && name != "load" {
+		return "", "", false, false
+	}
+	path = strings.TrimSpace(path)
+	if rest, found := strings.CutPrefix(path, "--history"); name == "save" && found && (rest == "" || rest[0] == ' ') {
+		path, withHistory = strings.TrimSpace(rest), true
+	}
+	return name, path, withHistory, true
+}